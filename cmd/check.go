@@ -0,0 +1,329 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	checkCmd.Flags().
+		StringSliceP("recursive", "r", nil, "Comma delimited list of paths to check every template in, as anchor -r does, and check that their anchored Dockerfiles pin each image and package the same way")
+	checkCmd.Flags().
+		StringSliceP("pattern", "", nil, "Comma delimited list of glob patterns of the template names to check with --recursive")
+	rootCmd.AddCommand(checkCmd)
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check that the anchored Dockerfile is up to date with its template",
+	Long: "Check renders the template with the image digests and package versions already " +
+		"pinned in the anchored Dockerfile and compares the result with it, ignoring comments " +
+		"and formatting. Nothing is resolved, so neither Docker nor network access is needed. " +
+		"It exits with a non-zero status when the Dockerfile or its package lists differ. With " +
+		"--recursive, every template of a workspace is checked, and so is that their anchored " +
+		"Dockerfiles pin each image, and each package for a base image and architecture, to " +
+		"the same digest and version.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		paths, err := cmd.Flags().GetStringSlice("recursive")
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return checkWorkspace(cmd, paths)
+		}
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		architectures, err := cmd.Flags().GetString("architectures")
+		if err != nil {
+			return err
+		}
+		contextDir, err := getContextDir(cmd, input)
+		if err != nil {
+			return err
+		}
+		targets, err := anchoredFiles(output, architectures)
+		if err != nil {
+			return err
+		}
+
+		mismatches := []anchor.Mismatch{}
+		for _, target := range targets {
+			targetMismatches, err := checkOutput(
+				cmd.Context(), input, contextDir, target, len(targets) > 1,
+			)
+			if err != nil {
+				return err
+			}
+			mismatches = append(mismatches, targetMismatches...)
+		}
+		for _, mismatch := range mismatches {
+			fmt.Println(mismatch.String())
+		}
+		if len(mismatches) > 0 {
+			return fmt.Errorf(
+				"%d difference(s) between %s and its anchored output, run anchor to regenerate it",
+				len(mismatches),
+				input,
+			)
+		}
+		for _, target := range targets {
+			color.Green("%s is up to date with %s", target.output, input)
+		}
+		return nil
+	},
+}
+
+// checkWorkspace checks every template in the paths against its anchored Dockerfiles, and
+// that the anchored Dockerfiles are consistent with each other.
+func checkWorkspace(cmd *cobra.Command, paths []string) error {
+	patterns, err := cmd.Flags().GetStringSlice("pattern")
+	if err != nil {
+		return err
+	}
+	architectures, err := cmd.Flags().GetString("architectures")
+	if err != nil {
+		return err
+	}
+	templates, err := anchor.FindTemplates(paths, patterns)
+	if err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return fmt.Errorf("no templates found in %s", strings.Join(paths, ", "))
+	}
+
+	mismatches := []anchor.Mismatch{}
+	files := []anchor.PinnedFile{}
+	for _, template := range templates {
+		output, err := anchor.TemplateOutput(template)
+		if err != nil {
+			return err
+		}
+		contextDir, err := getContextDir(cmd, template)
+		if err != nil {
+			return err
+		}
+		targets, err := anchoredFiles(output, architectures)
+		if err != nil {
+			mismatches = append(mismatches, anchor.Mismatch{
+				File:    output,
+				Message: "anchored Dockerfile is missing",
+			})
+			continue
+		}
+		for _, target := range targets {
+			targetMismatches, err := checkOutput(
+				cmd.Context(), template, contextDir, target, len(targets) > 1,
+			)
+			if err != nil {
+				return err
+			}
+			mismatches = append(mismatches, targetMismatches...)
+			nodes, err := readNodes(target.output)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			platforms, err := mergedPlatforms(nodes)
+			if err != nil {
+				return err
+			}
+			if platforms == nil {
+				pins, err := anchor.ReadPins(nodes, contextDir)
+				if err != nil {
+					return err
+				}
+				files = append(files, anchor.PinnedFile{Name: target.output, Pins: pins})
+			}
+			// a multi-arch Dockerfile pins the packages of each platform it is merged from
+			for _, platform := range platforms {
+				pins, err := anchor.ReadPlatformPins(nodes, contextDir, platform)
+				if err != nil {
+					return err
+				}
+				files = append(files, anchor.PinnedFile{Name: target.output, Pins: pins})
+			}
+		}
+	}
+	inconsistencies := anchor.CheckConsistency(files)
+
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch.String())
+	}
+	for _, inconsistency := range inconsistencies {
+		fmt.Println(inconsistency.String())
+	}
+	if len(mismatches) > 0 || len(inconsistencies) > 0 {
+		return fmt.Errorf(
+			"%d difference(s) and %d inconsistent pin(s) in %d template(s), run anchor -r to "+
+				"anchor them together",
+			len(mismatches),
+			len(inconsistencies),
+			len(templates),
+		)
+	}
+	color.Green("%d template(s) are up to date and pinned consistently", len(templates))
+	return nil
+}
+
+// anchoredFile is an anchored Dockerfile, with the platform it was anchored to, which is
+// read from the Dockerfile when zero.
+type anchoredFile struct {
+	output   string
+	platform v1.Platform
+}
+
+// anchoredFiles returns the anchored Dockerfiles of the output flag. Without architectures,
+// it is the output when it exists and the files anchored per architecture otherwise, e.g.
+// Dockerfile.amd64 and Dockerfile.arm64, as they are with all. An output merged with
+// --multi-arch is the only anchored Dockerfile, whatever the architectures.
+func anchoredFiles(output string, architectures string) ([]anchoredFile, error) {
+	nodes, err := readNodes(output)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if anchor.MergedPlatforms(nodes) != nil {
+		return []anchoredFile{{output: output}}, nil
+	}
+	if architectures != "" && architectures != "all" {
+		values := strings.Split(architectures, ",")
+		targets := []anchoredFile{}
+		for _, value := range values {
+			platform, err := anchor.ParsePlatform(value)
+			if err != nil {
+				return nil, err
+			}
+			name := output
+			if len(values) > 1 {
+				architecture, err := anchor.DpkgArchitecture(platform)
+				if err != nil {
+					return nil, err
+				}
+				name = fmt.Sprintf("%s.%s", output, architecture)
+			}
+			targets = append(targets, anchoredFile{output: name, platform: platform})
+		}
+		return targets, nil
+	}
+	if _, err := os.Stat(output); err == nil && architectures == "" {
+		return []anchoredFile{{output: output}}, nil
+	}
+	matches, err := filepath.Glob(output + ".*")
+	if err != nil {
+		return nil, err
+	}
+	targets := []anchoredFile{}
+	for _, match := range matches {
+		platform, err := anchor.DpkgPlatform(strings.TrimPrefix(filepath.Ext(match), "."))
+		if err == nil {
+			targets = append(targets, anchoredFile{output: match, platform: platform})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s does not exist, run anchor to generate it", output)
+	}
+	return targets, nil
+}
+
+// resolvePlatform returns the platform the Dockerfile was anchored to, which is read from the
+// architecture its packages were anchored for when it is not known. A Dockerfile without
+// packages is taken to be anchored for the system platform.
+func (f anchoredFile) resolvePlatform(nodes []anchor.Node, contextDir string) (v1.Platform, error) {
+	if f.platform.Architecture != "" {
+		return f.platform, nil
+	}
+	pins, err := anchor.ReadPins(nodes, contextDir)
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	if pins.Architecture != "" {
+		return anchor.DpkgPlatform(pins.Architecture)
+	}
+	architecture, err := getArchitecture()
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	return anchor.ParsePlatform(architecture)
+}
+
+// checkOutput checks an anchored Dockerfile against the template.
+func checkOutput(
+	ctx context.Context, input string, contextDir string, target anchoredFile, appendArch bool,
+) ([]anchor.Mismatch, error) {
+	template, err := readNodes(input)
+	if err != nil {
+		return nil, err
+	}
+	output, err := readNodes(target.output)
+	if errors.Is(err, os.ErrNotExist) {
+		return []anchor.Mismatch{{
+			File:    target.output,
+			Message: "anchored Dockerfile is missing",
+		}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a multi-arch Dockerfile is checked for each platform it is merged from
+	platform := target.platform
+	if anchor.MergedPlatforms(output) == nil {
+		platform, err = target.resolvePlatform(output, contextDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return anchor.Check(ctx, template, output, target.output, anchor.Config{
+		Platform:           platform,
+		ContextDir:         contextDir,
+		AppendArchitecture: appendArch,
+		// the progress of rendering the template is not of interest, only the differences are
+		Output: io.Discard,
+	})
+}
+
+// mergedPlatforms returns the platforms an anchored Dockerfile was merged from with
+// --multi-arch, or nil when it is anchored to a single platform.
+func mergedPlatforms(nodes anchor.Nodes) ([]v1.Platform, error) {
+	values := anchor.MergedPlatforms(nodes)
+	if values == nil {
+		return nil, nil
+	}
+	platforms := []v1.Platform{}
+	for _, value := range values {
+		platform, err := anchor.ParsePlatform(value)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+func readNodes(name string) (anchor.Nodes, error) {
+	file, err := os.Open(filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return anchor.Parse(file), nil
+}
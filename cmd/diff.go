@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+// ExitChangesPending is the exit status of anchor diff when the anchored files are not up to
+// date, so that it can be told apart from a failure.
+const ExitChangesPending = 2
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the changes anchoring would make as a unified diff",
+	Long: "Diff resolves the images and packages of the template like anchor does and prints a " +
+		"unified diff between the existing anchored Dockerfile, and the package lists generated " +
+		"with it, and the new rendering for every architecture. Nothing is written. It exits " +
+		"with status 2 when there are changes pending.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			cancel()
+			os.Exit(1)
+		}()
+
+		// the progress goes to stderr so that stdout is only the diff
+		renderings, err := render(ctx, cmd, nil, os.Stderr)
+		if err != nil {
+			return err
+		}
+
+		pending := false
+		for _, rendering := range renderings {
+			var sb strings.Builder
+			if err := rendering.nodes.Write(&sb); err != nil {
+				return err
+			}
+			files := append(
+				[]anchor.File{{Path: rendering.output, Content: []byte(sb.String())}},
+				rendering.files...,
+			)
+			for _, file := range files {
+				changed, err := printDiff(file)
+				if err != nil {
+					return err
+				}
+				pending = pending || changed
+			}
+		}
+		if pending {
+			return &exitError{
+				code: ExitChangesPending,
+				err:  fmt.Errorf("changes are pending, run anchor to apply them"),
+			}
+		}
+		color.New(color.FgGreen).Fprintln(
+			os.Stderr, "No changes, the anchored files are up to date",
+		)
+		return nil
+	},
+}
+
+// printDiff prints the changes to a file as a colourised unified diff, reporting whether
+// there are any.
+func printDiff(file anchor.File) (bool, error) {
+	name := filepath.ToSlash(file.Path)
+	oldName := "a/" + name
+	current, err := os.ReadFile(filepath.Clean(file.Path))
+	if errors.Is(err, fs.ErrNotExist) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return false, err
+	}
+	diff := anchor.UnifiedDiff(oldName, "b/"+name, current, file.Content)
+	if diff == "" {
+		return false, nil
+	}
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++"):
+			color.New(color.Bold).Fprint(os.Stdout, line)
+		case strings.HasPrefix(line, "@@"):
+			color.New(color.FgCyan).Fprint(os.Stdout, line)
+		case strings.HasPrefix(line, "-"):
+			color.New(color.FgRed).Fprint(os.Stdout, line)
+		case strings.HasPrefix(line, "+"):
+			color.New(color.FgGreen).Fprint(os.Stdout, line)
+		default:
+			fmt.Fprint(os.Stdout, line)
+		}
+	}
+	return true, nil
+}
+
+// exitError is an error that exits anchor with a status other than 1.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the status anchor exits with for an error returned by Execute.
+func ExitCode(err error) int {
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.code
+	}
+	return 1
+}
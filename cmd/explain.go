@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	explainCmd.Flags().
+		StringP("format", "f", "text", "Output format: \"text\" or \"json\"")
+	rootCmd.AddCommand(explainCmd)
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "Explain what anchoring does to each stage of the template, and why",
+	Long: "Explain resolves the template like anchor does and prints each stage with its base " +
+		"image, and what anchoring does to each image and package: whether it is pinned, " +
+		"ignored, already pinned, unsupported or set with a variable, and why apt chose the " +
+		"version it is pinned to. Nothing is written.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			cancel()
+			os.Exit(1)
+		}()
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		if format != "text" && format != "json" {
+			return fmt.Errorf("unsupported format: %s", format)
+		}
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			return err
+		}
+		architectures, err := cmd.Flags().GetString("architectures")
+		if err != nil {
+			return err
+		}
+		if architectures == "" {
+			architectures, err = getArchitecture()
+			if err != nil {
+				return err
+			}
+		}
+		contextDir, err := getContextDir(cmd, input)
+		if err != nil {
+			return err
+		}
+		resolver, err := getResolver(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		nodes, err := readNodes(input)
+		if err != nil {
+			return err
+		}
+
+		platforms, err := anchor.ResolvePlatforms(ctx, nodes, strings.Split(architectures, ","))
+		if err != nil {
+			return err
+		}
+		plans := []*anchor.Plan{}
+		for _, platform := range platforms {
+			// the progress goes to stderr so that stdout is only the plan
+			color.New(color.FgCyan).Fprintf(
+				os.Stderr, "Explaining %s for platform %s\n", input, platform.String(),
+			)
+			plan, err := anchor.Explain(ctx, nodes, anchor.Config{
+				Platform:           platform,
+				ContextDir:         contextDir,
+				AppendArchitecture: len(platforms) > 1,
+				Resolver:           resolver,
+				ProxyEnv:           anchor.ProxyEnvironment(),
+				Output:             os.Stderr,
+			})
+			if err != nil {
+				return err
+			}
+			plans = append(plans, plan)
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(plans)
+		}
+		for _, plan := range plans {
+			if err := writePlan(os.Stdout, plan); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// writePlan writes the plan of a platform as a table of dependencies per stage.
+func writePlan(w io.Writer, plan *anchor.Plan) error {
+	fmt.Fprintf(w, "Platform %s\n", plan.Platform)
+	for _, stage := range plan.Stages {
+		switch {
+		case stage.BaseStage != "":
+			fmt.Fprintf(w, "\nStage %s: builds on the %s stage\n", stage.Name, stage.BaseStage)
+		case stage.Anchored != stage.Image:
+			fmt.Fprintf(w, "\nStage %s: %s -> %s\n", stage.Name, stage.Image, stage.Anchored)
+		default:
+			fmt.Fprintf(w, "\nStage %s: %s\n", stage.Name, stage.Image)
+		}
+		if len(stage.Dependencies) == 0 {
+			continue
+		}
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "  LINE\tKIND\tNAME\tACTION\tVERSION\tREASON")
+		for _, dependency := range stage.Dependencies {
+			fmt.Fprintf(
+				table,
+				"  %d\t%s\t%s\t%s\t%s\t%s\n",
+				dependency.Line,
+				dependency.Kind,
+				valueOrDash(dependency.Name),
+				dependency.Action,
+				valueOrDash(shortDigest(dependency.Version)),
+				dependency.Reason,
+			)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
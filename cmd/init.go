@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init [dockerfile]",
+	Short: "Convert an existing Dockerfile into a template",
+	Long: "Init turns a Dockerfile that was pinned by hand or by anchor back into a template, " +
+		"written to the input file. Digests of tagged images, apt package versions and the " +
+		"dpkg --add-architecture prefix anchor injects are removed, and package lists copied " +
+		"from a lock file are copied from an unpinned list instead. Pins anchor cannot " +
+		"refresh, such as images referenced only by digest, are kept with an anchor ignore " +
+		"comment. The Dockerfile defaults to the output file.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		source, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			source = args[0]
+		}
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			return err
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return err
+		}
+
+		nodes, err := readNodes(source)
+		if err != nil {
+			return err
+		}
+		color.Cyan("Converting %s into a template\n", source)
+		contextDir, err := getContextDir(cmd, source)
+		if err != nil {
+			return err
+		}
+		result, err := anchor.MakeTemplate(nodes, contextDir)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			color.Green("Generated template\n")
+			nodes.Write(os.Stdout)
+			for _, file := range result.Files {
+				color.Green("Generated %s\n", file.Path)
+				os.Stdout.Write(file.Content)
+			}
+			return nil
+		}
+
+		files := []anchor.File{}
+		for _, file := range result.Files {
+			// lists the template shares with other Dockerfiles are left as they are
+			if _, err := os.Stat(file.Path); err == nil {
+				color.Yellow("Kept the existing package list %s", file.Path)
+				continue
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			files = append(files, file)
+		}
+
+		absPath, err := filepath.Abs(input)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absPath); err == nil && !yes {
+			color.Yellow("File %s already exists. Overwrite? (y/n)", absPath)
+			reader := bufio.NewReader(os.Stdin)
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.ToLower(response) != "y\n" {
+				color.Green("Generated template\n")
+				nodes.Write(os.Stdout)
+				return fmt.Errorf("exiting without writing file")
+			}
+		}
+
+		var sb strings.Builder
+		if err := nodes.Write(&sb); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Clean(input), []byte(sb.String()), 0o600); err != nil {
+			return fmt.Errorf("failed to write template: %w", err)
+		}
+		color.Green("Generated template: %s", absPath)
+		for _, file := range files {
+			err = os.WriteFile(filepath.Clean(file.Path), file.Content, 0o600)
+			if err != nil {
+				return fmt.Errorf("failed to write %s: %w", file.Path, err)
+			}
+			color.Green("Generated %s", file.Path)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	lintCmd.Flags().
+		StringP("format", "f", "text", "Output format: \"text\", \"json\" or \"sarif\"")
+	rootCmd.AddCommand(lintCmd)
+}
+
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Report the dependencies of the template that anchoring leaves floating",
+	Long: "Lint reads the template and reports every dependency anchor cannot pin, such as " +
+		"packages of other package managers, scripts piped from curl into a shell, images " +
+		"using the latest tag and images or packages set with variables, with the rule and " +
+		"where it is in the template. Nothing is resolved. It exits with a non-zero status " +
+		"when there are findings.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		if format != "text" && format != "json" && format != "sarif" {
+			return fmt.Errorf("unsupported format: %s", format)
+		}
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			return err
+		}
+		nodes, err := readNodes(input)
+		if err != nil {
+			return err
+		}
+
+		findings := anchor.Lint(nodes, input)
+		switch format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(findings); err != nil {
+				return err
+			}
+		case "sarif":
+			log, err := anchor.SARIF(findings, version)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(log))
+		default:
+			for _, finding := range findings {
+				fmt.Println(finding.String())
+			}
+		}
+		if len(findings) > 0 {
+			return fmt.Errorf("%d finding(s) in %s", len(findings), input)
+		}
+		if format == "text" {
+			color.Green("No findings in %s", input)
+		}
+		return nil
+	},
+}
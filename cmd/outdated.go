@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	outdatedCmd.Flags().
+		StringP("format", "f", "table", "Output format: \"table\" or \"json\"")
+	outdatedCmd.Flags().
+		BoolP("all", "", false, "List every pinned image and package, not only the outdated ones")
+	rootCmd.AddCommand(outdatedCmd)
+}
+
+var outdatedCmd = &cobra.Command{
+	Use:   "outdated",
+	Short: "List the pinned images and packages that have newer versions",
+	Long: "Outdated reads the anchored Dockerfile and compares each pinned image digest with the " +
+		"current digest of its tag, and each pinned package version with the version apt " +
+		"would install now. The anchored Dockerfile is not changed.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			cancel()
+			os.Exit(1)
+		}()
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		if format != "table" && format != "json" {
+			return fmt.Errorf("unsupported format: %s", format)
+		}
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			return err
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		architectures, err := cmd.Flags().GetString("architectures")
+		if err != nil {
+			return err
+		}
+		input, err := cmd.Flags().GetString("input")
+		if err != nil {
+			return err
+		}
+		contextDir, err := getContextDir(cmd, input)
+		if err != nil {
+			return err
+		}
+		resolver, err := getResolver(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		targets, err := anchoredFiles(output, architectures)
+		if err != nil {
+			return err
+		}
+
+		dependencies := []anchor.Dependency{}
+		for _, target := range targets {
+			nodes, err := readNodes(target.output)
+			if err != nil {
+				return err
+			}
+			// a multi-arch Dockerfile is checked for each platform it is merged from
+			platforms, err := mergedPlatforms(nodes)
+			if err != nil {
+				return err
+			}
+			appendArch := len(targets) > 1 || platforms != nil
+			if platforms == nil {
+				platform, err := target.resolvePlatform(nodes, contextDir)
+				if err != nil {
+					return err
+				}
+				platforms = []v1.Platform{platform}
+			}
+			for _, platform := range platforms {
+				// the progress goes to stderr so that stdout is only the report
+				color.New(color.FgCyan).Fprintf(
+					os.Stderr, "Checking %s for platform %s\n", target.output, platform.String(),
+				)
+				platformDependencies, err := anchor.Outdated(ctx, nodes, anchor.Config{
+					Platform:           platform,
+					ContextDir:         contextDir,
+					AppendArchitecture: appendArch,
+					Resolver:           resolver,
+					ProxyEnv:           anchor.ProxyEnvironment(),
+					Output:             os.Stderr,
+				})
+				if err != nil {
+					return err
+				}
+				dependencies = append(dependencies, platformDependencies...)
+			}
+		}
+
+		listed := []anchor.Dependency{}
+		for _, dependency := range dependencies {
+			// an image is listed once, not for every architecture it was checked for
+			if dependency.Kind == "image" && containsDependency(listed, dependency) {
+				continue
+			}
+			if all || dependency.IsOutdated() {
+				listed = append(listed, dependency)
+			}
+		}
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(listed)
+		}
+		if len(listed) == 0 {
+			color.Green("Everything is up to date")
+			return nil
+		}
+		return writeDependencies(os.Stdout, listed)
+	},
+}
+
+func containsDependency(dependencies []anchor.Dependency, dependency anchor.Dependency) bool {
+	for _, listed := range dependencies {
+		if listed.Kind == dependency.Kind && listed.Name == dependency.Name &&
+			listed.Stage == dependency.Stage {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDependencies writes the dependencies as a table, with digests shortened.
+func writeDependencies(w io.Writer, dependencies []anchor.Dependency) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "IMAGE/PACKAGE\tSTAGE\tARCH\tPINNED\tLATEST")
+	for _, dependency := range dependencies {
+		latest := shortDigest(dependency.Latest)
+		if dependency.Error != "" {
+			latest = "unavailable: " + dependency.Error
+		}
+		fmt.Fprintf(
+			table,
+			"%s\t%s\t%s\t%s\t%s\n",
+			dependency.Name,
+			dependency.Stage,
+			valueOrDash(dependency.Architecture),
+			valueOrDash(shortDigest(dependency.Pinned)),
+			valueOrDash(latest),
+		)
+	}
+	return table.Flush()
+}
+
+// shortDigest shortens a digest to 12 characters of its hash, as docker prints image IDs.
+func shortDigest(value string) string {
+	algorithm, hash, ok := strings.Cut(value, ":")
+	if !ok || !strings.HasPrefix(algorithm, "sha") || len(hash) <= 12 {
+		return value
+	}
+	return algorithm + ":" + hash[:12]
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+// templateResult is the outcome of anchoring one template of a recursive run.
+type templateResult struct {
+	template   string
+	renderings []rendering
+	// output is the progress of anchoring the template, with its warnings
+	output string
+	err    error
+}
+
+// anchorRecursive anchors every template found in the paths, several at a time. The
+// resolvers and their caches are shared, so each image tag, and each package for a base
+// image and architecture, is resolved once for the whole run and pinned the same way in
+// every template.
+func anchorRecursive(cmd *cobra.Command, paths []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+		os.Exit(1)
+	}()
+
+	patterns, err := cmd.Flags().GetStringSlice("pattern")
+	if err != nil {
+		return err
+	}
+	jobs, err := cmd.Flags().GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	if jobs < 1 {
+		return fmt.Errorf("jobs must be at least 1, got %d", jobs)
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+	options, err := getOptions(cmd)
+	if err != nil {
+		return err
+	}
+
+	templates, err := anchor.FindTemplates(paths, patterns)
+	if err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return fmt.Errorf("no templates found in %s", strings.Join(paths, ", "))
+	}
+	if !dryRun && !yes {
+		color.Yellow(
+			"Anchor %d template(s), overwriting their anchored Dockerfiles? (y/n)", len(templates),
+		)
+		reader := bufio.NewReader(os.Stdin)
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(response) != "y\n" {
+			return fmt.Errorf("exiting without writing files")
+		}
+	}
+	var resolver anchor.PackageResolver
+	if options.Locked == nil {
+		resolver, err = getResolver(ctx, cmd)
+		if err != nil {
+			return err
+		}
+	}
+	packages := &anchor.PackageCache{Resolver: resolver}
+	cache := &anchor.RegistryCache{}
+
+	// the progress of templates anchored at the same time would be interleaved, so the
+	// progress of each template is collected and printed with its outcome
+	color.Cyan("Anchoring %d template(s)", len(templates))
+
+	results := make([]templateResult, len(templates))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, jobs)
+	for i, template := range templates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = anchorTemplate(ctx, template, options, packages, cache, dryRun)
+			mu.Lock()
+			defer mu.Unlock()
+			printResult(color.Output, results[i])
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	locked := []rendering{}
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			continue
+		}
+		if dryRun {
+			for _, rendering := range result.renderings {
+				printRendering(rendering)
+			}
+		}
+		locked = append(locked, result.renderings...)
+	}
+	// the templates that failed keep what the lockfile records for them
+	if !dryRun && options.Locked == nil && len(locked) > 0 {
+		if err := lockRenderings(cmd, locked); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d template(s) failed to anchor", failed, len(templates))
+	}
+	color.Green("Anchored %d template(s)", len(templates))
+	return nil
+}
+
+// anchorTemplate anchors a template to the platforms of the options, writing the anchored
+// Dockerfiles unless it is a dry run.
+func anchorTemplate(
+	ctx context.Context,
+	template string,
+	options Options,
+	resolver anchor.PackageResolver,
+	cache *anchor.RegistryCache,
+	dryRun bool,
+) templateResult {
+	result := templateResult{template: template}
+	output, err := anchor.TemplateOutput(template)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	var progress bytes.Buffer
+	options.InputFile = template
+	options.OutputFile = output
+	options.Output = &progress
+	result.renderings, result.err = renderTemplate(ctx, options, resolver, cache, nil)
+	// the platforms that were resolved are written even when others failed, as anchor does
+	// for a single template
+	for _, rendering := range result.renderings {
+		if dryRun {
+			break
+		}
+		if err := writeRendering(&progress, rendering); err != nil {
+			result.err = err
+			break
+		}
+	}
+	result.output = progress.String()
+	return result
+}
+
+// printResult prints whether a template was anchored, and what to, followed by the progress
+// of anchoring it and its warnings.
+func printResult(w io.Writer, result templateResult) {
+	if result.err != nil {
+		color.New(color.FgRed).Fprintf(w, "✘ %s: %s\n", result.template, result.err)
+	} else {
+		outputs := []string{}
+		for _, rendering := range result.renderings {
+			outputs = append(outputs, rendering.output)
+		}
+		color.New(color.FgGreen).Fprintf(
+			w, "⚓ %s: %s\n", result.template, strings.Join(outputs, ", "),
+		)
+	}
+	io.WriteString(w, result.output)
+}
@@ -3,15 +3,20 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fatih/color"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/cobra"
 
 	"github.com/songstitch/anchor/pkg/anchor"
@@ -21,6 +26,14 @@ type Options struct {
 	Architectures []string
 	OutputFile    string
 	InputFile     string
+	// ContextDir is the build context of the input, the directory of the input when empty
+	ContextDir string
+	// Locked renders the template from the pins of the lockfile instead of resolving them
+	Locked *anchor.LockFile
+	// MultiArch merges the platforms into a single Dockerfile instead of one per architecture
+	MultiArch bool
+	// Output is where the progress of anchoring is written, color.Output when it is nil
+	Output io.Writer
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -39,11 +52,31 @@ func init() {
 	rootCmd.PersistentFlags().
 		StringP("output", "o", "Dockerfile", "Name of the output dockerfile. If using multiple architectures, the architecture will be appended to the output file name")
 	rootCmd.PersistentFlags().
-		StringP("architectures", "a", "", "Comma delimited list of architectures to anchor: \"amd64\" and \"arm64\" are supported. If the flag is not used, the system architecture will be used")
+		StringP("architectures", "a", "", "Comma delimited list of platforms to anchor, e.g. \"amd64\", \"arm64\", \"linux/arm/v7\", \"386\", \"ppc64le\", \"s390x\" or \"riscv64\", or \"all\" for every platform of the base images. If the flag is not used, the system platform will be used")
+	rootCmd.PersistentFlags().
+		StringP("context", "", "", "Build context that COPY sources, such as package lists, are read from and the package lock files are written to. Defaults to the directory of the input")
 	rootCmd.PersistentFlags().
 		BoolP("dry-run", "", false, "Write the output to stdout instead of a file")
 	rootCmd.PersistentFlags().
 		BoolP("yes", "y", false, "Write the output to the file without confirmation when the file exists. This will overwrite the file")
+	rootCmd.PersistentFlags().
+		StringP("resolver", "", "container", "How package versions are resolved: \"container\" runs apt inside a container, \"registry\" reads the image from the registry and the apt indices directly, without a container runtime")
+	rootCmd.PersistentFlags().
+		StringP("runtime", "", "auto", "Container runtime used by the container resolver: \"docker\", \"podman\" or \"nerdctl\". \"auto\" uses the first one that is installed and running")
+	rootCmd.PersistentFlags().
+		StringP("apt-mirror", "", "", "Replace the scheme and host of every apt source with this URL when using the registry resolver, e.g. http://localhost:8080")
+	rootCmd.PersistentFlags().
+		StringP("lockfile", "", "", "Lockfile to record the image digests and package versions of every anchored Dockerfile in, e.g. \""+anchor.LockFileName+"\". No lockfile is written when it is not set")
+	rootCmd.Flags().
+		StringSliceP("recursive", "r", nil, "Comma delimited list of paths to anchor every template in instead of the input, e.g. \"./services/...\" for ./services and its subdirectories. Each template is anchored to its name without the .template suffix")
+	rootCmd.Flags().
+		StringSliceP("pattern", "", nil, "Comma delimited list of glob patterns of the template names to anchor with --recursive, e.g. \"*.Dockerfile.template\". Defaults to Dockerfile.template and Containerfile.template")
+	rootCmd.Flags().
+		IntP("jobs", "j", 4, "Number of templates anchored at the same time with --recursive")
+	rootCmd.Flags().
+		BoolP("locked", "", false, "Render the anchored Dockerfiles from their templates and the pins of the lockfile, without resolving anything. The lockfile is \""+anchor.LockFileName+"\" unless --lockfile is set")
+	rootCmd.Flags().
+		BoolP("multi-arch", "", false, "Write a single Dockerfile for every platform, which installs the packages of each with a case on TARGETARCH, instead of a Dockerfile per architecture")
 
 }
 
@@ -54,128 +87,580 @@ var rootCmd = &cobra.Command{
 	SilenceUsage:  true,
 	SilenceErrors: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx, cancel := context.WithCancel(context.Background())
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			cancel()
-			os.Exit(1)
-		}()
-
-		if anchor.IsDockerInstalled() {
-			if !anchor.IsDockerRunning() {
-				return fmt.Errorf("docker is not running")
-			}
-		} else {
-			return fmt.Errorf("docker is not installed")
-		}
-
-		output, err := cmd.Flags().GetString("output")
+		paths, err := cmd.Flags().GetStringSlice("recursive")
 		if err != nil {
 			return err
 		}
-		architectures, err := cmd.Flags().GetString("architectures")
+		if len(paths) > 0 {
+			return anchorRecursive(cmd, paths)
+		}
+		return anchorFiles(cmd, nil)
+	},
+}
+
+// anchorFiles anchors the input to every platform and writes the anchored Dockerfiles. With a
+// selection, only what it selects is resolved again and the rest keeps the pins of the
+// existing output.
+func anchorFiles(cmd *cobra.Command, selection *anchor.Selection) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+		os.Exit(1)
+	}()
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+	locked, err := getRootFlag(cmd, "locked")
+	if err != nil {
+		return err
+	}
+
+	renderings, renderErr := render(ctx, cmd, selection, color.Output)
+	var resolutionError *anchor.ResolutionError
+	if renderErr != nil && !errors.As(renderErr, &resolutionError) {
+		return renderErr
+	}
+	for _, rendering := range renderings {
+		if dryRun {
+			printRendering(rendering)
+			return renderErr
+		}
+
+		absPath, err := filepath.Abs(rendering.output)
 		if err != nil {
 			return err
 		}
-		if architectures == "" {
-			architectures, err = getArchitecture()
+		if _, err := os.Stat(absPath); err == nil && !yes {
+			color.Yellow("File %s already exists. Overwrite? (y/n)", absPath)
+			reader := bufio.NewReader(os.Stdin)
+			response, err := reader.ReadString('\n')
 			if err != nil {
 				return err
 			}
+
+			if strings.ToLower(response) != "y\n" {
+				color.Green("Generated anchored Dockerfile\n")
+				rendering.nodes.Write(os.Stdout)
+				return fmt.Errorf("exiting without writing file")
+			}
 		}
-		input, err := cmd.Flags().GetString("input")
-		if err != nil {
+
+		if err := writeRendering(color.Output, rendering); err != nil {
 			return err
 		}
-		dryRun, err := cmd.Flags().GetBool("dry-run")
+	}
+	if locked || len(renderings) == 0 {
+		return renderErr
+	}
+	if renderErr != nil {
+		// the lockfile would not match the platforms that failed
+		color.Yellow("Not updating the lockfile, some packages could not be resolved")
+		return renderErr
+	}
+	return lockRenderings(cmd, renderings)
+}
+
+// printRendering prints an anchored Dockerfile and the files generated with it, for a dry run.
+func printRendering(rendering rendering) {
+	color.Green("Generated anchored Dockerfile\n")
+	rendering.nodes.Write(os.Stdout)
+	for _, file := range rendering.files {
+		color.Green("Generated %s\n", file.Path)
+		os.Stdout.Write(file.Content)
+	}
+}
+
+// writeRendering writes an anchored Dockerfile and the files generated with it, printing
+// what it wrote to w.
+func writeRendering(w io.Writer, rendering rendering) error {
+	absPath, err := filepath.Abs(rendering.output)
+	if err != nil {
+		return err
+	}
+	outputFile, err := os.Create(filepath.Clean(rendering.output))
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outputFile.Close()
+
+	writer := bufio.NewWriter(outputFile)
+	err = rendering.nodes.Write(writer)
+	if err != nil {
+		return fmt.Errorf("failed to write to output file: %w", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush to output file: %w", err)
+	}
+	color.New(color.FgGreen).Fprintf(w, "Generated anchored Dockerfile: %s\n", absPath)
+
+	for _, file := range rendering.files {
+		err = os.WriteFile(filepath.Clean(file.Path), file.Content, 0o600)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to write %s: %w", file.Path, err)
 		}
-		yes, err := cmd.Flags().GetBool("yes")
+		color.New(color.FgGreen).Fprintf(w, "Generated %s\n", file.Path)
+	}
+	return nil
+}
+
+// rendering is the anchored Dockerfile of a platform and the files generated with it.
+type rendering struct {
+	// template is the template the Dockerfile is anchored from, and output the name it is
+	// written to
+	template string
+	output   string
+	// contextDir is the build context the files generated with the Dockerfile are written to
+	contextDir string
+	platform   v1.Platform
+	// resolvedAt is when the images and packages of the Dockerfile were resolved
+	resolvedAt time.Time
+	nodes      anchor.Nodes
+	files      []anchor.File
+	// platforms are the Dockerfiles of each platform a multi-arch Dockerfile is merged from
+	platforms []platformRendering
+}
+
+// platformRendering is the Dockerfile anchored to one platform of a multi-arch Dockerfile.
+type platformRendering struct {
+	platform v1.Platform
+	nodes    anchor.Nodes
+}
+
+// render anchors the input to every platform of the flags. The packages that could not be
+// resolved for any platform are returned together as a *anchor.ResolutionError, along with
+// the renderings of the platforms that were resolved. With a selection, what it does not
+// select keeps the pins of the existing output of the platform. The progress is written to
+// output.
+func render(
+	ctx context.Context, cmd *cobra.Command, selection *anchor.Selection, output io.Writer,
+) ([]rendering, error) {
+	options, err := getOptions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	options.Output = output
+	// the lockfile is all there is to resolve with, so no container runtime is needed
+	var resolver anchor.PackageResolver
+	if options.Locked == nil {
+		resolver, err = getResolver(ctx, cmd)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
+	return renderTemplate(ctx, options, resolver, &anchor.RegistryCache{}, selection)
+}
 
-		options := Options{
-			Architectures: strings.Split(architectures, ","),
-			OutputFile:    output,
-			InputFile:     input,
-		}
-		appendArch := len(options.Architectures) > 1
+// getOptions returns the input, output and architectures of the flags, whether to merge the
+// platforms, and the lockfile with --locked. The architectures are empty when the flag is
+// not set, for renderTemplate to choose them.
+func getOptions(cmd *cobra.Command) (Options, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return Options{}, err
+	}
+	architectures, err := cmd.Flags().GetString("architectures")
+	if err != nil {
+		return Options{}, err
+	}
+	input, err := cmd.Flags().GetString("input")
+	if err != nil {
+		return Options{}, err
+	}
+	contextDir, err := cmd.Flags().GetString("context")
+	if err != nil {
+		return Options{}, err
+	}
+	options := Options{
+		OutputFile: output,
+		InputFile:  input,
+		ContextDir: contextDir,
+	}
+	if architectures != "" {
+		options.Architectures = strings.Split(architectures, ",")
+	}
+	options.MultiArch, err = getRootFlag(cmd, "multi-arch")
+	if err != nil {
+		return Options{}, err
+	}
+	locked, err := getRootFlag(cmd, "locked")
+	if err != nil || !locked {
+		return options, err
+	}
+	lockfile, err := cmd.Flags().GetString("lockfile")
+	if err != nil {
+		return Options{}, err
+	}
+	if lockfile == "" {
+		lockfile = anchor.LockFileName
+	}
+	options.Locked, err = readLockFile(lockfile)
+	if err != nil {
+		return Options{}, err
+	}
+	return options, nil
+}
+
+// output returns where the progress of anchoring is written.
+func (o Options) output() io.Writer {
+	if o.Output == nil {
+		return color.Output
+	}
+	return o.Output
+}
+
+// contextDir returns the build context of the input.
+func (o Options) contextDir() string {
+	if o.ContextDir == "" {
+		return filepath.Dir(o.InputFile)
+	}
+	return o.ContextDir
+}
+
+// getContextDir returns the build context of a template, the directory of the template
+// unless --context is set.
+func getContextDir(cmd *cobra.Command, template string) (string, error) {
+	contextDir, err := cmd.Flags().GetString("context")
+	if err != nil || contextDir != "" {
+		return contextDir, err
+	}
+	return filepath.Dir(template), nil
+}
 
-		for _, architecture := range options.Architectures {
-			content, err := os.Open(options.InputFile)
+// getRootFlag returns a flag that only anchor itself has, such as --locked, which is false
+// for the commands that render the template without it.
+func getRootFlag(cmd *cobra.Command, name string) (bool, error) {
+	if cmd.Flags().Lookup(name) == nil {
+		return false, nil
+	}
+	return cmd.Flags().GetBool(name)
+}
+
+func readLockFile(name string) (*anchor.LockFile, error) {
+	file, err := os.Open(filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return anchor.ReadLockFile(file)
+}
+
+// lockRenderings records the pins of the written renderings in the lockfile, replacing what
+// it records for their templates.
+func lockRenderings(cmd *cobra.Command, renderings []rendering) error {
+	name, err := cmd.Flags().GetString("lockfile")
+	if err != nil || name == "" {
+		return err
+	}
+	source, err := cmd.Flags().GetString("resolver")
+	if err != nil {
+		return err
+	}
+	lock, err := readLockFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		lock = &anchor.LockFile{}
+	} else if err != nil {
+		return err
+	}
+
+	templates := []string{}
+	files := map[string][]anchor.LockedFile{}
+	for _, rendering := range renderings {
+		// a multi-arch Dockerfile is locked for each platform it is merged from
+		platforms := rendering.platforms
+		if len(platforms) == 0 {
+			platforms = []platformRendering{{platform: rendering.platform, nodes: rendering.nodes}}
+		}
+		if _, ok := files[rendering.template]; !ok {
+			templates = append(templates, rendering.template)
+		}
+		for _, platform := range platforms {
+			pins, err := anchor.ReadPins(platform.nodes, rendering.contextDir)
 			if err != nil {
 				return err
 			}
-			nodes := anchor.Parse(content)
-			defer content.Close()
-			color.Cyan("Anchoring to architecture: %s\n", architecture)
-			err = anchor.Process(ctx, nodes, architecture)
+			file, err := anchor.NewLockedFile(
+				rendering.template,
+				rendering.output,
+				platform.platform,
+				pins,
+				source,
+				rendering.resolvedAt,
+			)
 			if err != nil {
 				return err
 			}
+			files[rendering.template] = append(files[rendering.template], file)
+		}
+	}
+	for _, template := range templates {
+		lock.Lock(template, files[template])
+	}
 
-			outputName := options.OutputFile
-			if appendArch {
-				outputName = fmt.Sprintf("%s.%s", outputName, architecture)
-			}
-
-			if dryRun {
-				color.Green("Generated anchored Dockerfile\n")
-				nodes.Write(os.Stdout)
-				return nil
-			}
+	file, err := os.Create(filepath.Clean(name))
+	if err != nil {
+		return fmt.Errorf("failed to create the lockfile: %w", err)
+	}
+	defer file.Close()
+	if err := lock.Write(file); err != nil {
+		return fmt.Errorf("failed to write the lockfile: %w", err)
+	}
+	color.Green("Locked %d anchored Dockerfile(s) in %s", len(renderings), name)
+	return nil
+}
 
-			absPath, err := filepath.Abs(outputName)
+// renderTemplate anchors a template to every platform of the options, like render. Images
+// are resolved through the cache, which can be shared by templates anchored together.
+// Without architectures, the template is anchored to the platforms its output was merged
+// from with --multi-arch, and to the system platform otherwise.
+func renderTemplate(
+	ctx context.Context,
+	options Options,
+	resolver anchor.PackageResolver,
+	cache *anchor.RegistryCache,
+	selection *anchor.Selection,
+) ([]rendering, error) {
+	content, err := readNodes(options.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	var platforms []v1.Platform
+	var locked []anchor.LockedFile
+	if options.Locked != nil {
+		locked = options.Locked.Template(options.InputFile)
+		if len(locked) == 0 {
+			return nil, fmt.Errorf(
+				"%s is not in the lockfile, run anchor to lock it", options.InputFile,
+			)
+		}
+		for _, file := range locked {
+			platform, err := anchor.ParsePlatform(file.Platform)
 			if err != nil {
-				return err
-			}
-			if _, err := os.Stat(absPath); err == nil && !yes {
-				color.Yellow("File %s already exists. Overwrite? (y/n)", absPath)
-				reader := bufio.NewReader(os.Stdin)
-				response, err := reader.ReadString('\n')
-				if err != nil {
-					return err
-				}
-
-				if strings.ToLower(response) != "y\n" {
-					color.Green("Generated anchored Dockerfile\n")
-					nodes.Write(os.Stdout)
-					return fmt.Errorf("exiting without writing file")
-				}
+				return nil, err
 			}
-
-			outputFile, err := os.Create(filepath.Clean(outputName))
+			platforms = append(platforms, platform)
+		}
+		// the platforms of a multi-arch Dockerfile are all locked to the same output
+		options.MultiArch = len(locked) > 1 && !slices.ContainsFunc(
+			locked, func(file anchor.LockedFile) bool { return file.Output != locked[0].Output },
+		)
+		if options.MultiArch {
+			options.OutputFile = filepath.FromSlash(locked[0].Output)
+		}
+	} else {
+		if len(options.Architectures) == 0 {
+			options, err = defaultArchitectures(options)
 			if err != nil {
-				return fmt.Errorf("failed to create output file: %w", err)
+				return nil, err
 			}
-			defer outputFile.Close()
+		}
+		platforms, err = cache.ResolvePlatforms(ctx, content, options.Architectures)
+		if err != nil {
+			return nil, err
+		}
+	}
+	appendArch := len(platforms) > 1
 
-			writer := bufio.NewWriter(outputFile)
-			err = nodes.Write(writer)
-			if err != nil {
-				return fmt.Errorf("failed to write to output file: %w", err)
+	// failures of every platform are reported together, rather than only the first one's
+	failures := []anchor.PackageFailure{}
+	renderings := []rendering{}
+	for i, platform := range platforms {
+		architecture, err := anchor.DpkgArchitecture(platform)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := readNodes(options.InputFile)
+		if err != nil {
+			return nil, err
+		}
+		outputName := options.OutputFile
+		if appendArch {
+			outputName = fmt.Sprintf("%s.%s", outputName, architecture)
+		}
+		config := anchor.Config{
+			Platform:           platform,
+			ContextDir:         options.contextDir(),
+			AppendArchitecture: appendArch,
+			Resolver:           resolver,
+			Images:             cache,
+			ProxyEnv:           anchor.ProxyEnvironment(),
+			Output:             options.output(),
+		}
+		if locked != nil {
+			outputName = filepath.FromSlash(locked[i].Output)
+			config.Resolver = &locked[i]
+			config.Images = &locked[i]
+		}
+		if selection != nil {
+			config.Refresh = *selection
+			// the pins of every platform of a multi-arch Dockerfile are read from the merge
+			pinned := outputName
+			if options.MultiArch {
+				pinned = options.OutputFile
 			}
-			err = writer.Flush()
+			config.Pins, err = readOutputPins(pinned, config.ContextDir, platform)
 			if err != nil {
-				return fmt.Errorf("failed to flush to output file: %w", err)
+				return nil, err
 			}
-			color.Green("Generated anchored Dockerfile: %s", absPath)
 		}
-		return nil
-	},
+		color.New(color.FgCyan).Fprintf(
+			config.Output, "Anchoring to platform: %s (%s)\n", platform.String(), architecture,
+		)
+		result, err := anchor.ProcessWithConfig(ctx, nodes, config)
+		var resolutionError *anchor.ResolutionError
+		if errors.As(err, &resolutionError) {
+			failures = append(failures, resolutionError.Failures...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		renderings = append(renderings, rendering{
+			template:   options.InputFile,
+			output:     outputName,
+			contextDir: config.ContextDir,
+			platform:   platform,
+			resolvedAt: time.Now(),
+			nodes:      nodes,
+			files:      result.Files,
+		})
+	}
+	if len(failures) > 0 {
+		if options.MultiArch {
+			// the platforms that were resolved cannot be written without the others
+			return nil, &anchor.ResolutionError{Failures: failures}
+		}
+		return renderings, &anchor.ResolutionError{Failures: failures}
+	}
+	if options.MultiArch && len(renderings) > 1 {
+		return mergeRenderings(options, renderings)
+	}
+	return renderings, nil
 }
 
-func getArchitecture() (string, error) {
-	switch runtime.GOARCH {
-	case "amd64":
-		return "amd64", nil
-	case "arm64":
-		return "arm64", nil
+// mergeRenderings merges the renderings of every platform into a single multi-arch
+// Dockerfile, written to the output.
+func mergeRenderings(options Options, renderings []rendering) ([]rendering, error) {
+	anchored := []anchor.AnchoredPlatform{}
+	platforms := []platformRendering{}
+	for _, rendering := range renderings {
+		anchored = append(anchored, anchor.AnchoredPlatform{
+			Platform: rendering.platform,
+			Nodes:    rendering.nodes,
+			Files:    rendering.files,
+		})
+		platforms = append(platforms, platformRendering{
+			platform: rendering.platform,
+			nodes:    rendering.nodes,
+		})
+	}
+	nodes, files, err := anchor.MergePlatforms(anchored)
+	if err != nil {
+		return nil, err
+	}
+	color.New(color.FgCyan).Fprintf(
+		options.output(), "Merged %d platforms into %s\n", len(renderings), options.OutputFile,
+	)
+	return []rendering{{
+		template:   options.InputFile,
+		output:     options.OutputFile,
+		contextDir: options.contextDir(),
+		resolvedAt: renderings[0].resolvedAt,
+		nodes:      nodes,
+		files:      files,
+		platforms:  platforms,
+	}}, nil
+}
+
+// readOutputPins reads the pins an existing anchored Dockerfile has for a platform, which are
+// empty when it does not exist yet or its packages are anchored for another architecture.
+func readOutputPins(
+	output string, contextDir string, platform v1.Platform,
+) (*anchor.Pins, error) {
+	nodes, err := readNodes(output)
+	if errors.Is(err, os.ErrNotExist) {
+		return &anchor.Pins{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pins, err := anchor.ReadPlatformPins(nodes, contextDir, platform)
+	if err != nil {
+		return nil, err
+	}
+	architecture, err := anchor.DpkgArchitecture(platform)
+	if err != nil {
+		return nil, err
+	}
+	if pins.Architecture != "" && pins.Architecture != architecture {
+		return &anchor.Pins{}, nil
+	}
+	return pins, nil
+}
+
+// defaultArchitectures sets the architectures of options without any to the platforms the
+// output was merged from with --multi-arch, merging them again, or the system architecture.
+func defaultArchitectures(options Options) (Options, error) {
+	nodes, err := readNodes(options.OutputFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Options{}, err
+	}
+	if platforms := anchor.MergedPlatforms(nodes); platforms != nil {
+		options.Architectures = platforms
+		options.MultiArch = true
+		return options, nil
+	}
+	architecture, err := getArchitecture()
+	if err != nil {
+		return Options{}, err
+	}
+	options.Architectures = []string{architecture}
+	return options, nil
+}
+
+func getResolver(ctx context.Context, cmd *cobra.Command) (anchor.PackageResolver, error) {
+	resolver, err := cmd.Flags().GetString("resolver")
+	if err != nil {
+		return nil, err
+	}
+	mirror, err := cmd.Flags().GetString("apt-mirror")
+	if err != nil {
+		return nil, err
+	}
+	switch resolver {
+	case "container":
+		name, err := cmd.Flags().GetString("runtime")
+		if err != nil {
+			return nil, err
+		}
+		containerRuntime, err := anchor.GetRuntime(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return &anchor.ContainerResolver{Runtime: containerRuntime}, nil
+	case "registry":
+		return &anchor.RegistryResolver{Mirror: mirror}, nil
 	default:
+		return nil, fmt.Errorf("unsupported resolver: %s", resolver)
+	}
+}
+
+func getArchitecture() (string, error) {
+	platform := runtime.GOARCH
+	if platform == "arm" {
+		platform += "/v7"
+	}
+	if _, err := anchor.ParsePlatform(platform); err != nil {
 		return "unknown", fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
 	}
+	return platform, nil
 }
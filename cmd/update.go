@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/songstitch/anchor/pkg/anchor"
+)
+
+func init() {
+	updateCmd.Flags().
+		BoolP("images", "", false, "Refresh the digests of base images, keeping the pinned package versions")
+	updateCmd.Flags().
+		BoolP("packages", "", false, "Refresh the package versions, keeping the pinned image digests")
+	updateCmd.Flags().
+		StringP("only", "", "", "Comma delimited list of images and packages to refresh, e.g. \"golang,curl\". Images are matched by their reference, repository or name")
+	updateCmd.Flags().
+		StringP("stage", "", "", "Comma delimited list of stages to refresh, by name or index")
+	rootCmd.AddCommand(updateCmd)
+}
+
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Refresh selected pins, keeping the rest of the anchored Dockerfile as it is",
+	Long: "Update anchors the template again like anchor does, but only resolves what is " +
+		"selected. Everything else keeps the digest or version it is pinned to in the existing " +
+		"output. Images and packages that are not pinned yet are always resolved.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		images, err := cmd.Flags().GetBool("images")
+		if err != nil {
+			return err
+		}
+		packages, err := cmd.Flags().GetBool("packages")
+		if err != nil {
+			return err
+		}
+		only, err := cmd.Flags().GetString("only")
+		if err != nil {
+			return err
+		}
+		stages, err := cmd.Flags().GetString("stage")
+		if err != nil {
+			return err
+		}
+		return anchorFiles(cmd, &anchor.Selection{
+			Images:   images,
+			Packages: packages,
+			Names:    splitList(only),
+			Stages:   splitList(stages),
+		})
+	},
+}
+
+// splitList splits a comma delimited flag value, leaving out empty values.
+func splitList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
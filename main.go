@@ -18,6 +18,6 @@ func run() error {
 func main() {
 	if err := run(); err != nil {
 		color.Red("%s", err)
-		os.Exit(1)
+		os.Exit(cmd.ExitCode(err))
 	}
 }
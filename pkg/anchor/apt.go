@@ -0,0 +1,233 @@
+package anchor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+// aptSource is a single suite of an apt repository, from either a one-line sources.list
+// entry or a deb822 .sources file.
+type aptSource struct {
+	URI        string
+	Suite      string
+	Components []string
+	// Architectures restricts the architectures fetched from the source, when set
+	Architectures []string
+}
+
+// indexURLs returns the URLs of the Packages index of the source for an architecture,
+// most preferred first.
+func (s aptSource) indexURLs(architecture string) []string {
+	base := strings.TrimSuffix(s.URI, "/")
+	if strings.HasSuffix(s.Suite, "/") {
+		// flat repository, the suite is a path relative to the URI
+		dir := base + "/" + strings.TrimPrefix(s.Suite, "/")
+		return []string{dir + "Packages.gz", dir + "Packages"}
+	}
+	urls := []string{}
+	for _, component := range s.Components {
+		dir := fmt.Sprintf("%s/dists/%s/%s/binary-%s/", base, s.Suite, component, architecture)
+		urls = append(urls, dir+"Packages.gz", dir+"Packages")
+	}
+	return urls
+}
+
+// releaseURL returns the URL of the Release file of the source.
+func (s aptSource) releaseURL() string {
+	base := strings.TrimSuffix(s.URI, "/")
+	if strings.HasSuffix(s.Suite, "/") {
+		return base + "/" + strings.TrimPrefix(s.Suite, "/") + "Release"
+	}
+	return fmt.Sprintf("%s/dists/%s/Release", base, s.Suite)
+}
+
+// supports reports whether the source provides packages for the architecture.
+func (s aptSource) supports(architecture string) bool {
+	return len(s.Architectures) == 0 || slices.Contains(s.Architectures, architecture)
+}
+
+// parseSourcesList parses the one-line format of /etc/apt/sources.list, skipping deb-src
+// entries.
+func parseSourcesList(content []byte) []aptSource {
+	sources := []aptSource{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "deb" {
+			continue
+		}
+		fields = fields[1:]
+		source := aptSource{}
+		if strings.HasPrefix(fields[0], "[") {
+			// options such as [arch=amd64 signed-by=/usr/share/keyrings/key.gpg]
+			options := []string{}
+			for len(fields) > 0 {
+				option := strings.Trim(fields[0], "[]")
+				if option != "" {
+					options = append(options, option)
+				}
+				done := strings.HasSuffix(fields[0], "]")
+				fields = fields[1:]
+				if done {
+					break
+				}
+			}
+			for _, option := range options {
+				key, value, _ := strings.Cut(option, "=")
+				if key == "arch" {
+					source.Architectures = strings.Split(value, ",")
+				}
+			}
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		source.URI = fields[0]
+		source.Suite = fields[1]
+		source.Components = fields[2:]
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// parseDeb822Sources parses the deb822 format of /etc/apt/sources.list.d/*.sources files.
+func parseDeb822Sources(content []byte) []aptSource {
+	sources := []aptSource{}
+	for _, stanza := range parseStanzas(content) {
+		if stanza["Enabled"] == "no" || !slices.Contains(strings.Fields(stanza["Types"]), "deb") {
+			continue
+		}
+		for _, uri := range strings.Fields(stanza["URIs"]) {
+			for _, suite := range strings.Fields(stanza["Suites"]) {
+				sources = append(sources, aptSource{
+					URI:           uri,
+					Suite:         suite,
+					Components:    strings.Fields(stanza["Components"]),
+					Architectures: strings.Fields(stanza["Architectures"]),
+				})
+			}
+		}
+	}
+	return sources
+}
+
+// parseImageSources returns the apt sources configured in the files of an image, in the
+// order apt reads them. Files are keyed by their path without the leading slash.
+func parseImageSources(files map[string][]byte) []aptSource {
+	sources := parseSourcesList(files["etc/apt/sources.list"])
+	names := slices.Sorted(maps.Keys(files))
+	for _, name := range names {
+		if path.Dir(name) != "etc/apt/sources.list.d" {
+			continue
+		}
+		switch path.Ext(name) {
+		case ".list":
+			sources = append(sources, parseSourcesList(files[name])...)
+		case ".sources":
+			sources = append(sources, parseDeb822Sources(files[name])...)
+		}
+	}
+	return sources
+}
+
+// parseStanzas parses deb822 control data, as used by Packages indices, the dpkg status
+// file and .sources files, into one map of fields per stanza. Continuation lines of
+// multiline fields are joined with newlines.
+func parseStanzas(content []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+	field := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+			field = ""
+		case strings.HasPrefix(line, "#"):
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			if field != "" {
+				stanza[field] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			key, value, found := strings.Cut(line, ":")
+			if !found {
+				continue
+			}
+			field = key
+			stanza[field] = strings.TrimSpace(value)
+		}
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas
+}
+
+// aptPackage is a single version of a package available from a Packages index, or
+// installed according to the dpkg status file.
+type aptPackage struct {
+	Name         string
+	Version      string
+	Architecture string
+	Provides     []string
+	// Source is the index the package was read from, empty for installed packages
+	Source aptSource
+	// Release is the release of the index the package was read from
+	Release aptRelease
+}
+
+func parsePackages(content []byte, source aptSource) []aptPackage {
+	packages := []aptPackage{}
+	for _, stanza := range parseStanzas(content) {
+		if pkg, ok := stanzaPackage(stanza, source); ok {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+// parseDpkgStatus returns the packages installed in an image from /var/lib/dpkg/status.
+func parseDpkgStatus(content []byte) []aptPackage {
+	installed := []aptPackage{}
+	for _, stanza := range parseStanzas(content) {
+		if !strings.HasSuffix(stanza["Status"], " installed") {
+			continue
+		}
+		if pkg, ok := stanzaPackage(stanza, aptSource{}); ok {
+			pkg.Release = installedRelease
+			installed = append(installed, pkg)
+		}
+	}
+	return installed
+}
+
+func stanzaPackage(stanza map[string]string, source aptSource) (aptPackage, bool) {
+	if stanza["Package"] == "" || stanza["Version"] == "" {
+		return aptPackage{}, false
+	}
+	pkg := aptPackage{
+		Name:         stanza["Package"],
+		Version:      stanza["Version"],
+		Architecture: stanza["Architecture"],
+		Source:       source,
+	}
+	for _, provided := range strings.Split(stanza["Provides"], ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(provided), " ")
+		if name != "" {
+			pkg.Provides = append(pkg.Provides, name)
+		}
+	}
+	return pkg, true
+}
@@ -0,0 +1,110 @@
+package anchor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSourcesList(t *testing.T) {
+	content := `# comment
+deb http://deb.debian.org/debian bookworm main contrib
+deb-src http://deb.debian.org/debian bookworm main
+deb [arch=amd64,arm64 signed-by=/etc/apt/keyrings/docker.gpg] https://download.docker.com/linux/debian bookworm stable
+deb https://example.com/flat ./
+`
+	expected := []aptSource{
+		{
+			URI:        "http://deb.debian.org/debian",
+			Suite:      "bookworm",
+			Components: []string{"main", "contrib"},
+		},
+		{
+			URI:           "https://download.docker.com/linux/debian",
+			Suite:         "bookworm",
+			Components:    []string{"stable"},
+			Architectures: []string{"amd64", "arm64"},
+		},
+		{URI: "https://example.com/flat", Suite: "./", Components: []string{}},
+	}
+	actual := parseSourcesList([]byte(content))
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, actual)
+	}
+}
+
+func TestParseDeb822Sources(t *testing.T) {
+	content := `Types: deb
+URIs: http://deb.debian.org/debian
+Suites: bookworm bookworm-updates
+Components: main
+Signed-By: /usr/share/keyrings/debian-archive-keyring.gpg
+
+Types: deb-src
+URIs: http://deb.debian.org/debian
+Suites: bookworm
+Components: main
+`
+	actual := parseDeb822Sources([]byte(content))
+	expected := []aptSource{
+		{
+			URI:        "http://deb.debian.org/debian",
+			Suite:      "bookworm",
+			Components: []string{"main"},
+		},
+		{
+			URI:        "http://deb.debian.org/debian",
+			Suite:      "bookworm-updates",
+			Components: []string{"main"},
+		},
+	}
+	for i := range actual {
+		actual[i].Architectures = nil
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, actual)
+	}
+}
+
+func TestIndexURLs(t *testing.T) {
+	source := aptSource{
+		URI:        "http://deb.debian.org/debian/",
+		Suite:      "bookworm",
+		Components: []string{"main"},
+	}
+	expected := []string{
+		"http://deb.debian.org/debian/dists/bookworm/main/binary-arm64/Packages.gz",
+		"http://deb.debian.org/debian/dists/bookworm/main/binary-arm64/Packages",
+	}
+	if actual := source.indexURLs("arm64"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+
+	flat := aptSource{URI: "https://example.com/flat", Suite: "./"}
+	expected = []string{
+		"https://example.com/flat/./Packages.gz",
+		"https://example.com/flat/./Packages",
+	}
+	if actual := flat.indexURLs("arm64"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestParseDpkgStatus(t *testing.T) {
+	content := `Package: curl
+Status: install ok installed
+Architecture: amd64
+Version: 7.88.1-10+deb12u5
+Description: command line tool for transferring data with URL syntax
+ curl is a command line tool for transferring data with URL syntax.
+
+Package: wget
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.21.3-1+b2
+`
+	installed := parseDpkgStatus([]byte(content))
+	if len(installed) != 1 || installed[0].Name != "curl" ||
+		installed[0].Version != "7.88.1-10+deb12u5" {
+		t.Errorf("Unexpected installed packages %+v", installed)
+	}
+}
@@ -0,0 +1,511 @@
+package anchor
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Span is a half-open byte range [Start, End) into the source of a Node, as returned by
+// Node.Source. Spans are invalidated by any edit to the node, so instructions should be
+// re-read with Node.Instruction after calling Node.Apply.
+type Span struct {
+	Start int
+	End   int
+}
+
+// Word is a single whitespace delimited argument of an instruction. Value holds the raw
+// text, including any quotes, exactly as it appears in the source.
+type Word struct {
+	Value string
+	Span  Span
+}
+
+// Literal returns the value of the word with a single pair of surrounding quotes removed.
+func (w Word) Literal() string {
+	return unquote(w.Value)
+}
+
+// IsZero reports whether the word is absent from the instruction.
+func (w Word) IsZero() bool {
+	return w.Value == "" && w.Span == Span{}
+}
+
+// KeyValue is a single key and value pair of an ARG or ENV instruction.
+type KeyValue struct {
+	Key      Word
+	Value    Word
+	HasValue bool
+}
+
+// Instruction is the typed form of a Dockerfile instruction.
+type Instruction interface {
+	Keyword() string
+}
+
+// FromInstruction is a FROM instruction, e.g. FROM --platform=linux/amd64 golang:1.23 AS builder.
+type FromInstruction struct {
+	Flags []Word
+	Image Word
+	// Platform is the value of the --platform flag, it is zero if the flag is not set
+	Platform Word
+	// Alias is the stage name following AS, it is zero if the stage is not named
+	Alias Word
+}
+
+func (*FromInstruction) Keyword() string { return "FROM" }
+
+// RunInstruction is a RUN instruction in either shell or exec form.
+type RunInstruction struct {
+	Flags []Word
+	// Exec is true when the instruction is in exec form, e.g. RUN ["apt-get", "install"]
+	Exec bool
+	// Args are the decoded elements of an exec form instruction
+	Args []Word
+	// Script is the shell form body. It is the node source with the keyword, flags and any
+	// interleaved comments replaced by spaces, so offsets into Script are offsets into the
+	// node source.
+	Script string
+}
+
+func (*RunInstruction) Keyword() string { return "RUN" }
+
+// CopyInstruction is a COPY instruction.
+type CopyInstruction struct {
+	Flags []Word
+	// From is the value of the --from flag, it is zero if the flag is not set
+	From    Word
+	Exec    bool
+	Sources []Word
+	Dest    Word
+}
+
+func (*CopyInstruction) Keyword() string { return "COPY" }
+
+// AddInstruction is an ADD instruction. It shares the layout of COPY.
+type AddInstruction struct {
+	CopyInstruction
+}
+
+func (*AddInstruction) Keyword() string { return "ADD" }
+
+// ArgInstruction is an ARG instruction, which may declare several arguments.
+type ArgInstruction struct {
+	Args []KeyValue
+}
+
+func (*ArgInstruction) Keyword() string { return "ARG" }
+
+// EnvInstruction is an ENV instruction in either the key=value or legacy key value form.
+type EnvInstruction struct {
+	Pairs []KeyValue
+}
+
+func (*EnvInstruction) Keyword() string { return "ENV" }
+
+// ShellInstruction is a SHELL instruction, which is always in exec form.
+type ShellInstruction struct {
+	Args []Word
+}
+
+func (*ShellInstruction) Keyword() string { return "SHELL" }
+
+// OtherInstruction is any instruction anchor does not have a dedicated type for.
+type OtherInstruction struct {
+	Name string
+	Args []Word
+}
+
+func (o *OtherInstruction) Keyword() string { return o.Name }
+
+// Edit replaces the source covered by Span with Text.
+type Edit struct {
+	Span Span
+	Text string
+}
+
+// Source returns the text of the node, including comments and empty lines.
+func (n Node) Source() string {
+	var sb strings.Builder
+	for _, entry := range n.Entries {
+		sb.WriteString(entry.Value)
+	}
+	return sb.String()
+}
+
+// Position converts an offset into the node source to a 1-based line and column in the file.
+func (n Node) Position(offset int) (int, int) {
+	source := n.Source()
+	offset = min(max(offset, 0), len(source))
+	before := source[:offset]
+	line := n.Line + strings.Count(before, "\n")
+	column := offset - strings.LastIndex(before, "\n")
+	return line, column
+}
+
+// Apply rewrites the node source with the given edits while keeping the surrounding
+// formatting, comments and empty lines intact. Edits must not overlap.
+func (n *Node) Apply(edits ...Edit) error {
+	sorted := slices.Clone(edits)
+	slices.SortFunc(sorted, func(a, b Edit) int {
+		return b.Span.Start - a.Span.Start
+	})
+	length := len(n.Source())
+	for i, edit := range sorted {
+		if edit.Span.Start < 0 || edit.Span.End < edit.Span.Start || edit.Span.End > length {
+			return fmt.Errorf("edit span %d:%d is out of range", edit.Span.Start, edit.Span.End)
+		}
+		if i > 0 && edit.Span.End > sorted[i-1].Span.Start {
+			return fmt.Errorf(
+				"edit span %d:%d overlaps another edit",
+				edit.Span.Start,
+				edit.Span.End,
+			)
+		}
+	}
+	for _, edit := range sorted {
+		n.replace(edit.Span, edit.Text)
+	}
+	n.rebuildCommand()
+	return nil
+}
+
+func (n *Node) replace(span Span, text string) {
+	offset := 0
+	inserted := false
+	entries := make([]Entry, 0, len(n.Entries))
+	for i, entry := range n.Entries {
+		start, end := offset, offset+len(entry.Value)
+		offset = end
+		isLast := i == len(n.Entries)-1
+		if end <= span.Start && !(isLast && span.Start == end) || start > span.End ||
+			start == span.End && inserted {
+			entries = append(entries, entry)
+			continue
+		}
+		from := max(span.Start-start, 0)
+		to := min(span.End-start, len(entry.Value))
+		value := entry.Value[:from]
+		if !inserted {
+			value += text
+			inserted = true
+		}
+		value += entry.Value[to:]
+		if value == "" {
+			continue
+		}
+		entry.Value = value
+		entries = append(entries, entry)
+	}
+	n.Entries = entries
+}
+
+func (n *Node) rebuildCommand() {
+	n.Command = ""
+	for _, entry := range n.Entries {
+		if entry.Type != EntryCommand {
+			continue
+		}
+		for _, line := range strings.SplitAfter(entry.Value, "\n") {
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				continue
+			}
+			if entry.Beginning && n.CommandType == CommandRun {
+				line = strings.TrimSpace(strings.TrimLeft(line, "RUN"))
+				entry.Beginning = false
+			}
+			n.Command += line
+		}
+	}
+}
+
+// masked returns the node source with comment and empty entries replaced by spaces, so
+// offsets are preserved while only the instruction text remains.
+func (n Node) masked() []byte {
+	masked := make([]byte, 0, len(n.Source()))
+	for _, entry := range n.Entries {
+		if entry.Type == EntryCommand {
+			masked = append(masked, entry.Value...)
+			continue
+		}
+		masked = append(masked, []byte(strings.Repeat(" ", len(entry.Value)))...)
+	}
+	return masked
+}
+
+// Instruction parses the node into its typed form. Nodes without an instruction, such as
+// a trailing comment, return an error.
+func (n Node) Instruction() (Instruction, error) {
+	masked := n.masked()
+	text := joinContinuations(masked)
+	words := splitWords(text)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("node does not contain an instruction")
+	}
+	keyword := strings.ToUpper(words[0].Value)
+	flags, args := splitFlags(words[1:])
+	switch keyword {
+	case "FROM":
+		return parseFrom(flags, args)
+	case "RUN":
+		return parseRun(string(masked), text, flags, args), nil
+	case "COPY":
+		instruction := parseCopy(text, flags, args)
+		return &instruction, nil
+	case "ADD":
+		return &AddInstruction{CopyInstruction: parseCopy(text, flags, args)}, nil
+	case "ARG":
+		return &ArgInstruction{Args: parseKeyValues(text, args, false)}, nil
+	case "ENV":
+		return &EnvInstruction{Pairs: parseKeyValues(text, args, true)}, nil
+	case "SHELL":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("SHELL command is missing its arguments")
+		}
+		exec, ok := parseExec(text, args[0].Span.Start)
+		if !ok || len(exec) == 0 {
+			return nil, fmt.Errorf("SHELL command must be a JSON array")
+		}
+		return &ShellInstruction{Args: exec}, nil
+	default:
+		return &OtherInstruction{Name: keyword, Args: words[1:]}, nil
+	}
+}
+
+// Instructions returns the typed instruction of every node, nodes without an instruction
+// are returned as nil so indexes match the nodes.
+func (n Nodes) Instructions() []Instruction {
+	instructions := make([]Instruction, len(n))
+	for i, node := range n {
+		instruction, err := node.Instruction()
+		if err != nil {
+			continue
+		}
+		instructions[i] = instruction
+	}
+	return instructions
+}
+
+func parseFrom(flags []Word, args []Word) (*FromInstruction, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("FROM command is missing image name")
+	}
+	from := &FromInstruction{
+		Flags:    flags,
+		Image:    args[0],
+		Platform: flagValue(flags, "platform"),
+	}
+	if len(args) >= 3 && strings.EqualFold(args[1].Value, "as") {
+		from.Alias = args[2]
+	}
+	return from, nil
+}
+
+func parseRun(masked string, text string, flags []Word, args []Word) *RunInstruction {
+	run := &RunInstruction{Flags: flags}
+	if len(args) == 0 {
+		run.Script = strings.Repeat(" ", len(masked))
+		return run
+	}
+	start := args[0].Span.Start
+	if exec, ok := parseExec(text, start); ok {
+		run.Exec = true
+		run.Args = exec
+		return run
+	}
+	run.Script = strings.Repeat(" ", start) + masked[start:]
+	return run
+}
+
+func parseCopy(text string, flags []Word, args []Word) CopyInstruction {
+	instruction := CopyInstruction{Flags: flags, From: flagValue(flags, "from")}
+	if len(args) == 0 {
+		return instruction
+	}
+	if exec, ok := parseExec(text, args[0].Span.Start); ok {
+		instruction.Exec = true
+		args = exec
+	}
+	if len(args) == 0 {
+		return instruction
+	}
+	instruction.Sources = args[:len(args)-1]
+	instruction.Dest = args[len(args)-1]
+	return instruction
+}
+
+func parseKeyValues(text string, args []Word, legacy bool) []KeyValue {
+	pairs := []KeyValue{}
+	if legacy && len(args) > 0 && !strings.Contains(args[0].Value, "=") {
+		pair := KeyValue{Key: args[0]}
+		if len(args) > 1 {
+			span := Span{Start: args[1].Span.Start, End: args[len(args)-1].Span.End}
+			pair.Value = Word{Value: text[span.Start:span.End], Span: span}
+			pair.HasValue = true
+		}
+		return append(pairs, pair)
+	}
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg.Value, "=")
+		pair := KeyValue{
+			Key: Word{
+				Value: key,
+				Span:  Span{Start: arg.Span.Start, End: arg.Span.Start + len(key)},
+			},
+			HasValue: found,
+		}
+		if found {
+			start := arg.Span.Start + len(key) + 1
+			pair.Value = Word{Value: value, Span: Span{Start: start, End: arg.Span.End}}
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// parseExec parses a JSON array of strings starting at offset, returning each element as a
+// word whose span covers the quoted string.
+func parseExec(text string, offset int) ([]Word, bool) {
+	i := skipSpace(text, offset)
+	if i >= len(text) || text[i] != '[' {
+		return nil, false
+	}
+	words := []Word{}
+	i = skipSpace(text, i+1)
+	if i < len(text) && text[i] == ']' {
+		return words, strings.TrimSpace(text[i+1:]) == ""
+	}
+	for i < len(text) {
+		if text[i] != '"' {
+			return nil, false
+		}
+		end := i + 1
+		for end < len(text) && text[end] != '"' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(text) {
+			return nil, false
+		}
+		end++
+		words = append(words, Word{Value: text[i:end], Span: Span{Start: i, End: end}})
+		i = skipSpace(text, end)
+		if i >= len(text) {
+			return nil, false
+		}
+		switch text[i] {
+		case ',':
+			i = skipSpace(text, i+1)
+		case ']':
+			return words, strings.TrimSpace(text[i+1:]) == ""
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func skipSpace(text string, i int) int {
+	for i < len(text) && unicode.IsSpace(rune(text[i])) {
+		i++
+	}
+	return i
+}
+
+// joinContinuations replaces line continuations with spaces, keeping offsets intact.
+func joinContinuations(masked []byte) string {
+	joined := []byte(string(masked))
+	for i := 0; i < len(joined); i++ {
+		if joined[i] != '\\' {
+			continue
+		}
+		j := i + 1
+		for j < len(joined) && (joined[j] == ' ' || joined[j] == '\t' || joined[j] == '\r') {
+			j++
+		}
+		if j < len(joined) && joined[j] == '\n' {
+			for k := i; k <= j; k++ {
+				joined[k] = ' '
+			}
+			i = j
+		}
+	}
+	return string(joined)
+}
+
+// splitWords splits text on whitespace, keeping quoted sections and escaped characters
+// within a single word.
+func splitWords(text string) []Word {
+	words := []Word{}
+	start := -1
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if start < 0 {
+			if unicode.IsSpace(rune(c)) {
+				continue
+			}
+			start = i
+		}
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '"' || c == '\'':
+			quote = c
+		case unicode.IsSpace(rune(c)):
+			words = append(words, Word{Value: text[start:i], Span: Span{Start: start, End: i}})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, Word{Value: text[start:], Span: Span{Start: start, End: len(text)}})
+	}
+	return words
+}
+
+func splitFlags(words []Word) ([]Word, []Word) {
+	for i, word := range words {
+		if !strings.HasPrefix(word.Value, "--") {
+			return words[:i], words[i:]
+		}
+	}
+	return words, []Word{}
+}
+
+// flagValue returns the value of a --name=value flag as a word spanning only the value.
+func flagValue(flags []Word, name string) Word {
+	prefix := "--" + name + "="
+	for _, flag := range flags {
+		if strings.HasPrefix(flag.Value, prefix) {
+			start := flag.Span.Start + len(prefix)
+			return Word{
+				Value: flag.Value[len(prefix):],
+				Span:  Span{Start: start, End: flag.Span.End},
+			}
+		}
+	}
+	return Word{}
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '"' && s[0] != '\'') {
+		return s
+	}
+	if s[0] == '"' {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+	}
+	return s[1 : len(s)-1]
+}
@@ -0,0 +1,213 @@
+package anchor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromInstruction(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		image    string
+		platform string
+		alias    string
+	}{
+		{"image only", "FROM ubuntu:20.04\n", "ubuntu:20.04", "", ""},
+		{
+			"with alias",
+			"FROM golang:1.23-bookworm as builder\n",
+			"golang:1.23-bookworm",
+			"",
+			"builder",
+		},
+		{
+			"with platform",
+			"FROM --platform=linux/arm64 golang:1.23 AS build\n",
+			"golang:1.23",
+			"linux/arm64",
+			"build",
+		},
+		{
+			"continuation",
+			"FROM \\\n  --platform=$BUILDPLATFORM \\\n  golang:1.23\n",
+			"golang:1.23",
+			"$BUILDPLATFORM",
+			"",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := Parse(strings.NewReader(tc.input))
+			instruction, err := nodes[0].Instruction()
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			from, ok := instruction.(*FromInstruction)
+			if !ok {
+				t.Fatalf("Expected a FROM instruction but got %T", instruction)
+			}
+			if from.Image.Value != tc.image {
+				t.Errorf("Expected image %v but got %v", tc.image, from.Image.Value)
+			}
+			if from.Platform.Value != tc.platform {
+				t.Errorf("Expected platform %v but got %v", tc.platform, from.Platform.Value)
+			}
+			if from.Alias.Value != tc.alias {
+				t.Errorf("Expected alias %v but got %v", tc.alias, from.Alias.Value)
+			}
+			source := nodes[0].Source()
+			if source[from.Image.Span.Start:from.Image.Span.End] != tc.image {
+				t.Errorf("Image span %v does not cover %v", from.Image.Span, tc.image)
+			}
+		})
+	}
+}
+
+func TestRunInstruction(t *testing.T) {
+	input := `# hadolint ignore=DL3008
+RUN --mount=type=cache,target=/var/cache/apt apt-get update \
+    # install curl
+    && apt-get install -y curl
+RUN ["apt-get", "install", "-y", "wget"]
+`
+	nodes := Parse(strings.NewReader(input))
+
+	instruction, err := nodes[0].Instruction()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	run := instruction.(*RunInstruction)
+	if run.Exec {
+		t.Errorf("Expected shell form")
+	}
+	if len(run.Flags) != 1 || run.Flags[0].Value != "--mount=type=cache,target=/var/cache/apt" {
+		t.Errorf("Unexpected flags %v", run.Flags)
+	}
+	if len(run.Script) != len(nodes[0].Source()) {
+		t.Errorf("Expected script to have the same length as the source")
+	}
+	if strings.Contains(run.Script, "install curl") || strings.Contains(run.Script, "--mount") {
+		t.Errorf("Expected comments and flags to be masked, got %q", run.Script)
+	}
+	if !strings.Contains(run.Script, "apt-get install -y curl") {
+		t.Errorf("Expected script to contain the install, got %q", run.Script)
+	}
+
+	instruction, err = nodes[1].Instruction()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	run = instruction.(*RunInstruction)
+	if !run.Exec {
+		t.Fatalf("Expected exec form")
+	}
+	args := []string{}
+	for _, arg := range run.Args {
+		args = append(args, arg.Literal())
+	}
+	expected := []string{"apt-get", "install", "-y", "wget"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v but got %v", expected, args)
+	}
+}
+
+func TestOtherInstructions(t *testing.T) {
+	input := `ARG VERSION=1.0 DEBUG
+ENV DEBIAN_FRONTEND=noninteractive LANG="C.UTF-8"
+ENV PATH /usr/local/bin:/usr/bin
+COPY --from=builder /src/a /src/b /dest/
+ADD ["https://example.com/file", "/file"]
+WORKDIR /app
+`
+	nodes := Parse(strings.NewReader(input))
+	instructions := nodes.Instructions()
+
+	arg := instructions[0].(*ArgInstruction)
+	if len(arg.Args) != 2 || arg.Args[0].Key.Value != "VERSION" ||
+		arg.Args[0].Value.Value != "1.0" || arg.Args[1].HasValue {
+		t.Errorf("Unexpected ARG %+v", arg.Args)
+	}
+
+	env := instructions[1].(*EnvInstruction)
+	if len(env.Pairs) != 2 || env.Pairs[1].Key.Value != "LANG" ||
+		env.Pairs[1].Value.Literal() != "C.UTF-8" {
+		t.Errorf("Unexpected ENV %+v", env.Pairs)
+	}
+
+	legacy := instructions[2].(*EnvInstruction)
+	if len(legacy.Pairs) != 1 || legacy.Pairs[0].Value.Value != "/usr/local/bin:/usr/bin" {
+		t.Errorf("Unexpected legacy ENV %+v", legacy.Pairs)
+	}
+
+	copyInstruction := instructions[3].(*CopyInstruction)
+	if copyInstruction.From.Value != "builder" || len(copyInstruction.Sources) != 2 ||
+		copyInstruction.Dest.Value != "/dest/" {
+		t.Errorf("Unexpected COPY %+v", copyInstruction)
+	}
+
+	add := instructions[4].(*AddInstruction)
+	if !add.Exec || add.Dest.Literal() != "/file" {
+		t.Errorf("Unexpected ADD %+v", add)
+	}
+
+	other := instructions[5].(*OtherInstruction)
+	if other.Keyword() != "WORKDIR" || other.Args[0].Value != "/app" {
+		t.Errorf("Unexpected instruction %+v", other)
+	}
+}
+
+func TestApply(t *testing.T) {
+	input := `# keep this comment
+FROM golang:1.23 \
+    # and this one
+    AS builder
+`
+	nodes := Parse(strings.NewReader(input))
+	node := nodes[0]
+	instruction, err := node.Instruction()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	from := instruction.(*FromInstruction)
+	err = node.Apply(
+		Edit{Span: from.Image.Span, Text: "golang:1.23@sha256:abc"},
+		Edit{Span: from.Alias.Span, Text: "build"},
+	)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := `# keep this comment
+FROM golang:1.23@sha256:abc \
+    # and this one
+    AS build
+`
+	if node.Source() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, node.Source())
+	}
+	if node.Command != "FROM golang:1.23@sha256:abc \\    AS build" {
+		t.Errorf("Unexpected command %q", node.Command)
+	}
+
+	err = node.Apply(Edit{Span: Span{Start: 0, End: 4}}, Edit{Span: Span{Start: 2, End: 6}})
+	if err == nil {
+		t.Errorf("Expected an error for overlapping edits")
+	}
+}
+
+func TestPosition(t *testing.T) {
+	input := `FROM golang:1.23
+
+# comment
+RUN apt-get update \
+    && apt-get install -y curl
+`
+	nodes := Parse(strings.NewReader(input))
+	node := nodes[1]
+	offset := strings.Index(node.Source(), "curl")
+	line, column := node.Position(offset)
+	if line != 5 || column != 27 {
+		t.Errorf("Expected 5:27 but got %d:%d", line, column)
+	}
+}
@@ -0,0 +1,210 @@
+package anchor
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// RegistryCache caches what is read from registries while anchoring several templates in
+// one run: the digest each image reference points to and the platforms of its manifest
+// index. Each image is looked up once, even when it is asked for concurrently, so every
+// template pins a reference to the same digest. It is safe for concurrent use.
+type RegistryCache struct {
+	// Images resolves the digests of images, a RegistryImageResolver when nil
+	Images ImageResolver
+	// Platforms returns the platforms of images, ImagePlatforms when nil
+	Platforms func(ctx context.Context, image string) ([]v1.Platform, error)
+
+	mu        sync.Mutex
+	digests   map[string]*cacheEntry[string]
+	platforms map[string]*cacheEntry[[]v1.Platform]
+}
+
+// cacheEntry is a value that is fetched once.
+type cacheEntry[T any] struct {
+	once  sync.Once
+	value T
+	err   error
+}
+
+// cached returns the value of a key, fetching it if it is the first time it is asked for.
+func cached[T any](
+	mu *sync.Mutex, entries *map[string]*cacheEntry[T], key string, fetch func() (T, error),
+) (T, error) {
+	mu.Lock()
+	if *entries == nil {
+		*entries = map[string]*cacheEntry[T]{}
+	}
+	entry, ok := (*entries)[key]
+	if !ok {
+		entry = &cacheEntry[T]{}
+		(*entries)[key] = entry
+	}
+	mu.Unlock()
+	entry.once.Do(func() {
+		entry.value, entry.err = fetch()
+	})
+	return entry.value, entry.err
+}
+
+// ResolveImage returns the digest of an image, resolving it the first time it is asked for.
+func (c *RegistryCache) ResolveImage(ctx context.Context, image string) (string, error) {
+	return cached(&c.mu, &c.digests, image, func() (string, error) {
+		resolver := c.Images
+		if resolver == nil {
+			resolver = &RegistryImageResolver{}
+		}
+		return resolver.ResolveImage(ctx, image)
+	})
+}
+
+// ResolvePlatforms returns the platforms to anchor a Dockerfile to like ResolvePlatforms,
+// reading the platforms of each base image once.
+func (c *RegistryCache) ResolvePlatforms(
+	ctx context.Context, nodes []Node, requested []string,
+) ([]v1.Platform, error) {
+	imagePlatforms := func(image string) ([]v1.Platform, error) {
+		return cached(&c.mu, &c.platforms, image, func() ([]v1.Platform, error) {
+			if c.Platforms != nil {
+				return c.Platforms(ctx, image)
+			}
+			return ImagePlatforms(ctx, image)
+		})
+	}
+	return resolvePlatforms(requested, BaseImages(nodes), imagePlatforms)
+}
+
+// PackageCache resolves each package once for a base image and architecture, so that every
+// Dockerfile anchored with it pins a package to the same version. Packages are resolved
+// with another resolver, and only those that were not resolved before are requested from
+// it. It is safe for concurrent use.
+type PackageCache struct {
+	Resolver PackageResolver
+
+	mu       sync.Mutex
+	packages map[string]*packageEntry
+}
+
+// packageEntry is the resolution of a single package, which is ready once done is closed.
+type packageEntry struct {
+	done       chan struct{}
+	resolution *Resolution
+	err        error
+}
+
+// ResolvePackages returns the resolution of the packages, asking the resolver only for the
+// packages that were not resolved before with the same base image, architecture and stage.
+func (c *PackageCache) ResolvePackages(
+	ctx context.Context, request PackageRequest,
+) (*Resolution, error) {
+	entries := make([]*packageEntry, len(request.Packages))
+	owned := map[string]*packageEntry{}
+	c.mu.Lock()
+	if c.packages == nil {
+		c.packages = map[string]*packageEntry{}
+	}
+	for i, pkg := range request.Packages {
+		key := packageKey(request, pkg)
+		entry, ok := c.packages[key]
+		if !ok {
+			entry = &packageEntry{done: make(chan struct{})}
+			c.packages[key] = entry
+			owned[pkg] = entry
+		}
+		entries[i] = entry
+	}
+	c.mu.Unlock()
+
+	if len(owned) > 0 {
+		c.resolve(ctx, request, owned)
+	}
+	resolution := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Reasons:   map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	for _, entry := range entries {
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		maps.Copy(resolution.Versions, entry.resolution.Versions)
+		maps.Copy(resolution.Providers, entry.resolution.Providers)
+		maps.Copy(resolution.Reasons, entry.resolution.Reasons)
+		resolution.Failures = append(resolution.Failures, entry.resolution.Failures...)
+	}
+	return resolution, nil
+}
+
+// resolve resolves the packages this request is the first to ask for, in one request, and
+// stores the resolution of each of them.
+func (c *PackageCache) resolve(
+	ctx context.Context, request PackageRequest, owned map[string]*packageEntry,
+) {
+	// keep the order of the request, so that the resolver is asked the same way each run
+	request.Packages = slices.DeleteFunc(slices.Clone(request.Packages), func(pkg string) bool {
+		return owned[pkg] == nil
+	})
+	resolution, err := c.Resolver.ResolvePackages(ctx, request)
+	for pkg, entry := range owned {
+		if err == nil {
+			entry.resolution = packageResolution(resolution, pkg)
+		}
+		entry.err = err
+		close(entry.done)
+	}
+}
+
+// packageResolution returns the part of a resolution about one requested package.
+func packageResolution(resolution *Resolution, pkg string) *Resolution {
+	result := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Reasons:   map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	name := pkg
+	if provider, ok := resolution.Providers[pkg]; ok {
+		name = provider
+		result.Providers[pkg] = provider
+	}
+	if version, ok := resolution.Versions[name]; ok {
+		result.Versions[name] = version
+	}
+	if reason, ok := resolution.Reasons[name]; ok {
+		result.Reasons[name] = reason
+	}
+	for _, failure := range resolution.Failures {
+		if failure.Package == pkg {
+			result.Failures = append(result.Failures, failure)
+		}
+	}
+	return result
+}
+
+// packageKey identifies what the version of a package is resolved from: the anchored base
+// image, the architecture and the release it is installed from, with the repositories and
+// environment of the stage, which can change the sources apt reads.
+func packageKey(request PackageRequest, pkg string) string {
+	return strings.Join([]string{
+		request.Image,
+		request.Platform.String(),
+		request.Architecture,
+		pkg,
+		request.TargetReleases[pkg],
+		request.Releases[pkg],
+		strings.Join(request.Environment, "\n"),
+		strings.Join(request.Shell, " "),
+		strings.Join(request.Setup, "\n"),
+	}, "\x00")
+}
@@ -0,0 +1,175 @@
+package anchor
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+type countingImageResolver struct {
+	calls atomic.Int32
+}
+
+func (r *countingImageResolver) ResolveImage(_ context.Context, image string) (string, error) {
+	r.calls.Add(1)
+	return image + "@sha256:abc", nil
+}
+
+func TestRegistryCacheResolveImage(t *testing.T) {
+	images := &countingImageResolver{}
+	cache := &RegistryCache{Images: images}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digest, err := cache.ResolveImage(context.Background(), "debian:bookworm")
+			if err != nil {
+				t.Error(err)
+			}
+			if digest != "debian:bookworm@sha256:abc" {
+				t.Errorf("unexpected digest %s", digest)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := images.calls.Load(); calls != 1 {
+		t.Errorf("expected the image to be resolved once, got %d", calls)
+	}
+	if _, err := cache.ResolveImage(context.Background(), "alpine:3"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := images.calls.Load(); calls != 2 {
+		t.Errorf("expected another image to be resolved, got %d calls", calls)
+	}
+}
+
+func TestRegistryCacheResolvePlatforms(t *testing.T) {
+	calls := 0
+	cache := &RegistryCache{
+		Platforms: func(_ context.Context, image string) ([]v1.Platform, error) {
+			calls++
+			return []v1.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			}, nil
+		},
+	}
+	nodes := Parse(strings.NewReader("FROM debian:bookworm\n"))
+	for range 2 {
+		platforms, err := cache.ResolvePlatforms(context.Background(), nodes, []string{"arm64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(platforms) != 1 || platforms[0].Architecture != "arm64" {
+			t.Errorf("unexpected platforms %v", platforms)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the platforms to be read once, got %d", calls)
+	}
+}
+
+// catalogResolver resolves every package to a version of its architecture, mta to its
+// provider and missing to a failure, recording the packages of each request.
+type catalogResolver struct {
+	mu       sync.Mutex
+	requests [][]string
+}
+
+func (r *catalogResolver) ResolvePackages(
+	_ context.Context, request PackageRequest,
+) (*Resolution, error) {
+	r.mu.Lock()
+	r.requests = append(r.requests, request.Packages)
+	r.mu.Unlock()
+	resolution := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Reasons:   map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	for _, pkg := range request.Packages {
+		switch pkg {
+		case "mta":
+			resolution.Providers[pkg] = "exim"
+			resolution.Versions["exim"] = "4.96"
+			resolution.Reasons["exim"] = "the only provider of mta"
+		case "missing":
+			resolution.Failures = append(resolution.Failures, PackageFailure{Package: pkg})
+		default:
+			resolution.Versions[pkg] = "1.0-" + request.Architecture
+			resolution.Reasons[pkg] = "the newest version"
+		}
+	}
+	return resolution, nil
+}
+
+func TestPackageCache(t *testing.T) {
+	resolver := &catalogResolver{}
+	cache := &PackageCache{Resolver: resolver}
+	resolve := func(architecture string, packages ...string) *Resolution {
+		t.Helper()
+		resolution, err := cache.ResolvePackages(context.Background(), PackageRequest{
+			Image:        "debian:bookworm@sha256:abc",
+			Architecture: architecture,
+			Packages:     packages,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolution
+	}
+
+	resolve("amd64", "curl", "mta", "missing")
+	resolution := resolve("amd64", "curl", "git", "mta", "missing")
+	resolve("arm64", "curl")
+
+	expected := [][]string{{"curl", "mta", "missing"}, {"git"}, {"curl"}}
+	if !reflect.DeepEqual(resolver.requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, resolver.requests)
+	}
+	versions := map[string]string{"curl": "1.0-amd64", "git": "1.0-amd64", "exim": "4.96"}
+	if !reflect.DeepEqual(resolution.Versions, versions) {
+		t.Errorf("expected versions %v, got %v", versions, resolution.Versions)
+	}
+	if resolution.Providers["mta"] != "exim" || resolution.Reasons["exim"] == "" {
+		t.Errorf("expected mta to be provided by exim, got %+v", resolution)
+	}
+	if len(resolution.Failures) != 1 || resolution.Failures[0].Package != "missing" {
+		t.Errorf("expected missing to fail, got %v", resolution.Failures)
+	}
+}
+
+func TestPackageCacheConcurrent(t *testing.T) {
+	resolver := &catalogResolver{}
+	cache := &PackageCache{Resolver: resolver}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resolution, err := cache.ResolvePackages(context.Background(), PackageRequest{
+				Image:        "debian:bookworm@sha256:abc",
+				Architecture: "amd64",
+				Packages:     []string{"curl"},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resolution.Versions["curl"] != "1.0-amd64" {
+				t.Errorf("unexpected versions %v", resolution.Versions)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(resolver.requests) != 1 {
+		t.Errorf("expected curl to be resolved once, got %v", resolver.requests)
+	}
+}
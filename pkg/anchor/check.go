@@ -0,0 +1,260 @@
+package anchor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mismatch is a difference between an anchored Dockerfile, or a file generated with it, and
+// the rendering of its template.
+type Mismatch struct {
+	File string
+	// Line is the 1-based line of the difference in the file, 0 when it is not at a line
+	Line    int
+	Message string
+	// Expected is the rendering of the template, empty when the template has nothing there
+	Expected string
+	// Actual is what the file has instead, empty when it has nothing there
+	Actual string
+}
+
+func (m Mismatch) String() string {
+	var sb strings.Builder
+	sb.WriteString(m.File)
+	if m.Line > 0 {
+		fmt.Fprintf(&sb, ":%d", m.Line)
+	}
+	sb.WriteString(": " + m.Message)
+	if m.Expected != "" {
+		sb.WriteString("\n  template: " + m.Expected)
+	}
+	if m.Actual != "" {
+		sb.WriteString("\n  output:   " + m.Actual)
+	}
+	return sb.String()
+}
+
+// Check renders a template with the pins of its anchored output, read with ReadPins, and
+// reports where the output, named outputName, and the package lists generated with it differ
+// from the rendering. Nothing is resolved, so neither a container runtime nor the network is
+// needed. The template nodes are rewritten with the rendering. An output merged by
+// MergePlatforms is compared with the template rendered for each of its platforms and merged
+// again, and neither config.Platform is used nor the template nodes rewritten.
+func Check(
+	ctx context.Context, template []Node, output []Node, outputName string, config Config,
+) ([]Mismatch, error) {
+	if MergedPlatforms(output) != nil {
+		return checkMerged(ctx, template, output, outputName, config)
+	}
+	pins, err := ReadPins(output, config.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	config.Resolver = pins
+	config.Images = pins
+	result, err := ProcessWithConfig(ctx, template, config)
+	if err != nil {
+		return nil, err
+	}
+	mismatches := CompareNodes(template, output, outputName)
+	for _, file := range result.Files {
+		mismatches = append(mismatches, compareFile(file)...)
+	}
+	return mismatches, nil
+}
+
+// checkMerged is Check for an output merged by MergePlatforms.
+func checkMerged(
+	ctx context.Context, template []Node, output []Node, outputName string, config Config,
+) ([]Mismatch, error) {
+	anchored := []AnchoredPlatform{}
+	for _, value := range MergedPlatforms(output) {
+		platform, err := ParsePlatform(value)
+		if err != nil {
+			return nil, err
+		}
+		pins, err := ReadPlatformPins(output, config.ContextDir, platform)
+		if err != nil {
+			return nil, err
+		}
+		platformConfig := config
+		platformConfig.Platform = platform
+		platformConfig.AppendArchitecture = true
+		platformConfig.Resolver = pins
+		platformConfig.Images = pins
+		nodes := cloneNodes(template)
+		result, err := ProcessWithConfig(ctx, nodes, platformConfig)
+		if err != nil {
+			return nil, err
+		}
+		anchored = append(anchored, AnchoredPlatform{
+			Platform: platform,
+			Nodes:    nodes,
+			Files:    result.Files,
+		})
+	}
+	merged, files, err := MergePlatforms(anchored)
+	if err != nil {
+		return nil, err
+	}
+	mismatches := CompareNodes(merged, output, outputName)
+	for _, file := range files {
+		mismatches = append(mismatches, compareFile(file)...)
+	}
+	return mismatches, nil
+}
+
+// normalizedInstruction returns the instruction of a node with comments, line continuations
+// and the whitespace between its words removed, or false for a node without an instruction.
+func normalizedInstruction(node Node) (string, bool) {
+	if _, err := node.Instruction(); err != nil {
+		return "", false
+	}
+	words := splitWords(joinContinuations(node.masked()))
+	values := []string{strings.ToUpper(words[0].Value)}
+	for _, word := range words[1:] {
+		values = append(values, word.Value)
+	}
+	return strings.Join(values, " "), true
+}
+
+// CompareNodes compares the instructions of an anchored Dockerfile, named name, with those
+// expected. Comments, empty lines and formatting are ignored, so only changes to what is
+// built are reported.
+func CompareNodes(expected []Node, actual []Node, name string) []Mismatch {
+	type instruction struct {
+		text string
+		line int
+	}
+	instructions := func(nodes []Node) []instruction {
+		instructions := []instruction{}
+		for _, node := range nodes {
+			if text, ok := normalizedInstruction(node); ok {
+				instructions = append(instructions, instruction{text: text, line: instructionLine(node)})
+			}
+		}
+		return instructions
+	}
+	texts := func(instructions []instruction) []string {
+		texts := []string{}
+		for _, instruction := range instructions {
+			texts = append(texts, instruction.text)
+		}
+		return texts
+	}
+	keyword := func(text string) string {
+		keyword, _, _ := strings.Cut(text, " ")
+		return keyword
+	}
+	wanted, found := instructions(expected), instructions(actual)
+	// the line an instruction is missing at is the line of the instruction after it
+	lineAt := func(index int) int {
+		if index < len(found) {
+			return found[index].line
+		}
+		if len(actual) == 0 {
+			return 1
+		}
+		last := actual[len(actual)-1]
+		return last.Line + strings.Count(last.Source(), "\n")
+	}
+
+	mismatches := []Mismatch{}
+	ops := diffLines(texts(found), texts(wanted))
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == diffEqual {
+			i++
+			continue
+		}
+		deleted, inserted := []diffOp{}, []diffOp{}
+		for ; i < len(ops) && ops[i].Kind != diffEqual; i++ {
+			if ops[i].Kind == diffDelete {
+				deleted = append(deleted, ops[i])
+			} else {
+				inserted = append(inserted, ops[i])
+			}
+		}
+		for j := 0; j < max(len(deleted), len(inserted)); j++ {
+			switch {
+			case j < len(deleted) && j < len(inserted):
+				got, want := found[deleted[j].Old], wanted[inserted[j].New]
+				mismatches = append(mismatches, Mismatch{
+					File:     name,
+					Line:     got.line,
+					Message:  fmt.Sprintf("%s instruction differs from the template", keyword(got.text)),
+					Expected: want.text,
+					Actual:   got.text,
+				})
+			case j < len(deleted):
+				got := found[deleted[j].Old]
+				mismatches = append(mismatches, Mismatch{
+					File:    name,
+					Line:    got.line,
+					Message: fmt.Sprintf("%s instruction is not in the template", keyword(got.text)),
+					Actual:  got.text,
+				})
+			default:
+				want := wanted[inserted[j].New]
+				mismatches = append(mismatches, Mismatch{
+					File:     name,
+					Line:     lineAt(inserted[j].Old),
+					Message:  fmt.Sprintf("%s instruction of the template is missing", keyword(want.text)),
+					Expected: want.text,
+				})
+			}
+		}
+	}
+	return mismatches
+}
+
+// instructionLine returns the line the instruction of a node starts on, after the comments
+// and empty lines before it.
+func instructionLine(node Node) int {
+	for i, entry := range node.Entries {
+		if entry.Type == EntryCommand {
+			return node.Line + i
+		}
+	}
+	return node.Line
+}
+
+// compareFile compares a generated file with the one on disk, reporting the first line that
+// differs.
+func compareFile(file File) []Mismatch {
+	name := filepath.ToSlash(file.Path)
+	content, err := os.ReadFile(file.Path) // #nosec G304
+	if errors.Is(err, os.ErrNotExist) {
+		return []Mismatch{{File: name, Message: "file of the template is missing"}}
+	}
+	if err != nil {
+		return []Mismatch{{File: name, Message: err.Error()}}
+	}
+	if bytes.Equal(content, file.Content) {
+		return nil
+	}
+	expected := strings.Split(string(file.Content), "\n")
+	actual := strings.Split(string(content), "\n")
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		line := func(lines []string) string {
+			if i < len(lines) {
+				return lines[i]
+			}
+			return ""
+		}
+		if line(expected) != line(actual) {
+			return []Mismatch{{
+				File:     name,
+				Line:     i + 1,
+				Message:  "line differs from the template",
+				Expected: line(expected),
+				Actual:   line(actual),
+			}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package anchor
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const testCheckTemplate = `FROM debian:bookworm AS builder
+COPY packages.txt /tmp/packages.txt
+RUN apt-get update \
+    && apt-get install -y curl $(cat /tmp/packages.txt)
+
+FROM debian:bookworm
+RUN apt-get update && apt-get install -y ca-certificates
+`
+
+const testCheckOutput = `FROM debian:bookworm@sha256:abc AS builder
+COPY packages.lock.txt /tmp/packages.txt
+# formatting and comments of the output are not compared
+RUN dpkg --add-architecture arm64 && apt-get update && apt-get update \
+    && apt-get install -y curl=7.88.1 \
+       $(cat /tmp/packages.txt)
+
+FROM debian:bookworm@sha256:abc
+RUN dpkg --add-architecture arm64 && apt-get update && apt-get update && apt-get install -y ca-certificates=20230311
+`
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		lock     string
+		expected []string
+	}{
+		{"up to date", testCheckTemplate, "git=1:2.39.5\n", []string{}},
+		{
+			"package added",
+			strings.Replace(testCheckTemplate, "curl", "curl wget", 1),
+			"git=1:2.39.5\n",
+			[]string{`Dockerfile:4: RUN instruction differs from the template
+  template: RUN dpkg --add-architecture arm64 && apt-get update && apt-get update && apt-get install -y curl=7.88.1 wget $(cat /tmp/packages.txt)
+  output:   RUN dpkg --add-architecture arm64 && apt-get update && apt-get update && apt-get install -y curl=7.88.1 $(cat /tmp/packages.txt)`},
+		},
+		{
+			"image changed and instruction added",
+			strings.Replace(testCheckTemplate, "FROM debian:bookworm\n", "FROM debian:trixie\nUSER nobody\n", 1),
+			"git=1:2.39.5\n",
+			[]string{
+				`Dockerfile:8: FROM instruction differs from the template
+  template: FROM debian:trixie
+  output:   FROM debian:bookworm@sha256:abc`,
+				`Dockerfile:9: USER instruction of the template is missing
+  template: USER nobody`,
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range map[string]string{
+				"packages.txt":      "git\n",
+				"packages.lock.txt": tc.lock,
+			} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mismatches, err := Check(
+				context.Background(),
+				Parse(strings.NewReader(tc.template)),
+				Parse(strings.NewReader(testCheckOutput)),
+				"Dockerfile",
+				Config{Platform: v1.Platform{OS: "linux", Architecture: "arm64"}, ContextDir: dir},
+			)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			actual := []string{}
+			for _, mismatch := range mismatches {
+				actual = append(actual, mismatch.String())
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Expected:\n%v\ngot:\n%v", strings.Join(tc.expected, "\n"), strings.Join(actual, "\n"))
+			}
+		})
+	}
+}
+
+func TestCheckPackageList(t *testing.T) {
+	dir := t.TempDir()
+	// the list has a package that was added after the lock file was generated
+	for name, content := range map[string]string{
+		"packages.txt":      "git\nmake\njq\n",
+		"packages.lock.txt": "git=1:2.39.5\nmake=4.3-4.1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mismatches, err := Check(
+		context.Background(),
+		Parse(strings.NewReader(testCheckTemplate)),
+		Parse(strings.NewReader(testCheckOutput)),
+		"Dockerfile",
+		Config{Platform: v1.Platform{OS: "linux", Architecture: "arm64"}, ContextDir: dir},
+	)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := []Mismatch{{
+		File:     filepath.ToSlash(filepath.Join(dir, "packages.lock.txt")),
+		Line:     3,
+		Message:  "line differs from the template",
+		Expected: "jq",
+	}}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, mismatches)
+	}
+}
+
+func TestCompareNodes(t *testing.T) {
+	expected := Parse(strings.NewReader("FROM debian\nRUN true\nUSER nobody\nCMD [\"sh\"]\n"))
+	actual := Parse(strings.NewReader("FROM debian\n\n# edited by hand\nRUN  false\nCMD [\"sh\"]\nEXPOSE 80\n"))
+	mismatches := CompareNodes(expected, actual, "Dockerfile")
+	lines := []string{}
+	for _, mismatch := range mismatches {
+		lines = append(lines, mismatch.String())
+	}
+	expectedLines := []string{
+		"Dockerfile:4: RUN instruction differs from the template\n" +
+			"  template: RUN true\n  output:   RUN false",
+		"Dockerfile:5: USER instruction of the template is missing\n  template: USER nobody",
+		"Dockerfile:6: EXPOSE instruction is not in the template\n  output:   EXPOSE 80",
+	}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", strings.Join(expectedLines, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestCheckVirtualPackage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "packages.txt"), []byte("mta\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	template := `FROM debian:bookworm
+COPY packages.txt /tmp/packages.txt
+RUN apt-get update && apt-get install -y mta curl $(cat /tmp/packages.txt)
+`
+	config := Config{
+		Platform:   v1.Platform{OS: "linux", Architecture: "amd64"},
+		ContextDir: dir,
+		Output:     io.Discard,
+	}
+	anchored := config
+	anchored.Resolver = &catalogResolver{}
+	anchored.Images = strictImageResolver{"debian:bookworm": "sha256:abc"}
+	output := Parse(strings.NewReader(template))
+	result, err := ProcessWithConfig(context.Background(), output, anchored)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	for _, file := range result.Files {
+		if err := os.WriteFile(file.Path, file.Content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(output[2].Source(), "# anchor providers=mta=exim\n") ||
+		!strings.Contains(output[2].Source(), " exim=4.96 curl=") {
+		t.Fatalf("Expected mta to be anchored to its provider, got:\n%s", output[2].Source())
+	}
+
+	mismatches, err := Check(
+		context.Background(), Parse(strings.NewReader(template)), output, "Dockerfile", config,
+	)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(mismatches) > 0 {
+		t.Errorf("Expected no mismatches but got %v", mismatches)
+	}
+
+	// the provider is kept rather than resolved again, and locked through the virtual package
+	pins, err := ReadPins(output, dir)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	resolver := &recordingPackageResolver{resolver: &failingResolver{}}
+	kept := config
+	kept.Pins = pins
+	kept.Refresh = Selection{Names: []string{"curl"}}
+	kept.Resolver = resolver
+	_, err = ProcessWithConfig(context.Background(), Parse(strings.NewReader(template)), kept)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(resolver.requests) != 1 ||
+		!reflect.DeepEqual(resolver.requests[0].Packages, []string{"curl"}) {
+		t.Errorf("Expected only curl to be resolved again, got %+v", resolver.requests)
+	}
+	file, err := NewLockedFile(
+		"Dockerfile.template", "Dockerfile", config.Platform, pins, "registry", time.Now(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := config
+	locked.Resolver = &file
+	locked.Images = &file
+	_, err = ProcessWithConfig(context.Background(), Parse(strings.NewReader(template)), locked)
+	if err != nil {
+		t.Errorf("Expected the lockfile to resolve mta but got %v", err)
+	}
+}
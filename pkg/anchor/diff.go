@@ -0,0 +1,151 @@
+package anchor
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// diffKind is whether a line is kept, removed from the old text or inserted from the updated one.
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffDelete
+	diffInsert
+)
+
+// diffOp is one line of a diff. Old and New are the indexes of the line in the old and
+// updated text, the index of the next line of the other text when it is only in one of them.
+type diffOp struct {
+	Kind diffKind
+	Old  int
+	New  int
+}
+
+// diffLines returns the shortest edit from the old lines to the updated lines, from their
+// longest common subsequence. Deletions come before insertions where lines are replaced.
+func diffLines(old []string, updated []string) []diffOp {
+	// lengths[i][j] is the length of the longest common subsequence of old[i:] and updated[j:]
+	lengths := make([][]int, len(old)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(updated)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(updated) - 1; j >= 0; j-- {
+			if old[i] == updated[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(old) || j < len(updated) {
+		switch {
+		case i < len(old) && j < len(updated) && old[i] == updated[j]:
+			ops = append(ops, diffOp{Kind: diffEqual, Old: i, New: j})
+			i++
+			j++
+		case j == len(updated) || (i < len(old) && lengths[i+1][j] >= lengths[i][j+1]):
+			ops = append(ops, diffOp{Kind: diffDelete, Old: i, New: j})
+			i++
+		default:
+			ops = append(ops, diffOp{Kind: diffInsert, Old: i, New: j})
+			j++
+		}
+	}
+	return ops
+}
+
+// diffContext is the number of unchanged lines shown around each change of a unified diff.
+const diffContext = 3
+
+// UnifiedDiff returns the changes from old to updated in the unified format of diff -u,
+// labelled with the names of the files, or an empty string when they are the same.
+func UnifiedDiff(oldName string, updatedName string, old []byte, updated []byte) string {
+	oldLines, updatedLines := splitLines(old), splitLines(updated)
+	ops := diffLines(oldLines, updatedLines)
+	var sb strings.Builder
+	for start := 0; start < len(ops); {
+		// a hunk starts with the context before a change and ends once there are more unchanged
+		// lines than the context around two changes
+		first := slices.IndexFunc(ops[start:], func(op diffOp) bool { return op.Kind != diffEqual })
+		if first < 0 {
+			break
+		}
+		first += start
+		end, equal := first, 0
+		for i := first; i < len(ops) && equal <= 2*diffContext; i++ {
+			if ops[i].Kind == diffEqual {
+				equal++
+				continue
+			}
+			end, equal = i+1, 0
+		}
+		hunk := ops[max(start, first-diffContext):min(len(ops), end+diffContext)]
+		start = min(len(ops), end+diffContext)
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, updatedName)
+		}
+		oldCount, updatedCount := 0, 0
+		for _, op := range hunk {
+			if op.Kind != diffInsert {
+				oldCount++
+			}
+			if op.Kind != diffDelete {
+				updatedCount++
+			}
+		}
+		fmt.Fprintf(
+			&sb,
+			"@@ -%s +%s @@\n",
+			hunkRange(hunk[0].Old, oldCount),
+			hunkRange(hunk[0].New, updatedCount),
+		)
+		for _, op := range hunk {
+			switch op.Kind {
+			case diffEqual:
+				writeDiffLine(&sb, " ", oldLines[op.Old])
+			case diffDelete:
+				writeDiffLine(&sb, "-", oldLines[op.Old])
+			case diffInsert:
+				writeDiffLine(&sb, "+", updatedLines[op.New])
+			}
+		}
+	}
+	return sb.String()
+}
+
+// writeDiffLine writes a line of a hunk, marking a last line without a newline as diff does.
+func writeDiffLine(sb *strings.Builder, prefix string, line string) {
+	sb.WriteString(prefix + line)
+	if !strings.HasSuffix(line, "\n") {
+		sb.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// hunkRange formats the start and length of a hunk from the index of its first line. An
+// empty range starts at the line before it, as diff prints it.
+func hunkRange(index int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", index)
+	}
+	if count == 1 {
+		return strconv.Itoa(index + 1)
+	}
+	return fmt.Sprintf("%d,%d", index+1, count)
+}
+
+// splitLines splits content into lines that keep their newline, so that a last line without
+// one differs from the same line with one, as it does when the files are compared.
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
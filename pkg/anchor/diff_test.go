@@ -0,0 +1,66 @@
+package anchor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := `FROM debian:bookworm@sha256:abc
+ARG A=1
+ARG B=2
+ARG C=3
+ARG D=4
+ARG E=5
+ARG F=6
+ARG G=7
+ARG H=8
+RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y curl=7.88.1
+`
+	updated := strings.NewReplacer(
+		"sha256:abc", "sha256:def",
+		"curl=7.88.1", "curl=7.88.2",
+	).Replace(old) + "USER nobody\n"
+	expected := `--- a/Dockerfile
++++ b/Dockerfile
+@@ -1,4 +1,4 @@
+-FROM debian:bookworm@sha256:abc
++FROM debian:bookworm@sha256:def
+ ARG A=1
+ ARG B=2
+ ARG C=3
+@@ -7,4 +7,5 @@
+ ARG F=6
+ ARG G=7
+ ARG H=8
+-RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y curl=7.88.1
++RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y curl=7.88.2
++USER nobody
+`
+	actual := UnifiedDiff("a/Dockerfile", "b/Dockerfile", []byte(old), []byte(updated))
+	if actual != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, actual)
+	}
+}
+
+func TestUnifiedDiffNewFile(t *testing.T) {
+	expected := "--- /dev/null\n+++ b/packages.lock.txt\n@@ -0,0 +1,2 @@\n+curl=7.88.1\n+git=1:2.39.5\n"
+	actual := UnifiedDiff("/dev/null", "b/packages.lock.txt", nil, []byte("curl=7.88.1\ngit=1:2.39.5\n"))
+	if actual != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, actual)
+	}
+	if diff := UnifiedDiff("a", "b", []byte("same\n"), []byte("same\n")); diff != "" {
+		t.Errorf("Expected no diff but got %v", diff)
+	}
+}
+
+func TestUnifiedDiffNewline(t *testing.T) {
+	expected := "--- a\n+++ b\n@@ -1,2 +1,2 @@\n FROM debian\n-USER nobody\n" +
+		"\\ No newline at end of file\n+USER nobody\n"
+	actual := UnifiedDiff(
+		"a", "b", []byte("FROM debian\nUSER nobody"), []byte("FROM debian\nUSER nobody\n"),
+	)
+	if actual != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, actual)
+	}
+}
@@ -3,95 +3,307 @@ package anchor
 import (
 	"context"
 	"fmt"
-	"os/exec"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/fatih/color"
-	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-func processFromCommand(node *Node) (string, error) {
+func processFromCommand(
+	ctx context.Context, node *Node, config Config, stage string,
+) (string, error) {
 	if node.CommandType != CommandFrom {
 		return "", fmt.Errorf("node is not a FROM command")
 	}
-	ignoredPackages := []string{}
-	ignoreAll := false
-	for i := range node.Entries {
-		entry := node.Entries[i]
-		if entry.Type == EntryComment {
-			var ignored []string
-			ignored, ignoreAll = parseComment(entry)
-			ignoredPackages = append(ignoredPackages, ignored...)
-		}
-		if entry.Type != EntryCommand {
-			continue
-		}
+	ignoredPackages, ignoreAll := nodeIgnores(node)
+	w := config.output()
 
-		commandSplit := strings.Split(entry.Value, " ")
-		if len(commandSplit) < 2 {
-			return "", fmt.Errorf("FROM command is missing image name")
-		}
+	instruction, err := node.Instruction()
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to parse the FROM command on line %d: %w", instructionLine(*node), err,
+		)
+	}
+	from, ok := instruction.(*FromInstruction)
+	if !ok {
+		return "", fmt.Errorf("node did not contain a FROM command")
+	}
 
-		if len(commandSplit) == 4 {
-			color.Blue("Parsing %s image...", commandSplit[3])
-		} else {
-			color.Blue("Parsing the final image...")
-		}
+	if !from.Alias.IsZero() {
+		printColor(w, color.FgBlue, "Parsing %s image...", from.Alias.Value)
+	} else {
+		printColor(w, color.FgBlue, "Parsing the final image...")
+	}
 
-		image := commandSplit[1]
-		image = strings.TrimSpace((image))
-		if slices.Contains(ignoredPackages, image) || ignoreAll {
-			return image, nil
-		}
+	image, pinned := splitImageDigest(from.Image.Value)
+	if ignoreAll || slices.Contains(ignoredPackages, image) ||
+		slices.Contains(ignoredPackages, from.Image.Value) {
+		return from.Image.Value, nil
+	}
+	if strings.Contains(image, "$") {
+		printColor(w, color.FgYellow, "\tLeaving %s as it is, it is set with a build arg", image)
+		return from.Image.Value, nil
+	}
+	if !hasTag(image) && pinned != "" {
+		// the image is only referenced by digest, there is no tag to refresh it from
+		fmt.Fprintf(w, "\t⚓%s is already anchored to %s\n", image, pinned)
+		return from.Image.Value, nil
+	}
 
-		digest, err := crane.Digest(image)
-		if err != nil {
-			return "", err
-		}
+	digest, err := config.imageDigest(ctx, image, stage)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		printColor(w, color.FgYellow, "\tLeaving %s as it is, no digest was found for it", image)
+		return from.Image.Value, nil
+	}
 
-		entry.Value = strings.Replace((entry.Value), image, fmt.Sprintf("%s@%s", image, digest), 1)
-		node.Entries[i] = entry
-		fmt.Printf("\t⚓Anchored %s to %s\n", image, digest)
-		// FROM command can only be one line, exit here
-		return image, nil
+	anchored := fmt.Sprintf("%s@%s", image, digest)
+	err = node.Apply(Edit{Span: from.Image.Span, Text: anchored})
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("node did not contain a FROM command")
+	if pinned != "" && pinned != digest {
+		fmt.Fprintf(w, "\t⚓Re-anchored %s from %s to %s\n", image, pinned, digest)
+	} else {
+		fmt.Fprintf(w, "\t⚓Anchored %s to %s\n", image, digest)
+	}
+	return anchored, nil
 }
 
-func IsDockerInstalled() bool {
-	cmd := exec.Command("docker", "--version")
-	if err := cmd.Run(); err != nil {
-		return false
-	}
-	return true
+// splitImageDigest splits an image reference into the reference without a digest and the
+// digest it is pinned to, if any.
+func splitImageDigest(image string) (string, string) {
+	ref, digest, _ := strings.Cut(image, "@")
+	return ref, digest
 }
 
-func IsDockerRunning() bool {
-	cmd := exec.Command("docker", "info")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return false
-	}
-	// Check if output contains information indicating Docker is running
-	return strings.Contains(string(output), "Server:")
+// hasTag reports whether the image reference includes a tag, e.g. golang:1.23.
+func hasTag(image string) bool {
+	name := image[strings.LastIndex(image, "/")+1:]
+	return strings.Contains(name, ":")
 }
 
-func processRunCommand(ctx context.Context, node *Node, architecture string, image string) error {
+// processRunCommand anchors the packages installed by a RUN command, returning the package
+// lists it generated and the packages that could not be resolved.
+func processRunCommand(
+	ctx context.Context, node *Node, config Config, stage *stage,
+) ([]File, []PackageFailure, error) {
 	if node.CommandType != CommandRun {
-		return fmt.Errorf("node is not a RUN command")
+		return nil, nil, fmt.Errorf("node is not a RUN command")
 	}
 
-	packageNames := parseCommand(node.Command)
-	if len(packageNames) == 0 {
-		return nil
+	ignored, all := nodeIgnores(node)
+	if all {
+		return nil, nil, nil
 	}
-	packageMap, err := fetchPackageVersions(ctx, packageNames, architecture, image)
+	w := config.output()
+	installs, err := runInstalls(node)
 	if err != nil {
-		return err
+		printColor(w, color.FgYellow, "\tSkipping RUN command that could not be parsed: %s", err)
+		return nil, nil, nil
 	}
-	appendPackageVersions(node, packageMap, architecture)
-	return nil
+	packageNames := installPackageNames(installs, ignored)
+	lists, err := readPackageLists(w, installs, config.ContextDir, stage.copies)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, list := range lists {
+		for _, pkg := range list.unignored(ignored) {
+			if !slices.Contains(packageNames, pkg) {
+				packageNames = append(packageNames, pkg)
+			}
+		}
+	}
+	if len(packageNames) == 0 {
+		return nil, nil, nil
+	}
+	setup := slices.Clone(stage.setup)
+	if len(installs) > 0 {
+		// repositories added earlier in the same RUN, before the install
+		if prefix := repositorySetup(node, installs[len(installs)-1].Start); prefix != "" {
+			setup = append(setup, prefix)
+		}
+	}
+	environment := []string{}
+	for _, variable := range config.ProxyEnv {
+		key, value, _ := strings.Cut(variable, "=")
+		environment = append(environment, key+"="+shellQuote(value))
+	}
+	targetReleases, releases := installReleases(installs, lists)
+	kept := config.keptPackages(packageNames, stage.name)
+	resolved := slices.DeleteFunc(slices.Clone(packageNames), func(pkg string) bool {
+		_, _, ok := kept.pin(pkg)
+		return ok
+	})
+	resolution := &Resolution{Versions: map[string]string{}, Providers: map[string]string{}}
+	if len(resolved) > 0 {
+		printColor(w, color.FgBlue, "\tParsing package versions...")
+		resolution, err = config.packageResolver().ResolvePackages(ctx, PackageRequest{
+			Image:          stage.image,
+			Platform:       config.Platform,
+			Stage:          stage.name,
+			Architecture:   config.architecture(),
+			Packages:       resolved,
+			TargetReleases: targetReleases,
+			Releases:       releases,
+			Environment:    append(environment, stage.env...),
+			Shell:          stage.shell,
+			Setup:          setup,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if resolution.Versions == nil {
+			resolution.Versions = map[string]string{}
+		}
+		if resolution.Providers == nil {
+			resolution.Providers = map[string]string{}
+		}
+	}
+	maps.Copy(resolution.Versions, kept.Versions)
+	maps.Copy(resolution.Providers, kept.Providers)
+	for i := range resolution.Failures {
+		resolution.Failures[i].Stage = stage.name
+		printColor(w, color.FgRed, "\t%s", resolution.Failures[i].String())
+	}
+	if err := appendPackageVersions(w, node, resolution, config.architecture()); err != nil {
+		return nil, nil, err
+	}
+	// the anchored instruction and lists only name the providers of virtual packages, so the
+	// virtual packages they were anchored for are recorded to be read back by ReadPins
+	providers := map[string]string{}
+	for virtual, provider := range nodeProviders(node) {
+		if slices.Contains(packageNames, provider) && !slices.Contains(packageNames, virtual) {
+			providers[virtual] = provider
+		}
+	}
+	for _, pkg := range packageNames {
+		if name, _, ok := resolution.pin(pkg); ok && name != pkg {
+			providers[pkg] = name
+		}
+	}
+	setProvidersComment(node, providers)
+
+	files := []File{}
+	for _, list := range lists {
+		lock := lockName(list.Source, config.architecture(), config.AppendArchitecture)
+		if err := list.copy.rewrite(list.sourceWord, lock, list.Target); err != nil {
+			return nil, nil, err
+		}
+		files = append(files, File{
+			Path:    filepath.Join(config.ContextDir, filepath.FromSlash(lock)),
+			Content: list.pinned(w, resolution, ignored),
+		})
+		fmt.Fprintf(w, "\t⚓Anchored package list %s to %s\n", list.Source, lock)
+	}
+	return files, resolution.Failures, nil
+}
+
+// installReleases returns the target releases of the packages installed with -t, and the
+// releases of those installed with a package/release suffix.
+func installReleases(
+	installs []packageInstall, lists []*packageList,
+) (map[string]string, map[string]string) {
+	targetReleases := map[string]string{}
+	releases := map[string]string{}
+	for _, install := range installs {
+		packages := []string{}
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if !ok {
+				continue
+			}
+			pkg, release := packageRelease(value)
+			packages = append(packages, pkg)
+			if release != "" {
+				releases[pkg] = release
+			}
+		}
+		for _, list := range lists {
+			if slices.ContainsFunc(install.ListFiles, func(file shellWord) bool {
+				target, ok := file.literal()
+				return ok && target == list.Target
+			}) {
+				packages = append(packages, list.Packages...)
+			}
+		}
+		if install.TargetRelease == "" {
+			continue
+		}
+		for _, pkg := range packages {
+			targetReleases[pkg] = install.TargetRelease
+		}
+	}
+	return targetReleases, releases
+}
+
+// readPackageLists reads the package lists installed by a RUN command from the build
+// context, following them back through the COPY instructions of the stage.
+func readPackageLists(
+	w io.Writer, installs []packageInstall, contextDir string, copies []*stageCopy,
+) ([]*packageList, error) {
+	lists := []*packageList{}
+	seen := []string{}
+	for _, install := range installs {
+		for _, file := range install.ListFiles {
+			target, ok := file.literal()
+			if !ok || slices.Contains(seen, target) {
+				continue
+			}
+			seen = append(seen, target)
+			var list *packageList
+			// the latest copy to a path is the one the RUN command reads
+			for i := len(copies) - 1; i >= 0 && list == nil; i-- {
+				source, found := copies[i].resolve(target)
+				if !found {
+					continue
+				}
+				var err error
+				list, err = readPackageList(contextDir, source.Literal(), target)
+				if err != nil {
+					return nil, err
+				}
+				list.copy = copies[i]
+				list.sourceWord = source
+			}
+			if list == nil {
+				printColor(
+					w,
+					color.FgYellow,
+					"\tSkipping package list %s as it is not copied from the build context",
+					target,
+				)
+				continue
+			}
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// nodeIgnores returns the images and packages ignored by the anchor comments of a node,
+// and whether the whole node is ignored.
+func nodeIgnores(node *Node) ([]string, bool) {
+	ignoredPackages := []string{}
+	ignoreAll := false
+	for _, entry := range node.Entries {
+		if entry.Type == EntryComment {
+			ignored, all := parseComment(entry)
+			ignoredPackages = append(ignoredPackages, ignored...)
+			ignoreAll = ignoreAll || all
+		}
+	}
+	return ignoredPackages, ignoreAll
 }
 
 func parseComment(entry Entry) ([]string, bool) {
@@ -129,95 +341,404 @@ func parseComment(entry Entry) ([]string, bool) {
 	return ignoredPackages, false
 }
 
-func appendPackageVersions(node *Node, packageMap map[string]string, architecture string) {
-	aptGet := false
-	install := false
-	dpkgSet := false
-	ignoredPackages := []string{}
-	for i := range node.Entries {
-		entry := node.Entries[i]
-		if entry.Type == EntryComment {
-			ignored, all := parseComment(entry)
-			if all {
-				return
-			}
-			ignoredPackages = append(ignoredPackages, ignored...)
+// providersPrefix starts the comment that records the package each virtual package of a RUN
+// instruction is anchored to, e.g. # anchor providers=mail-transport-agent=exim4-daemon-light,
+// as the anchored instruction only names the provider.
+const providersPrefix = "# anchor providers="
+
+// nodeProviders returns the providers recorded in the comments of a node, by virtual package.
+func nodeProviders(node *Node) map[string]string {
+	providers := map[string]string{}
+	for _, entry := range node.Entries {
+		if entry.Type != EntryComment {
+			continue
 		}
-		if entry.Type != EntryCommand {
+		value, ok := strings.CutPrefix(strings.TrimSpace(entry.Value), providersPrefix)
+		if !ok {
 			continue
 		}
-
-		elements := strings.Split(entry.Value, " ")
-		for j := range elements {
-			if elements[j] == "apt-get" {
-				aptGet = true
+		for _, pair := range strings.Split(value, ",") {
+			if virtual, provider, ok := strings.Cut(strings.TrimSpace(pair), "="); ok {
+				providers[virtual] = provider
 			}
-			if aptGet && elements[j] == "install" {
-				install = true
+		}
+	}
+	return providers
+}
+
+// setProvidersComment replaces the providers comment of a node with one for the providers,
+// removing it when there are none.
+func setProvidersComment(node *Node, providers map[string]string) {
+	node.Entries = slices.DeleteFunc(node.Entries, func(entry Entry) bool {
+		return entry.Type == EntryComment &&
+			strings.HasPrefix(strings.TrimSpace(entry.Value), providersPrefix)
+	})
+	if len(providers) == 0 {
+		return
+	}
+	i := slices.IndexFunc(node.Entries, func(entry Entry) bool {
+		return entry.Type == EntryCommand
+	})
+	if i < 0 {
+		return
+	}
+	pairs := []string{}
+	for _, virtual := range slices.Sorted(maps.Keys(providers)) {
+		pairs = append(pairs, virtual+"="+providers[virtual])
+	}
+	comment := providersPrefix + strings.Join(pairs, ",") + "\n"
+	node.Entries = slices.Insert(node.Entries, i, Entry{Type: EntryComment, Value: comment})
+}
 
+// dpkgPrefix matches the architecture prefix injected by appendPackageVersions, with the
+// whitespace after it, so it can be refreshed rather than injected again when anchoring
+// previously anchored input.
+var dpkgPrefix = regexp.MustCompile(`^dpkg --add-architecture (\S+) && apt-get update &&\s*`)
+
+// findDpkgPrefix returns the indexes of the architecture prefix and its architecture in a
+// script, as FindStringSubmatchIndex does, or nil when the script does not start with the
+// prefix anchor injects. The same command later in the script, or adding an architecture
+// the script installs packages of, such as wine32:i386, is the user's own setup.
+func findDpkgPrefix(script string) []int {
+	start := len(script) - len(strings.TrimLeftFunc(script, unicode.IsSpace))
+	match := dpkgPrefix.FindStringSubmatchIndex(script[start:])
+	if match == nil {
+		return nil
+	}
+	for i := range match {
+		match[i] += start
+	}
+	if strings.Contains(script[match[1]:], ":"+script[match[2]:match[3]]) {
+		return nil
+	}
+	return match
+}
+
+// packageName strips any pinned version or release from a package argument, e.g.
+// curl=7.88.1 and curl/bookworm-backports are curl.
+func packageName(pkg string) string {
+	name, _ := packageRelease(pkg)
+	return name
+}
+
+// packageRelease splits the release from a package argument such as
+// curl/bookworm-backports, it is empty when the package is not installed from a release.
+func packageRelease(pkg string) (string, string) {
+	name, _, _ := strings.Cut(pkg, "=")
+	name, release, _ := strings.Cut(name, "/")
+	return name, release
+}
+
+// packageVersion returns the version a package argument is pinned to, e.g. 7.88.1 for
+// curl=7.88.1, it is empty when the package is not pinned.
+func packageVersion(pkg string) string {
+	_, version, _ := strings.Cut(pkg, "=")
+	return version
+}
+
+// isDowngrade reports whether re-anchoring a package from its previous version to the
+// candidate would downgrade it, e.g. when the previous version came from a release that is
+// no longer selected or has been removed from the archive.
+func isDowngrade(previous string, version string) bool {
+	return previous != "" && CompareDebianVersions(version, previous) < 0
+}
+
+// reportAnchor prints the version a package is anchored to, warning about downgrades.
+func reportAnchor(w io.Writer, pkg string, previous string, version string) {
+	switch {
+	case isDowngrade(previous, version):
+		printColor(w, color.FgYellow, "\tDowngraded %s from %s to %s", pkg, previous, version)
+	case previous != "" && previous != version:
+		fmt.Fprintf(w, "\t⚓Re-anchored %s from %s to %s\n", pkg, previous, version)
+	default:
+		fmt.Fprintf(w, "\t⚓Anchored %s to %s\n", pkg, version)
+	}
+}
+
+// printColor prints a line of progress in a colour, as color.Blue and the like print to
+// color.Output.
+func printColor(w io.Writer, attribute color.Attribute, format string, a ...any) {
+	color.New(attribute).Fprintln(w, fmt.Sprintf(format, a...))
+}
+
+// pinnedWord returns the replacement text for a package word, keeping its quoting.
+func pinnedWord(word shellWord, text string) string {
+	if len(word.Parts) == 1 {
+		switch word.Parts[0].Kind {
+		case partSingleQuoted:
+			return "'" + text + "'"
+		case partDoubleQuoted:
+			return `"` + text + `"`
+		}
+	}
+	return text
+}
+
+func appendPackageVersions(
+	w io.Writer, node *Node, resolution *Resolution, architecture string,
+) error {
+	ignoredPackages, all := nodeIgnores(node)
+	if all {
+		return nil
+	}
+	instruction, err := node.Instruction()
+	if err != nil {
+		return err
+	}
+	run, ok := instruction.(*RunInstruction)
+	if !ok {
+		return nil
+	}
+	installs, err := runInstalls(node)
+	if err != nil {
+		return err
+	}
+
+	edits := []Edit{}
+	installing := false
+	for _, install := range installs {
+		installing = installing || len(install.ListFiles) > 0
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if !ok {
+				continue
 			}
-			if aptGet && install {
-				pkg := strings.TrimSpace(elements[j])
-				if _, ok := packageMap[pkg]; ok {
-					if !slices.Contains(ignoredPackages, pkg) {
-						fmt.Printf(
-							"\t⚓Anchored %s to %s\n",
-							pkg,
-							packageMap[elements[j]],
-						)
-						elements[j] = fmt.Sprintf("%s=%s", elements[j], packageMap[elements[j]])
-					}
-				}
+			pkg := packageName(value)
+			if slices.Contains(ignoredPackages, pkg) {
+				continue
 			}
-			if strings.TrimSpace(elements[j]) == "&&" {
-				aptGet = false
-				install = false
+			installing = true
+			name, version, ok := resolution.pin(pkg)
+			if !ok {
+				continue
 			}
-		}
-		entry.Value = strings.Join(elements, " ")
-		if !dpkgSet {
-			dpkgSet = true
-			// since we know we have packages, that must mean we have apt-get install as part of this command
-			// so we append the architecture and update to the beginning
-			if entry.Beginning {
-				s := fmt.Sprintf(
-					"RUN dpkg --add-architecture %s && apt-get update &&",
-					architecture,
-				)
-				entry.Value = strings.Replace(entry.Value,
-					"RUN",
-					s,
-					1,
-				)
-			} else {
-				entry.Value = fmt.Sprintf(
-					// leading space is intentional to separate commands
-					" dpkg --add-architecture %s && apt-get update \\\n &&%s",
-					architecture,
-					entry.Value,
-				)
+			if name != pkg {
+				fmt.Fprintf(w, "\t⚓Anchored virtual package %s to its provider %s\n", pkg, name)
 			}
+			reportAnchor(w, name, packageVersion(value), version)
+			edits = append(edits, Edit{
+				Span: word.Span,
+				Text: pinnedWord(word, fmt.Sprintf("%s=%s", name, version)),
+			})
+		}
+	}
+	if !installing || run.Exec {
+		return node.Apply(edits...)
+	}
+
+	// the command installs packages, including those of package lists and those that failed
+	// to resolve, so we prepend the architecture and update, or refresh the existing prefix
+	if match := findDpkgPrefix(run.Script); match != nil {
+		edits = append(edits, Edit{Span: Span{Start: match[2], End: match[3]}, Text: architecture})
+	} else {
+		start := len(run.Script) - len(strings.TrimLeftFunc(run.Script, unicode.IsSpace))
+		edits = append(edits, Edit{
+			Span: Span{Start: start, End: start},
+			Text: fmt.Sprintf("dpkg --add-architecture %s && apt-get update && ", architecture),
+		})
+	}
+	return node.Apply(edits...)
+}
+
+// Config configures how ProcessWithConfig anchors a Dockerfile.
+type Config struct {
+	// Platform is the platform anchored to, such as linux/arm/v7
+	Platform v1.Platform
+	// ContextDir is the build context that COPY sources are read from
+	ContextDir string
+	// AppendArchitecture adds the architecture to the names of generated files, so that
+	// several architectures can be anchored side by side
+	AppendArchitecture bool
+	// Resolver resolves package versions, packages are resolved in a docker container when it
+	// is nil
+	Resolver PackageResolver
+	// ProxyEnv are proxy variables, as KEY=VALUE pairs, that are set while resolving packages
+	// in addition to the ENV and ARG values of the stage
+	ProxyEnv []string
+	// Images resolves the digests of base images, they are looked up in the registry when it
+	// is nil
+	Images ImageResolver
+	// Pins are the pins of the previous output. Images and packages that Refresh does not
+	// select keep them rather than being resolved again
+	Pins *Pins
+	// Refresh selects the images and packages that are resolved again when Pins are set
+	Refresh Selection
+	// Output is where the progress is written, color.Output when it is nil
+	Output io.Writer
+}
+
+// architecture returns the dpkg architecture of the platform, e.g. armhf for linux/arm/v7.
+func (c Config) architecture() string {
+	architecture, _ := DpkgArchitecture(c.Platform)
+	return architecture
+}
+
+func (c Config) output() io.Writer {
+	if c.Output == nil {
+		return color.Output
+	}
+	return c.Output
+}
+
+func (c Config) packageResolver() PackageResolver {
+	if c.Resolver == nil {
+		return &ContainerResolver{}
+	}
+	return c.Resolver
+}
+
+func (c Config) imageResolver() ImageResolver {
+	if c.Images == nil {
+		return &RegistryImageResolver{}
+	}
+	return c.Images
+}
+
+// imageDigest returns the digest to anchor the image of a stage to, which is its previous pin
+// when it is not selected to be refreshed.
+func (c Config) imageDigest(ctx context.Context, image string, stage string) (string, error) {
+	if c.Pins != nil && !c.Refresh.selectsImage(image, stage) {
+		if digest, ok := c.Pins.Images[image]; ok {
+			return digest, nil
 		}
-		node.Entries[i] = entry
 	}
+	return c.imageResolver().ResolveImage(ctx, image)
 }
 
+// keptPackages returns the previous pins of the packages of a stage that are not selected to
+// be refreshed, through the providers they were anchored to for virtual packages. Packages
+// that were not pinned before are resolved.
+func (c Config) keptPackages(packages []string, stage string) *Resolution {
+	kept := &Resolution{Versions: map[string]string{}, Providers: map[string]string{}}
+	if c.Pins == nil {
+		return kept
+	}
+	for _, pkg := range packages {
+		name, version, ok := c.Pins.pin(stage, pkg)
+		if !ok || c.Refresh.selectsPackage(pkg, stage) || c.Refresh.selectsPackage(name, stage) {
+			continue
+		}
+		if name != pkg {
+			kept.Providers[pkg] = name
+		}
+		kept.Versions[name] = version
+	}
+	return kept
+}
+
+// File is a file generated alongside the anchored Dockerfile, such as a pinned package list.
+type File struct {
+	Path    string
+	Content []byte
+}
+
+// Result holds everything ProcessWithConfig generated besides the rewritten nodes.
+type Result struct {
+	Files []File
+}
+
+// Process anchors the base images and packages of a Dockerfile to the dpkg architecture,
+// e.g. amd64, rewriting the nodes. Package lists are read from the working directory and
+// their pinned lists are written next to them.
+//
+// Deprecated: use ProcessWithConfig, which returns the pinned package lists rather than
+// writing them.
 func Process(ctx context.Context, nodes []Node, architecture string) error {
-	image := ""
-	var err error
-	for _, node := range nodes {
+	platform, err := DpkgPlatform(architecture)
+	if err != nil {
+		return err
+	}
+	result, err := ProcessWithConfig(ctx, nodes, Config{Platform: platform})
+	if err != nil {
+		return err
+	}
+	for _, file := range result.Files {
+		if err := os.WriteFile(filepath.Clean(file.Path), file.Content, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessWithConfig anchors the base images and packages of a Dockerfile to the platform of
+// the config, rewriting the nodes, and returns the package lists it pinned. Packages that
+// cannot be resolved are reported together in a ResolutionError.
+func ProcessWithConfig(ctx context.Context, nodes []Node, config Config) (*Result, error) {
+	if _, err := DpkgArchitecture(config.Platform); err != nil {
+		return nil, err
+	}
+	result := &Result{Files: []File{}}
+	// share the resolver, and its caches, between stages
+	config.Resolver = config.packageResolver()
+	args := globalArgs(nodes)
+	current := newStage("", args)
+	stages := 0
+	// the anchored images of the named stages, which later stages can be built from
+	stageImages := map[string]string{"scratch": "scratch"}
+	failures := []PackageFailure{}
+	for i := range nodes {
+		node := &nodes[i]
 		switch node.CommandType {
 		case CommandFrom:
-			image, err = processFromCommand(&node)
-			if err != nil {
-				return err
+			name := stageName(node, stages)
+			image, ok := baseStageImage(node, stageImages)
+			if !ok {
+				var err error
+				image, err = processFromCommand(ctx, node, config, name)
+				if err != nil {
+					return nil, err
+				}
 			}
+			stageImages[strings.ToLower(name)] = image
+			current = newStage(image, args)
+			current.name = name
+			stages++
 		case CommandRun:
-			err := processRunCommand(ctx, &node, architecture, image)
+			// read before the node is rewritten with the anchored versions
+			setup := repositorySetup(node, -1)
+			files, runFailures, err := processRunCommand(ctx, node, config, current)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			result.Files = append(result.Files, files...)
+			failures = append(failures, runFailures...)
+			if setup != "" {
+				current.setup = append(current.setup, setup)
 			}
+		default:
+			current.apply(node)
 		}
 	}
-	return nil
+	if len(failures) > 0 {
+		return nil, &ResolutionError{Failures: failures}
+	}
+	return result, nil
+}
+
+// baseStageImage returns the image of the earlier stage, or scratch, a FROM instruction
+// builds on, which is not anchored again.
+func baseStageImage(node *Node, stageImages map[string]string) (string, bool) {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return "", false
+	}
+	from, ok := instruction.(*FromInstruction)
+	if !ok {
+		return "", false
+	}
+	image, ok := stageImages[strings.ToLower(from.Image.Value)]
+	return image, ok
+}
+
+// stageName returns the name of the stage a FROM instruction starts, or its index when it
+// is not named, as docker refers to it.
+func stageName(node *Node, index int) string {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return strconv.Itoa(index)
+	}
+	if from, ok := instruction.(*FromInstruction); ok && !from.Alias.IsZero() {
+		return from.Alias.Value
+	}
+	return strconv.Itoa(index)
 }
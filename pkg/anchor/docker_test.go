@@ -1,10 +1,14 @@
 package anchor
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 func TestParseCommand(t *testing.T) {
@@ -45,7 +49,10 @@ RUN dpkg --add-architecture %s && apt-get update && apt-get update \
 `, architecture, packageMap["curl"], packageMap["wget"])
 
 	node := nodes[0]
-	appendPackageVersions(&node, packageMap, architecture)
+	resolution := &Resolution{Versions: packageMap}
+	if err := appendPackageVersions(io.Discard, &node, resolution, architecture); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
 	nodes[0] = node
 
 	w := &strings.Builder{}
@@ -153,7 +160,10 @@ RUN dpkg --add-architecture %s && apt-get update && apt-get update \
 `, architecture, packageMap["wget"])
 
 	node := nodes[0]
-	appendPackageVersions(&node, packageMap, architecture)
+	resolution := &Resolution{Versions: packageMap}
+	if err := appendPackageVersions(io.Discard, &node, resolution, architecture); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
 	nodes[0] = node
 
 	w := &strings.Builder{}
@@ -172,7 +182,7 @@ FROM golang:1.23-bookworm as builder
 
 	input := strings.NewReader(file)
 	nodes := Parse(input)
-	image, err := processFromCommand(&nodes[0])
+	image, err := processFromCommand(context.Background(), &nodes[0], Config{}, "builder")
 	if err != nil {
 		t.Errorf("Expected no error but got %v", err)
 	}
@@ -180,3 +190,246 @@ FROM golang:1.23-bookworm as builder
 		t.Errorf("Expected golang:1.23-bookworm but got %v", image)
 	}
 }
+
+func TestProcessFromCommandError(t *testing.T) {
+	nodes := Parse(strings.NewReader("ARG BASE\nFROM --platform=linux/amd64\n"))
+	_, err := processFromCommand(context.Background(), &nodes[1], Config{}, "0")
+	if err == nil {
+		t.Fatal("Expected an error for a FROM command without an image")
+	}
+	expected := "failed to parse the FROM command on line 2: FROM command is missing image name"
+	if err.Error() != expected {
+		t.Errorf("Expected %q but got %q", expected, err.Error())
+	}
+}
+
+func TestAppendPackageVersionsIdempotent(t *testing.T) {
+	file := `RUN apt-get update \
+  && apt-get install --no-install-recommends -y curl wget
+`
+	architecture := "amd64"
+	nodes := Parse(strings.NewReader(file))
+	node := nodes[0]
+	if err := appendPackageVersions(
+		io.Discard,
+		&node,
+		&Resolution{Versions: map[string]string{"curl": "7.68.0", "wget": "1.20.3"}},
+		architecture,
+	); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	reanchored := Parse(strings.NewReader(node.Source()))
+	node = reanchored[0]
+	packageNames := parseCommand(node.Command)
+	if !reflect.DeepEqual(packageNames, []string{"curl", "wget"}) {
+		t.Errorf("Expected [curl wget] but got %v", packageNames)
+	}
+	if err := appendPackageVersions(
+		io.Discard,
+		&node,
+		&Resolution{Versions: map[string]string{"curl": "7.88.1", "wget": "1.21.3"}},
+		architecture,
+	); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	expected := `RUN dpkg --add-architecture amd64 && apt-get update && apt-get update \
+  && apt-get install --no-install-recommends -y curl=7.88.1 wget=1.21.3
+`
+	if node.Source() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, node.Source())
+	}
+}
+
+func TestInstallReleases(t *testing.T) {
+	file := `RUN apt-get update \
+  && apt-get install -y -t bookworm-backports golang-go \
+  && apt-get install -y --no-install-recommends curl/bookworm-backports wget \
+  && apt-get -o APT::Default-Release=testing install -y git
+`
+	nodes := Parse(strings.NewReader(file))
+	installs, err := runInstalls(&nodes[0])
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if names := installPackageNames(installs, nil); !reflect.DeepEqual(
+		names, []string{"golang-go", "curl", "wget", "git"},
+	) {
+		t.Errorf("Unexpected packages %v", names)
+	}
+	targetReleases, releases := installReleases(installs, nil)
+	expectedTargets := map[string]string{"golang-go": "bookworm-backports", "git": "testing"}
+	if !reflect.DeepEqual(targetReleases, expectedTargets) {
+		t.Errorf("Expected %v but got %v", expectedTargets, targetReleases)
+	}
+	expectedReleases := map[string]string{"curl": "bookworm-backports"}
+	if !reflect.DeepEqual(releases, expectedReleases) {
+		t.Errorf("Expected %v but got %v", expectedReleases, releases)
+	}
+
+	node := nodes[0]
+	resolution := &Resolution{Versions: map[string]string{"curl": "8.11.1-1~bpo12+1"}}
+	if err := appendPackageVersions(io.Discard, &node, resolution, "amd64"); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if !strings.Contains(node.Source(), " curl=8.11.1-1~bpo12+1 wget") {
+		t.Errorf("Expected the release suffix to be replaced by the version:\n%s", node.Source())
+	}
+}
+
+func TestInstallPackageFiles(t *testing.T) {
+	file := "RUN apt-get install -y ./local.deb /tmp/tool.deb tool.deb curl\n"
+	nodes := Parse(strings.NewReader(file))
+	installs, err := runInstalls(&nodes[0])
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if names := installPackageNames(installs, nil); !reflect.DeepEqual(names, []string{"curl"}) {
+		t.Errorf("Expected only curl to be a package but got %v", names)
+	}
+	resolution := &Resolution{Versions: map[string]string{"curl": "7.88.1"}}
+	if err := appendPackageVersions(io.Discard, &nodes[0], resolution, "amd64"); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := "RUN dpkg --add-architecture amd64 && apt-get update && " +
+		"apt-get install -y ./local.deb /tmp/tool.deb tool.deb curl=7.88.1\n"
+	if nodes[0].Source() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, nodes[0].Source())
+	}
+}
+
+func TestAppendPackageVersionsPrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{
+			name: "package list",
+			file: "RUN apt-get update && apt-get install -y $(cat /tmp/packages.txt)\n",
+			expected: "RUN dpkg --add-architecture arm64 && apt-get update && " +
+				"apt-get update && apt-get install -y $(cat /tmp/packages.txt)\n",
+		},
+		{
+			name:     "unresolved",
+			file:     "RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y wgte\n",
+			expected: "RUN dpkg --add-architecture arm64 && apt-get update && apt-get install -y wgte\n",
+		},
+		{
+			name: "user architecture",
+			file: "RUN dpkg --add-architecture i386 && apt-get update && " +
+				"apt-get install -y wine32:i386\n",
+			expected: "RUN dpkg --add-architecture arm64 && apt-get update && " +
+				"dpkg --add-architecture i386 && apt-get update && apt-get install -y wine32:i386\n",
+		},
+		{
+			name: "user architecture later",
+			file: "RUN apt-get update && dpkg --add-architecture i386 && apt-get update && " +
+				"apt-get install -y wine32:i386\n",
+			expected: "RUN dpkg --add-architecture arm64 && apt-get update && apt-get update && " +
+				"dpkg --add-architecture i386 && apt-get update && apt-get install -y wine32:i386\n",
+		},
+		{
+			name:     "ignored",
+			file:     "# anchor ignore=curl\nRUN apt-get update && apt-get install -y curl\n",
+			expected: "# anchor ignore=curl\nRUN apt-get update && apt-get install -y curl\n",
+		},
+		{
+			name:     "no install",
+			file:     "RUN apt-get update\n",
+			expected: "RUN apt-get update\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := Parse(strings.NewReader(tc.file))
+			node := &nodes[len(nodes)-1]
+			if err := appendPackageVersions(io.Discard, node, &Resolution{}, "arm64"); err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			w := &strings.Builder{}
+			nodes.Write(w)
+			if w.String() != tc.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tc.expected, w.String())
+			}
+		})
+	}
+}
+
+func TestSplitImageDigest(t *testing.T) {
+	cases := []struct {
+		input  string
+		image  string
+		digest string
+		tagged bool
+	}{
+		{"golang:1.23", "golang:1.23", "", true},
+		{"golang:1.23@sha256:abc", "golang:1.23", "sha256:abc", true},
+		{"localhost:5000/golang@sha256:abc", "localhost:5000/golang", "sha256:abc", false},
+		{"localhost:5000/golang:1.23", "localhost:5000/golang:1.23", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.input, func(t *testing.T) {
+			image, digest := splitImageDigest(tc.input)
+			if image != tc.image || digest != tc.digest {
+				t.Errorf("Expected %v %v but got %v %v", tc.image, tc.digest, image, digest)
+			}
+			if hasTag(image) != tc.tagged {
+				t.Errorf("Expected tagged to be %v", tc.tagged)
+			}
+		})
+	}
+}
+
+// strictImageResolver resolves only the images it knows, as a registry would.
+type strictImageResolver map[string]string
+
+func (r strictImageResolver) ResolveImage(_ context.Context, image string) (string, error) {
+	digest, ok := r[image]
+	if !ok {
+		return "", fmt.Errorf("image %s not found", image)
+	}
+	return digest, nil
+}
+
+func TestProcessStageBases(t *testing.T) {
+	file := `ARG BASE=debian:bookworm
+FROM debian:bookworm AS builder
+FROM builder AS test
+RUN apt-get update && apt-get install -y curl
+FROM scratch
+FROM $BASE
+`
+	resolver := &recordingPackageResolver{resolver: &failingResolver{}}
+	nodes := Parse(strings.NewReader(file))
+	_, err := ProcessWithConfig(context.Background(), nodes, Config{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		Resolver: resolver,
+		Images:   strictImageResolver{"debian:bookworm": "sha256:abc"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(resolver.requests) != 1 || resolver.requests[0].Image != "debian:bookworm@sha256:abc" {
+		t.Errorf("Expected curl to be resolved against the builder image, got %+v", resolver.requests)
+	}
+	var sb strings.Builder
+	if err := nodes.Write(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "FROM builder AS test\n") ||
+		!strings.Contains(sb.String(), "FROM scratch\nFROM $BASE\n") {
+		t.Errorf("Expected the stages and build arg to be left as they are, got:\n%s", sb.String())
+	}
+}
+
+func TestProcessArchitecture(t *testing.T) {
+	nodes := Parse(strings.NewReader("FROM scratch\nCOPY app /app\n"))
+	if err := Process(context.Background(), nodes, "arm64"); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+	if err := Process(context.Background(), nodes, "sparc"); err == nil {
+		t.Error("Expected an error for an unsupported architecture")
+	}
+}
@@ -0,0 +1,685 @@
+package anchor
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// minimumAPIVersion is the oldest Docker Engine API version the engine runtime supports.
+var minimumAPIVersion = apiVersion{major: 1, minor: 41}
+
+// apiVersion is a version of the Docker Engine API, e.g. 1.41.
+type apiVersion struct {
+	major int
+	minor int
+}
+
+// parseAPIVersion parses a major.minor Engine API version.
+func parseAPIVersion(version string) (apiVersion, error) {
+	major, minor, ok := strings.Cut(version, ".")
+	if !ok {
+		return apiVersion{}, fmt.Errorf("invalid API version %q", version)
+	}
+	parsed := apiVersion{}
+	var err error
+	if parsed.major, err = strconv.Atoi(major); err != nil {
+		return apiVersion{}, fmt.Errorf("invalid API version %q", version)
+	}
+	if parsed.minor, err = strconv.Atoi(minor); err != nil {
+		return apiVersion{}, fmt.Errorf("invalid API version %q", version)
+	}
+	return parsed, nil
+}
+
+// before returns whether the version is older than another.
+func (v apiVersion) before(other apiVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// DockerEngine is a runtime that talks to the Docker Engine API directly, over a unix socket,
+// TCP with optional TLS, or SSH. The endpoint is resolved the way the docker CLI resolves it:
+// DOCKER_HOST with DOCKER_TLS_VERIFY, DOCKER_TLS and DOCKER_CERT_PATH, then DOCKER_CONTEXT,
+// then the current context of the docker config, then the local socket.
+type DockerEngine struct {
+	// Host overrides the endpoint resolved from the environment, e.g. unix:///var/run/docker.sock,
+	// tcp://localhost:2375 or ssh://user@host
+	Host string
+	// TLS is the TLS configuration used for tcp endpoints, resolved from the environment when
+	// Host is not set
+	TLS *tls.Config
+
+	mu      sync.Mutex
+	client  *http.Client
+	base    string
+	host    string
+	version string
+}
+
+func (*DockerEngine) Name() string {
+	return "docker"
+}
+
+// dockerEndpoint is the daemon a docker context points at.
+type dockerEndpoint struct {
+	Host string
+	TLS  *tls.Config
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".docker"
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// resolveDockerEndpoint returns the endpoint the docker CLI would use. DOCKER_HOST overrides
+// the context, as it does for the docker CLI.
+func resolveDockerEndpoint() (dockerEndpoint, error) {
+	configDir := dockerConfigDir()
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		contextName := os.Getenv("DOCKER_CONTEXT")
+		if contextName == "" {
+			contextName = currentDockerContext(configDir)
+		}
+		if contextName != "" && contextName != "default" {
+			return readDockerContext(configDir, contextName)
+		}
+		return dockerEndpoint{Host: "unix:///var/run/docker.sock"}, nil
+	}
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if !verify && os.Getenv("DOCKER_TLS") == "" {
+		return dockerEndpoint{Host: host}, nil
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = configDir
+	}
+	config, err := dockerTLSConfig(certPath, !verify)
+	if err != nil {
+		return dockerEndpoint{}, err
+	}
+	return dockerEndpoint{Host: host, TLS: config}, nil
+}
+
+func currentDockerContext(configDir string) string {
+	content, err := os.ReadFile(filepath.Join(configDir, "config.json")) // #nosec G304
+	if err != nil {
+		return ""
+	}
+	config := struct {
+		CurrentContext string `json:"currentContext"`
+	}{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// readDockerContext reads the docker endpoint of a context from the context store of the
+// docker CLI, where each context is stored under the SHA-256 digest of its name.
+func readDockerContext(configDir string, contextName string) (dockerEndpoint, error) {
+	digest := sha256.Sum256([]byte(contextName))
+	id := hex.EncodeToString(digest[:])
+	metaPath := filepath.Join(configDir, "contexts", "meta", id, "meta.json")
+	content, err := os.ReadFile(metaPath) // #nosec G304
+	if err != nil {
+		return dockerEndpoint{}, fmt.Errorf(
+			"failed to read docker context %s: %w", contextName, err,
+		)
+	}
+	meta := struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}{}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return dockerEndpoint{}, fmt.Errorf("invalid docker context %s: %w", contextName, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return dockerEndpoint{}, fmt.Errorf(
+			"docker context %s does not have a docker endpoint", contextName,
+		)
+	}
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if _, err := os.Stat(tlsDir); err != nil {
+		if !endpoint.SkipTLSVerify {
+			return dockerEndpoint{Host: endpoint.Host}, nil
+		}
+		return dockerEndpoint{
+			Host: endpoint.Host,
+			TLS:  &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+		}, nil
+	}
+	config, err := dockerTLSConfig(tlsDir, endpoint.SkipTLSVerify)
+	if err != nil {
+		return dockerEndpoint{}, err
+	}
+	return dockerEndpoint{Host: endpoint.Host, TLS: config}, nil
+}
+
+// dockerTLSConfig loads ca.pem, cert.pem and key.pem from a directory, each of which is
+// optional.
+func dockerTLSConfig(dir string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify, // #nosec G402
+	}
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.pem")) // #nosec G304
+	if err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid CA certificate in %s", dir)
+		}
+		config.RootCAs = pool
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the docker client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// connect builds the HTTP client for the endpoint, once.
+func (e *DockerEngine) connect() error {
+	if e.client != nil {
+		return nil
+	}
+	endpoint := dockerEndpoint{Host: e.Host, TLS: e.TLS}
+	if endpoint.Host == "" {
+		var err error
+		endpoint, err = resolveDockerEndpoint()
+		if err != nil {
+			return err
+		}
+	}
+	u, err := url.Parse(endpoint.Host)
+	if err != nil {
+		return fmt.Errorf("invalid docker host %s: %w", endpoint.Host, err)
+	}
+	transport := &http.Transport{}
+	base := "http://docker"
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+	case "tcp", "http", "https":
+		host := u.Host
+		scheme := "http"
+		if endpoint.TLS != nil || u.Scheme == "https" {
+			scheme = "https"
+			transport.TLSClientConfig = endpoint.TLS
+		}
+		if u.Port() == "" {
+			if scheme == "https" {
+				host += ":2376"
+			} else {
+				host += ":2375"
+			}
+		}
+		base = scheme + "://" + host
+	case "ssh":
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialSSH(ctx, u)
+		}
+	default:
+		return fmt.Errorf("unsupported docker host %s", endpoint.Host)
+	}
+	e.client = &http.Client{Transport: transport}
+	e.base = base
+	e.host = endpoint.Host
+	return nil
+}
+
+func (e *DockerEngine) Check(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.version != "" {
+		return nil
+	}
+	if err := e.connect(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.base+"/_ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker is not running, cannot connect to %s: %w", e.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker daemon at %s is not healthy: %s", e.host, resp.Status)
+	}
+	version := resp.Header.Get("Api-Version")
+	if version == "" {
+		return fmt.Errorf("docker daemon at %s did not report its API version", e.host)
+	}
+	parsed, err := parseAPIVersion(version)
+	if err != nil {
+		return fmt.Errorf("docker daemon at %s reported an %w", e.host, err)
+	}
+	if parsed.before(minimumAPIVersion) {
+		return fmt.Errorf(
+			"docker daemon at %s is reachable but its API version %s is too old, "+
+				"%s or later is required",
+			e.host,
+			version,
+			minimumAPIVersion,
+		)
+	}
+	e.version = version
+	return nil
+}
+
+// engineError is an error response of the Engine API.
+type engineError struct {
+	Message string `json:"message"`
+}
+
+// do sends a request to the versioned Engine API and returns the response when it has one of
+// the expected status codes.
+func (e *DockerEngine) do(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	body any,
+	header http.Header,
+	expected ...int,
+) (*http.Response, error) {
+	var reader io.Reader
+	contentType := ""
+	switch body := body.(type) {
+	case nil:
+	case *tarBody:
+		reader = &body.Buffer
+		contentType = "application/x-tar"
+	default:
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(content)
+		contentType = "application/json"
+	}
+	u := e.base + "/v" + e.version + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker request %s %s failed: %w", method, path, err)
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	apiErr := engineError{}
+	if json.Unmarshal(content, &apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(content))
+	}
+	return nil, fmt.Errorf(
+		"docker request %s %s failed: %s: %s", method, path, resp.Status, apiErr.Message,
+	)
+}
+
+func (e *DockerEngine) Run(ctx context.Context, run ContainerRun) ([]byte, error) {
+	if err := e.Check(ctx); err != nil {
+		return nil, err
+	}
+	if err := e.pull(ctx, run.Image); err != nil {
+		return nil, err
+	}
+
+	config := map[string]any{"Image": run.Image, "Cmd": run.Command}
+	if len(run.Entrypoint) > 0 {
+		config["Entrypoint"] = run.Entrypoint
+	}
+	if run.User != "" {
+		config["User"] = run.User
+	}
+	resp, err := e.do(
+		ctx, http.MethodPost, "/containers/create", nil, config, nil, http.StatusCreated,
+	)
+	if err != nil {
+		return nil, err
+	}
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid create container response: %w", err)
+	}
+	defer e.remove(ctx, created.ID)
+
+	container := "/containers/" + url.PathEscape(created.ID)
+	if len(run.Files) > 0 {
+		if err := e.upload(ctx, container, run.Files); err != nil {
+			return nil, err
+		}
+	}
+	resp, err = e.do(ctx, http.MethodPost, container+"/start", nil, nil, nil, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	resp, err = e.do(ctx, http.MethodPost, container+"/wait", nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	waited := struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&waited)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("invalid wait container response: %w", err)
+	}
+	if waited.Error != nil && waited.Error.Message != "" {
+		return nil, fmt.Errorf("failed to wait for the container: %s", waited.Error.Message)
+	}
+
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	resp, err = e.do(ctx, http.MethodGet, container+"/logs", query, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	stdout, stderr, err := demuxLogs(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the container logs: %w", err)
+	}
+	if waited.StatusCode != 0 {
+		return nil, fmt.Errorf(
+			"failed to run docker container: exit status %d\n%s",
+			waited.StatusCode,
+			strings.TrimSpace(string(stderr)),
+		)
+	}
+	return stdout, nil
+}
+
+// tarBody is a request body that is sent as a tar archive rather than JSON.
+type tarBody struct {
+	bytes.Buffer
+}
+
+// upload extracts the files into the filesystem of a created container.
+func (e *DockerEngine) upload(
+	ctx context.Context, container string, files map[string][]byte,
+) error {
+	body := &tarBody{}
+	archive := tar.NewWriter(body)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		err := archive.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(name, "/"),
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := archive.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	resp, err := e.do(
+		ctx, http.MethodPut, container+"/archive", url.Values{"path": {"/"}}, body, nil,
+		http.StatusOK,
+	)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// remove removes the container even when the context has been cancelled.
+func (e *DockerEngine) remove(ctx context.Context, id string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	query := url.Values{"force": {"1"}}
+	resp, err := e.do(
+		ctx, http.MethodDelete, "/containers/"+url.PathEscape(id), query, nil, nil,
+		http.StatusNoContent, http.StatusNotFound,
+	)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// pull pulls the image unless the daemon already has it, with the credentials of the default
+// keychain.
+func (e *DockerEngine) pull(ctx context.Context, image string) error {
+	resp, err := e.do(
+		ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil,
+		http.StatusOK, http.StatusNotFound,
+	)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	header := http.Header{}
+	if auth, err := registryAuth(ctx, image); err == nil && auth != "" {
+		header.Set("X-Registry-Auth", auth)
+	}
+	resp, err = e.do(
+		ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {image}}, nil, header,
+		http.StatusOK,
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// the progress is streamed as JSON messages, a failed pull is reported in the stream
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := struct {
+			Error string `json:"error"`
+		}{}
+		err := decoder.Decode(&message)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pull %s: %w", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("failed to pull %s: %s", image, message.Error)
+		}
+	}
+}
+
+func registryAuth(ctx context.Context, image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	authenticator, err := authn.DefaultKeychain.Resolve(ref.Context())
+	if err != nil || authenticator == authn.Anonymous {
+		return "", err
+	}
+	config, err := authn.Authorization(ctx, authenticator)
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(map[string]string{
+		"username":      config.Username,
+		"password":      config.Password,
+		"identitytoken": config.IdentityToken,
+		"registrytoken": config.RegistryToken,
+		"serveraddress": ref.Context().RegistryStr(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(content), nil
+}
+
+// demuxLogs splits the multiplexed log stream of a container without a TTY, where each frame
+// has an 8 byte header of the stream and the big endian frame size.
+func demuxLogs(r io.Reader) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	reader := bufio.NewReader(r)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return stdout.Bytes(), stderr.Bytes(), nil
+			}
+			return nil, nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		out := io.Discard
+		switch header[0] {
+		case 1:
+			out = &stdout
+		case 2:
+			out = &stderr
+		}
+		if _, err := io.CopyN(out, reader, size); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// dialSSH connects to a remote daemon the way the docker CLI does, by running
+// docker system dial-stdio on the remote host over ssh.
+func dialSSH(ctx context.Context, u *url.URL) (net.Conn, error) {
+	args := []string{}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+	cmd := exec.CommandContext(context.WithoutCancel(ctx), "ssh", args...) // #nosec G204
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s over ssh: %w", u.Host, err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// commandConn is a connection over the stdin and stdout of a command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	_ = c.stdin.Close()
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+	return nil
+}
+
+func (*commandConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: "ssh", Net: "unix"}
+}
+
+func (*commandConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: "ssh", Net: "unix"}
+}
+
+func (*commandConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (*commandConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (*commandConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
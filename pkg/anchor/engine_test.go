@@ -0,0 +1,260 @@
+package anchor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logFrame encodes a frame of a multiplexed container log stream.
+func logFrame(stream byte, content string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(content)))
+	return append(header, content...)
+}
+
+// testEngine serves a fake Engine API on a unix socket and records the requests it receives.
+func testEngine(
+	t *testing.T, version string, exitCode int, logs []byte,
+) (*DockerEngine, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		prefix := "/v" + version
+		switch {
+		case r.URL.Path == "/_ping":
+			w.Header().Set("Api-Version", version)
+			w.Write([]byte("OK"))
+		case r.URL.Path == prefix+"/images/debian:bookworm/json":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image: debian:bookworm"}`))
+		case r.URL.Path == prefix+"/images/create":
+			w.Write([]byte(`{"status":"Pulling"}` + "\n" + `{"status":"Downloaded"}` + "\n"))
+		case r.URL.Path == prefix+"/containers/create":
+			body := struct {
+				Image string
+				Cmd   []string
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Image == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"abc123"}`))
+		case r.URL.Path == prefix+"/containers/abc123/archive" && r.Method == http.MethodPut:
+			header, err := tar.NewReader(r.Body).Next()
+			if err != nil || r.URL.Query().Get("path") != "/" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			requests = append(requests, "extract "+header.Name)
+			mu.Unlock()
+		case r.URL.Path == prefix+"/containers/abc123/start":
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == prefix+"/containers/abc123/wait":
+			json.NewEncoder(w).Encode(map[string]int{"StatusCode": exitCode})
+		case r.URL.Path == prefix+"/containers/abc123/logs":
+			w.Write(logs)
+		case r.URL.Path == prefix+"/containers/abc123" && r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return &DockerEngine{Host: "unix://" + socket}, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, requests...)
+	}
+}
+
+func TestDockerEngineRun(t *testing.T) {
+	logs := append(logFrame(1, "Package: curl\n"), logFrame(2, "W: warning\n")...)
+	logs = append(logs, logFrame(1, "Version: 7.88.1\n")...)
+	engine, requests := testEngine(t, "1.45", 0, logs)
+
+	output, err := engine.Run(context.Background(), ContainerRun{
+		Image:   "debian:bookworm",
+		Command: []string{"bash", "-c", "apt-cache show curl"},
+		Files:   map[string][]byte{"/anchor/etc/apt/sources.list": []byte("deb http://x y z\n")},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if string(output) != "Package: curl\nVersion: 7.88.1\n" {
+		t.Errorf("Unexpected output %q", output)
+	}
+	expected := []string{
+		"GET /_ping",
+		"GET /v1.45/images/debian:bookworm/json",
+		"POST /v1.45/images/create",
+		"POST /v1.45/containers/create",
+		"PUT /v1.45/containers/abc123/archive",
+		"extract anchor/etc/apt/sources.list",
+		"POST /v1.45/containers/abc123/start",
+		"POST /v1.45/containers/abc123/wait",
+		"GET /v1.45/containers/abc123/logs",
+		"DELETE /v1.45/containers/abc123",
+	}
+	if !reflect.DeepEqual(requests(), expected) {
+		t.Errorf("Expected requests %v but got %v", expected, requests())
+	}
+}
+
+func TestDockerEngineRunFailure(t *testing.T) {
+	engine, requests := testEngine(t, "1.45", 100, logFrame(2, "E: Unable to locate package\n"))
+	_, err := engine.Run(context.Background(), ContainerRun{
+		Image:   "debian:bookworm",
+		Command: []string{"true"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "E: Unable to locate package") {
+		t.Errorf("Expected the container stderr in the error but got %v", err)
+	}
+	actual := requests()
+	if actual[len(actual)-1] != "DELETE /v1.45/containers/abc123" {
+		t.Errorf("Expected the container to be removed but got %v", actual)
+	}
+}
+
+func TestDockerEngineAPIVersionTooOld(t *testing.T) {
+	engine, _ := testEngine(t, "1.40", 0, nil)
+	err := engine.Check(context.Background())
+	expected := "is reachable but its API version 1.40 is too old"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected API version error but got %v", err)
+	}
+}
+
+func TestParseAPIVersion(t *testing.T) {
+	testCases := []struct {
+		version string
+		before  bool
+	}{
+		{version: "1.40", before: true},
+		{version: "1.41", before: false},
+		{version: "1.9", before: true},
+		{version: "1.100", before: false},
+		{version: "2.0", before: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.version, func(t *testing.T) {
+			version, err := parseAPIVersion(tc.version)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if actual := version.before(minimumAPIVersion); actual != tc.before {
+				t.Errorf("Expected %s before %s to be %v", tc.version, minimumAPIVersion, tc.before)
+			}
+		})
+	}
+	for _, version := range []string{"", "1", "1.x", "v1.41"} {
+		if _, err := parseAPIVersion(version); err == nil {
+			t.Errorf("Expected an error for %q", version)
+		}
+	}
+}
+
+func TestDockerEngineNotRunning(t *testing.T) {
+	engine := &DockerEngine{Host: "unix://" + filepath.Join(t.TempDir(), "missing.sock")}
+	err := engine.Check(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "docker is not running") {
+		t.Errorf("Expected docker is not running but got %v", err)
+	}
+}
+
+func TestResolveDockerEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_TLS", "")
+	write := func(name string, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest := sha256.Sum256([]byte("remote"))
+	write(
+		filepath.Join(dir, "contexts", "meta", hex.EncodeToString(digest[:]), "meta.json"),
+		`{"Name":"remote","Endpoints":{"docker":{"Host":"ssh://builder@build.example.com"}}}`,
+	)
+
+	assertHost := func(expected string) {
+		t.Helper()
+		endpoint, err := resolveDockerEndpoint()
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+		if endpoint.Host != expected {
+			t.Errorf("Expected %v but got %v", expected, endpoint.Host)
+		}
+	}
+	assertHost("unix:///var/run/docker.sock")
+
+	write(filepath.Join(dir, "config.json"), `{"currentContext":"remote"}`)
+	assertHost("ssh://builder@build.example.com")
+
+	t.Setenv("DOCKER_HOST", "tcp://localhost:2375")
+	assertHost("tcp://localhost:2375")
+
+	// DOCKER_HOST overrides the context, as it does for the docker CLI
+	t.Setenv("DOCKER_CONTEXT", "remote")
+	assertHost("tcp://localhost:2375")
+
+	t.Setenv("DOCKER_HOST", "")
+	assertHost("ssh://builder@build.example.com")
+
+	t.Setenv("DOCKER_CONTEXT", "missing")
+	if _, err := resolveDockerEndpoint(); err == nil {
+		t.Errorf("Expected an error for a missing context")
+	}
+}
+
+func TestDemuxLogs(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(logFrame(1, "out"))
+	stream.Write(logFrame(2, "err"))
+	stream.Write(logFrame(1, "put"))
+	stdout, stderr, err := demuxLogs(&stream)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if string(stdout) != "output" || string(stderr) != "err" {
+		t.Errorf("Unexpected stdout %q and stderr %q", stdout, stderr)
+	}
+}
@@ -0,0 +1,338 @@
+package anchor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The actions anchoring takes for a dependency.
+const (
+	ActionPinned = "pinned"
+	// ActionIgnored is a dependency ignored with an anchor ignore comment
+	ActionIgnored = "ignored"
+	// ActionAlreadyPinned is a dependency pinned in the template that anchor keeps as it is
+	ActionAlreadyPinned = "already pinned"
+	// ActionUnsupported is a dependency anchor does not know how to pin
+	ActionUnsupported = "unsupported"
+	// ActionVariable is a dependency set with a variable, which anchor leaves as it is
+	ActionVariable = "variable"
+	// ActionFailed is a dependency anchor could not resolve
+	ActionFailed = "failed"
+)
+
+// Plan is what anchoring a template to a platform does, stage by stage.
+type Plan struct {
+	Platform string      `json:"platform"`
+	Stages   []StagePlan `json:"stages"`
+}
+
+// StagePlan is what anchoring does to a stage.
+type StagePlan struct {
+	// Name is the name of the stage, or its index when it is not named
+	Name string `json:"name"`
+	// Image is the base image of the stage in the template, and Anchored the image it is
+	// built from once anchored
+	Image    string `json:"image"`
+	Anchored string `json:"anchored"`
+	// BaseStage is the earlier stage the stage builds on, if any
+	BaseStage    string              `json:"baseStage,omitempty"`
+	Dependencies []PlannedDependency `json:"dependencies"`
+}
+
+// PlannedDependency is an image or package of a stage, with what anchoring does to it and
+// why.
+type PlannedDependency struct {
+	// Kind is image or package, or for dependencies anchor does not pin the lint rule they
+	// break, e.g. remote-script
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Line is the line of the template the dependency is on
+	Line   int    `json:"line"`
+	Action string `json:"action"`
+	// Version is the digest or version the dependency is pinned to
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// explainedRules are the lint rules reported as dependencies of a stage, with the action
+// anchoring takes for them.
+var explainedRules = map[string]string{
+	"unresolved-variable":         ActionVariable,
+	"unsupported-package-manager": ActionUnsupported,
+	"remote-script":               ActionUnsupported,
+	"remote-add":                  ActionUnsupported,
+	"unpinned-copy-from":          ActionUnsupported,
+	"unparsed-run":                ActionUnsupported,
+}
+
+// Explain resolves the images and packages of a template like ProcessWithConfig does and
+// reports what anchoring does to each of them, and why. The nodes are not changed and no
+// files are written.
+func Explain(ctx context.Context, nodes []Node, config Config) (*Plan, error) {
+	images := &recordingImageResolver{resolver: config.imageResolver(), digests: map[string]string{}}
+	packages := &recordingPackageResolver{resolver: config.packageResolver()}
+	config.Images = images
+	config.Resolver = packages
+	anchored := cloneNodes(nodes)
+	_, err := ProcessWithConfig(ctx, anchored, config)
+	var resolutionError *ResolutionError
+	if err != nil && !errors.As(err, &resolutionError) {
+		return nil, err
+	}
+	resolutions := map[string]*Resolution{}
+	for i, request := range packages.requests {
+		resolutions[request.Stage] = mergeResolutions(
+			resolutions[request.Stage], packages.resolutions[i],
+		)
+	}
+
+	e := &explainer{
+		plan:    &Plan{Platform: config.Platform.String(), Stages: []StagePlan{}},
+		linter:  &linter{findings: []Finding{}},
+		args:    globalArgs(nodes),
+		digests: images.digests,
+	}
+	stages := []string{"scratch"}
+	copies := []*stageCopy{}
+	for i := range nodes {
+		node := &nodes[i]
+		ignored, all := nodeIgnores(node)
+		if node.CommandType == CommandFrom {
+			e.explainFrom(node, &anchored[i], ignored, all, stages)
+			copies = []*stageCopy{}
+			if from, ok := nodeInstruction(node).(*FromInstruction); ok && !from.Alias.IsZero() {
+				stages = append(stages, strings.ToLower(from.Alias.Value))
+			}
+			continue
+		}
+		if len(e.plan.Stages) == 0 {
+			continue
+		}
+		if stageCopy := parseStageCopy(node); stageCopy != nil {
+			copies = append(copies, stageCopy)
+		}
+		instruction, err := node.Instruction()
+		if err != nil {
+			continue
+		}
+		if !all {
+			e.explainFindings(node, instruction, ignored, stages)
+		}
+		if node.CommandType == CommandRun {
+			stage := e.plan.Stages[len(e.plan.Stages)-1].Name
+			err := e.explainRun(node, ignored, all, config.ContextDir, copies, resolutions[stage])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e.plan, nil
+}
+
+type explainer struct {
+	plan   *Plan
+	linter *linter
+	args   map[string]Word
+	// digests are the digests resolved for each image
+	digests map[string]string
+}
+
+// add adds a dependency to the current stage.
+func (e *explainer) add(dependency PlannedDependency) {
+	stage := &e.plan.Stages[len(e.plan.Stages)-1]
+	stage.Dependencies = append(stage.Dependencies, dependency)
+}
+
+// nodeInstruction returns the instruction of a node, nil when it cannot be parsed.
+func nodeInstruction(node *Node) Instruction {
+	instruction, _ := node.Instruction()
+	return instruction
+}
+
+func (e *explainer) explainFrom(
+	node *Node, anchored *Node, ignored []string, all bool, stages []string,
+) {
+	stage := StagePlan{
+		Name:         stageName(node, len(e.plan.Stages)),
+		Dependencies: []PlannedDependency{},
+	}
+	e.plan.Stages = append(e.plan.Stages, stage)
+	dependency := PlannedDependency{Kind: "image", Line: instructionLine(*node)}
+	from, ok := nodeInstruction(node).(*FromInstruction)
+	if !ok {
+		dependency.Action = ActionUnsupported
+		dependency.Reason = "the FROM instruction could not be parsed"
+		e.add(dependency)
+		return
+	}
+	current := &e.plan.Stages[len(e.plan.Stages)-1]
+	current.Image = from.Image.Value
+	current.Anchored = from.Image.Value
+	if anchoredFrom, ok := nodeInstruction(anchored).(*FromInstruction); ok {
+		current.Anchored = anchoredFrom.Image.Value
+	}
+
+	image, pinned := splitImageDigest(from.Image.Value)
+	dependency.Name = image
+	switch {
+	case slices.Contains(stages, strings.ToLower(image)):
+		current.BaseStage = image
+		return
+	case all || slices.Contains(ignored, image) || slices.Contains(ignored, from.Image.Value):
+		dependency.Name = from.Image.Value
+		dependency.Action = ActionIgnored
+		dependency.Reason = "ignored with an anchor ignore comment"
+	case strings.Contains(image, "$"):
+		dependency.Action = ActionVariable
+		dependency.Reason = "set with a build arg, anchor leaves it as it is"
+		defined := true
+		expanded := os.Expand(image, func(key string) string {
+			value, ok := e.args[key]
+			defined = defined && ok
+			return value.Literal()
+		})
+		if defined {
+			dependency.Reason += fmt.Sprintf(", it defaults to %s", expanded)
+		}
+	case !hasTag(image) && pinned != "":
+		dependency.Action = ActionAlreadyPinned
+		dependency.Version = pinned
+		dependency.Reason = "only referenced by digest, there is no tag to refresh it from"
+	case e.digests[image] == "":
+		dependency.Action = ActionFailed
+		dependency.Reason = "no digest was found for it"
+	default:
+		dependency.Action = ActionPinned
+		dependency.Version = e.digests[image]
+		dependency.Reason = "the current digest of the tag"
+		if pinned != "" && pinned != dependency.Version {
+			dependency.Reason += ", it was " + pinned
+		}
+	}
+	e.add(dependency)
+}
+
+// explainFindings adds the dependencies of a node that anchor does not pin, as reported by
+// lint.
+func (e *explainer) explainFindings(
+	node *Node, instruction Instruction, ignored []string, stages []string,
+) {
+	start := len(e.linter.findings)
+	e.linter.lint(node, instruction, ignored, stages)
+	for _, finding := range e.linter.findings[start:] {
+		action, ok := explainedRules[finding.Rule]
+		if !ok {
+			continue
+		}
+		e.add(PlannedDependency{
+			Kind:   finding.Rule,
+			Line:   finding.Line,
+			Action: action,
+			Reason: finding.Message,
+		})
+	}
+}
+
+func (e *explainer) explainRun(
+	node *Node,
+	ignored []string,
+	all bool,
+	contextDir string,
+	copies []*stageCopy,
+	resolution *Resolution,
+) error {
+	installs, err := runInstalls(node)
+	if err != nil {
+		return nil
+	}
+	explain := func(pkg string, line int, ignoredBy bool, source string, previous string) {
+		dependency := PlannedDependency{Kind: "package", Name: pkg, Line: line}
+		if all || ignoredBy {
+			dependency.Action = ActionIgnored
+			dependency.Reason = "ignored with an anchor ignore comment"
+		} else {
+			dependency = packageDependency(dependency, resolution)
+		}
+		if dependency.Action == ActionPinned && previous != "" && previous != dependency.Version {
+			dependency.Reason += ", it was " + previous
+		}
+		if source != "" {
+			dependency.Reason = fmt.Sprintf("listed in %s, %s", source, dependency.Reason)
+		}
+		e.add(dependency)
+	}
+	for _, install := range installs {
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if !ok {
+				continue
+			}
+			pkg := packageName(value)
+			line, _ := node.Position(word.Span.Start)
+			explain(pkg, line, slices.Contains(ignored, pkg), "", packageVersion(value))
+		}
+	}
+	// ProcessWithConfig already warned about the lists it skips
+	lists, err := readPackageLists(io.Discard, installs, contextDir, copies)
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		versions := list.versions()
+		for _, pkg := range list.Packages {
+			ignoredBy := list.IgnoreAll || slices.Contains(list.Ignored, pkg) ||
+				slices.Contains(ignored, pkg)
+			explain(pkg, instructionLine(*node), ignoredBy, list.Source, versions[pkg])
+		}
+	}
+	return nil
+}
+
+// packageDependency fills in the action of a package from its resolution.
+func packageDependency(dependency PlannedDependency, resolution *Resolution) PlannedDependency {
+	if resolution == nil {
+		resolution = &Resolution{}
+	}
+	if name, version, ok := resolution.pin(dependency.Name); ok {
+		dependency.Name = name
+		dependency.Action = ActionPinned
+		dependency.Version = version
+		dependency.Reason = resolution.Reasons[name]
+		if dependency.Reason == "" {
+			dependency.Reason = "the version apt would install"
+		}
+		return dependency
+	}
+	dependency.Action = ActionFailed
+	dependency.Reason = "it was not resolved"
+	if i := slices.IndexFunc(resolution.Failures, func(failure PackageFailure) bool {
+		return failure.Package == dependency.Name
+	}); i >= 0 {
+		failure := resolution.Failures[i]
+		dependency.Reason = failure.Reason + ". " + failure.Suggestion
+	}
+	return dependency
+}
+
+// mergeResolutions merges the resolutions of the RUN commands of a stage.
+func mergeResolutions(merged *Resolution, resolution *Resolution) *Resolution {
+	if merged == nil {
+		merged = &Resolution{
+			Versions:  map[string]string{},
+			Providers: map[string]string{},
+			Reasons:   map[string]string{},
+			Failures:  []PackageFailure{},
+		}
+	}
+	maps.Copy(merged.Versions, resolution.Versions)
+	maps.Copy(merged.Providers, resolution.Providers)
+	maps.Copy(merged.Reasons, resolution.Reasons)
+	merged.Failures = append(merged.Failures, resolution.Failures...)
+	return merged
+}
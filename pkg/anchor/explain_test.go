@@ -0,0 +1,148 @@
+package anchor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "packages.txt"), []byte("git=1:2.39.2\nlibc6\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := `ARG BASE=debian:bookworm
+FROM debian:bookworm@sha256:old AS builder
+COPY packages.txt /tmp/packages.txt
+# anchor ignore=wget
+RUN apt-get update && apt-get install -y curl=7.88.1 wget culr $(cat /tmp/packages.txt)
+RUN pip install flask && apt-get install -y $EXTRA
+FROM builder AS test
+FROM $BASE
+FROM debian@sha256:digest
+`
+	nodes := Parse(strings.NewReader(file))
+	plan, err := Explain(context.Background(), nodes, Config{
+		Platform:   v1.Platform{OS: "linux", Architecture: "amd64"},
+		ContextDir: dir,
+		Resolver:   &failingResolver{failures: map[string]string{"culr": "package is not available for amd64"}},
+		Images:     &Pins{Images: map[string]string{"debian:bookworm": "sha256:new"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := &Plan{
+		Platform: "linux/amd64",
+		Stages: []StagePlan{
+			{
+				Name:     "builder",
+				Image:    "debian:bookworm@sha256:old",
+				Anchored: "debian:bookworm@sha256:new",
+				Dependencies: []PlannedDependency{
+					{
+						Kind:    "image",
+						Name:    "debian:bookworm",
+						Line:    2,
+						Action:  ActionPinned,
+						Version: "sha256:new",
+						Reason:  "the current digest of the tag, it was sha256:old",
+					},
+					{
+						Kind:    "package",
+						Name:    "curl",
+						Line:    5,
+						Action:  ActionPinned,
+						Version: "1.0",
+						Reason:  "the version apt would install, it was 7.88.1",
+					},
+					{
+						Kind:   "package",
+						Name:   "wget",
+						Line:   5,
+						Action: ActionIgnored,
+						Reason: "ignored with an anchor ignore comment",
+					},
+					{
+						Kind:   "package",
+						Name:   "culr",
+						Line:   5,
+						Action: ActionFailed,
+						Reason: "package is not available for amd64. Check the package name.",
+					},
+					{
+						Kind:    "package",
+						Name:    "git",
+						Line:    5,
+						Action:  ActionPinned,
+						Version: "1.0",
+						Reason:  "listed in packages.txt, the version apt would install, it was 1:2.39.2",
+					},
+					{
+						Kind:    "package",
+						Name:    "libc6",
+						Line:    5,
+						Action:  ActionPinned,
+						Version: "1.0",
+						Reason:  "listed in packages.txt, the version apt would install",
+					},
+					{
+						Kind:   "unresolved-variable",
+						Line:   6,
+						Action: ActionVariable,
+						Reason: "package $EXTRA is set with a variable, anchor cannot pin it",
+					},
+					{
+						Kind:   "unsupported-package-manager",
+						Line:   6,
+						Action: ActionUnsupported,
+						Reason: "pip package flask is not pinned to a version, anchor does not pin pip packages",
+					},
+				},
+			},
+			{
+				Name:         "test",
+				Image:        "builder",
+				Anchored:     "builder",
+				BaseStage:    "builder",
+				Dependencies: []PlannedDependency{},
+			},
+			{
+				Name:     "2",
+				Image:    "$BASE",
+				Anchored: "$BASE",
+				Dependencies: []PlannedDependency{{
+					Kind:   "image",
+					Name:   "$BASE",
+					Line:   8,
+					Action: ActionVariable,
+					Reason: "set with a build arg, anchor leaves it as it is, it defaults to debian:bookworm",
+				}},
+			},
+			{
+				Name:     "3",
+				Image:    "debian@sha256:digest",
+				Anchored: "debian@sha256:digest",
+				Dependencies: []PlannedDependency{{
+					Kind:    "image",
+					Name:    "debian",
+					Line:    9,
+					Action:  ActionAlreadyPinned,
+					Version: "sha256:digest",
+					Reason:  "only referenced by digest, there is no tag to refresh it from",
+				}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, plan)
+	}
+	if nodes[1].Source() != "FROM debian:bookworm@sha256:old AS builder\n" {
+		t.Errorf("Expected the nodes to be unchanged but got %v", nodes[1].Source())
+	}
+}
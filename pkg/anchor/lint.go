@@ -0,0 +1,453 @@
+package anchor
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// LintRule is a pattern anchor lint reports, because it leaves a dependency floating or
+// anchor cannot pin it.
+type LintRule struct {
+	ID string
+	// Level is how severe the findings of the rule are: error, warning or note, as in SARIF
+	Level       string
+	Description string
+}
+
+// LintRules are the rules of anchor lint.
+var LintRules = []LintRule{
+	{
+		ID:          "latest-tag",
+		Level:       "warning",
+		Description: "The base image uses the latest tag, which moves to new releases",
+	},
+	{
+		ID:          "untagged-image",
+		Level:       "warning",
+		Description: "The base image has no tag, so it is the latest tag",
+	},
+	{
+		ID:          "unresolved-variable",
+		Level:       "warning",
+		Description: "An image or package is set with a variable, which anchor cannot pin",
+	},
+	{
+		ID:          "unsupported-from",
+		Level:       "error",
+		Description: "The FROM instruction is not in a form anchor can anchor",
+	},
+	{
+		ID:          "unsupported-package-manager",
+		Level:       "warning",
+		Description: "A package is installed without a version by a package manager anchor does not pin",
+	},
+	{
+		ID:          "remote-script",
+		Level:       "error",
+		Description: "A script is downloaded and run by a shell, so what runs is not pinned",
+	},
+	{
+		ID:          "remote-add",
+		Level:       "warning",
+		Description: "A file is added from a URL without a checksum",
+	},
+	{
+		ID:          "unpinned-copy-from",
+		Level:       "warning",
+		Description: "Files are copied from an image that is not pinned to a digest",
+	},
+	{
+		ID:          "unparsed-run",
+		Level:       "warning",
+		Description: "The RUN command could not be parsed, so its packages are not anchored",
+	},
+}
+
+// Finding is a rule violation reported by Lint.
+type Finding struct {
+	Rule    string `json:"rule"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	File    string `json:"file"`
+	// Line and Column are the 1-based position of the finding in the file
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s [%s]", f.File, f.Line, f.Column, f.Level, f.Message, f.Rule)
+}
+
+// packageManager is a package manager anchor does not resolve packages for.
+type packageManager struct {
+	// subcommands are the subcommands that install packages
+	subcommands []string
+	// valueOptions are the options which take a separate value
+	valueOptions []string
+	// versionOptions are options that pin every package of the command, e.g. gem -v
+	versionOptions []string
+	// pinned reports whether a package argument includes its version
+	pinned func(arg string) bool
+}
+
+// rangeVersion matches versions that select a range rather than a single version.
+var rangeVersion = regexp.MustCompile(`^([~^<>=*]|x$|latest$|next$)`)
+
+// atVersion reports whether a package is pinned with name@version, as npm, go and cargo do.
+func atVersion(arg string) bool {
+	i := strings.LastIndex(arg, "@")
+	return i > 0 && !rangeVersion.MatchString(arg[i+1:])
+}
+
+var packageManagers = map[string]packageManager{
+	"pip": {
+		subcommands: []string{"install"},
+		valueOptions: []string{
+			"-r", "-c", "-e", "-i", "-t", "--requirement", "--constraint", "--editable",
+			"--index-url", "--extra-index-url", "--target", "--prefix", "--root",
+		},
+		pinned: func(arg string) bool { return strings.Contains(arg, "==") },
+	},
+	"npm": {
+		subcommands:  []string{"install", "i", "add"},
+		valueOptions: []string{"--prefix", "--registry"},
+		pinned:       atVersion,
+	},
+	"yarn": {
+		subcommands:  []string{"add"},
+		valueOptions: []string{"--registry"},
+		pinned:       atVersion,
+	},
+	"pnpm": {
+		subcommands:  []string{"add"},
+		valueOptions: []string{"--registry"},
+		pinned:       atVersion,
+	},
+	"gem": {
+		subcommands:    []string{"install"},
+		valueOptions:   []string{"-i", "-n", "-s", "--install-dir", "--bindir", "--source"},
+		versionOptions: []string{"-v", "--version"},
+		pinned:         func(arg string) bool { return strings.Contains(arg, ":") },
+	},
+	"go": {
+		subcommands: []string{"install"},
+		pinned:      atVersion,
+	},
+	"cargo": {
+		subcommands: []string{"install"},
+		valueOptions: []string{
+			"--git", "--branch", "--tag", "--rev", "--path", "--root", "--features", "-F",
+			"--jobs", "-j", "--target",
+		},
+		versionOptions: []string{"--version", "--vers"},
+		pinned:         atVersion,
+	},
+	"apk": {
+		subcommands:  []string{"add"},
+		valueOptions: []string{"-X", "-t", "--repository", "--root", "--virtual"},
+		pinned:       func(arg string) bool { return strings.ContainsAny(arg, "=~<>") },
+	},
+	"dnf": {
+		subcommands:  []string{"install"},
+		valueOptions: []string{"--repo", "--enablerepo", "--disablerepo", "--releasever"},
+		pinned:       rpmVersion.MatchString,
+	},
+	"zypper": {
+		subcommands:  []string{"install", "in"},
+		valueOptions: []string{"-r", "-t", "--repo", "--type"},
+		pinned:       func(arg string) bool { return strings.ContainsAny(arg, "=<>") },
+	},
+}
+
+// rpmVersion matches an rpm package with its version, e.g. nginx-1.24.0.
+var rpmVersion = regexp.MustCompile(`-\d`)
+
+// packageManagerAliases are commands that are run like another package manager.
+var packageManagerAliases = map[string]string{
+	"pip3":     "pip",
+	"yum":      "dnf",
+	"microdnf": "dnf",
+}
+
+// remoteFetchers are commands that download a file, remoteShells are the commands that run
+// one when it is piped into them.
+var (
+	remoteFetchers = []string{"curl", "wget"}
+	remoteShells   = []string{"sh", "bash", "dash", "zsh", "ash", "python", "python3", "perl"}
+)
+
+// Lint reports the dependencies of a template that anchoring leaves floating, and the
+// patterns anchor cannot pin. Nodes and names ignored with an anchor ignore comment are not
+// reported. The file is the name findings are reported for.
+func Lint(nodes []Node, file string) []Finding {
+	l := &linter{file: file, findings: []Finding{}}
+	stages := []string{"scratch"}
+	for i := range nodes {
+		node := &nodes[i]
+		ignored, all := nodeIgnores(node)
+		instruction, err := node.Instruction()
+		switch {
+		case all:
+		case err != nil && node.CommandType == CommandFrom:
+			l.report(node, -1, "unsupported-from", "FROM instruction cannot be anchored: %v", err)
+		case err == nil:
+			l.lint(node, instruction, ignored, stages)
+		}
+		if from, ok := instruction.(*FromInstruction); ok && !from.Alias.IsZero() {
+			stages = append(stages, strings.ToLower(from.Alias.Value))
+		}
+	}
+	return l.findings
+}
+
+type linter struct {
+	file     string
+	findings []Finding
+}
+
+func (l *linter) lint(node *Node, instruction Instruction, ignored []string, stages []string) {
+	switch instruction := instruction.(type) {
+	case *FromInstruction:
+		l.lintFrom(node, instruction, ignored, stages)
+	case *RunInstruction:
+		l.lintRun(node, instruction, ignored)
+	case *AddInstruction:
+		l.lintAdd(node, instruction)
+		l.lintCopyFrom(node, instruction.CopyInstruction, ignored, stages)
+	case *CopyInstruction:
+		l.lintCopyFrom(node, *instruction, ignored, stages)
+	}
+}
+
+// report adds a finding at an offset into the node source, or at the instruction when the
+// offset is negative.
+func (l *linter) report(node *Node, offset int, rule string, format string, args ...any) {
+	line, column := instructionLine(*node), 1
+	if offset >= 0 {
+		line, column = node.Position(offset)
+	}
+	level := ""
+	if i := slices.IndexFunc(LintRules, func(r LintRule) bool { return r.ID == rule }); i >= 0 {
+		level = LintRules[i].Level
+	}
+	l.findings = append(l.findings, Finding{
+		Rule:    rule,
+		Level:   level,
+		Message: fmt.Sprintf(format, args...),
+		File:    l.file,
+		Line:    line,
+		Column:  column,
+	})
+}
+
+func (l *linter) lintFrom(node *Node, from *FromInstruction, ignored []string, stages []string) {
+	image, digest := splitImageDigest(from.Image.Value)
+	offset := from.Image.Span.Start
+	switch {
+	case slices.Contains(ignored, image) || slices.Contains(ignored, from.Image.Value):
+	case strings.Contains(from.Image.Value, "$"):
+		l.report(node, offset, "unresolved-variable",
+			"image %s is set with a variable, anchor cannot pin it", from.Image.Value)
+	case slices.Contains(stages, strings.ToLower(image)):
+	case !validReference(image):
+		l.report(node, offset, "unsupported-from",
+			"%s is not an image reference anchor can anchor", from.Image.Value)
+	case digest != "":
+	case !hasTag(image):
+		l.report(node, offset, "untagged-image",
+			"%s has no tag, it is built from whatever latest points to", image)
+	case strings.HasSuffix(image, ":latest"):
+		l.report(node, offset, "latest-tag",
+			"%s uses the latest tag, use a versioned tag so refreshing the digest stays on it", image)
+	}
+}
+
+// validReference reports whether an image is a reference anchor can resolve.
+func validReference(image string) bool {
+	_, err := name.ParseReference(image)
+	return err == nil
+}
+
+func (l *linter) lintRun(node *Node, run *RunInstruction, ignored []string) {
+	installs, err := runInstalls(node)
+	if err != nil {
+		l.report(node, -1, "unparsed-run",
+			"RUN command could not be parsed, so its packages are not anchored: %v", err)
+		return
+	}
+	source := node.Source()
+	for _, install := range installs {
+		for _, word := range install.Packages {
+			if _, ok := word.literal(); ok || isListSubstitution(word) {
+				continue
+			}
+			l.report(node, word.Span.Start, "unresolved-variable",
+				"package %s is set with a variable, anchor cannot pin it",
+				source[word.Span.Start:word.Span.End])
+		}
+	}
+
+	script := &shellList{Items: []*shellAndOr{{Pipelines: []*shellPipeline{{
+		Commands: []*shellCommand{{Simple: &shellSimpleCommand{Args: execWords(run.Args)}}},
+	}}}}}
+	if !run.Exec {
+		// the script parsed for the installs above, so it parses here too
+		script, _ = parseShell(run.Script)
+	}
+	script.walk(func(command *shellSimpleCommand, input *shellSimpleCommand) {
+		args, _, _ := unwrapCommand(command.Args)
+		if len(args) == 0 {
+			return
+		}
+		name, ok := args[0].literal()
+		if !ok {
+			return
+		}
+		name = path.Base(name)
+		if fetcher := commandName(input); slices.Contains(remoteFetchers, fetcher) &&
+			slices.Contains(remoteShells, name) {
+			l.report(node, input.Args[0].Span.Start, "remote-script",
+				"the output of %s is run by %s, download a pinned release and verify its checksum instead",
+				fetcher, name)
+		}
+		l.lintPackages(node, source, name, args[1:], ignored)
+	})
+}
+
+// commandName returns the name of the command a simple command runs, without the wrappers
+// around it.
+func commandName(command *shellSimpleCommand) string {
+	if command == nil {
+		return ""
+	}
+	args, _, _ := unwrapCommand(command.Args)
+	if len(args) == 0 {
+		return ""
+	}
+	name, ok := args[0].literal()
+	if !ok {
+		return ""
+	}
+	return path.Base(name)
+}
+
+// isListSubstitution reports whether a package argument reads the packages from a list, as
+// in $(cat /tmp/packages.txt), which anchor pins when it is copied from the build context.
+func isListSubstitution(word shellWord) bool {
+	return slices.ContainsFunc(word.Parts, func(part shellPart) bool {
+		return part.Kind == partCommandSubstitution && len(catFiles(part.Script.single())) > 0
+	})
+}
+
+// lintPackages reports the packages installed without a version by a package manager anchor
+// does not support.
+func (l *linter) lintPackages(
+	node *Node, source string, command string, args []shellWord, ignored []string,
+) {
+	if command == "python" || command == "python3" {
+		// python -m pip install
+		if len(args) < 2 || literalOf(args[0]) != "-m" || literalOf(args[1]) != "pip" {
+			return
+		}
+		command, args = "pip", args[2:]
+	}
+	if alias, ok := packageManagerAliases[command]; ok {
+		command = alias
+	}
+	manager, ok := packageManagers[command]
+	if !ok {
+		return
+	}
+	subcommand := ""
+	packages := []shellWord{}
+	for i := 0; i < len(args); i++ {
+		arg, ok := args[i].literal()
+		if ok && strings.HasPrefix(arg, "-") {
+			option, _, _ := strings.Cut(arg, "=")
+			if slices.Contains(manager.versionOptions, option) {
+				// the version applies to every package of the command
+				return
+			}
+			if slices.Contains(manager.valueOptions, arg) {
+				i++
+			}
+			continue
+		}
+		switch {
+		case subcommand == "" && arg == "global":
+			// yarn global add
+		case subcommand == "":
+			subcommand = arg
+		default:
+			packages = append(packages, args[i])
+		}
+	}
+	if !slices.Contains(manager.subcommands, subcommand) {
+		return
+	}
+	for _, word := range packages {
+		arg, ok := word.literal()
+		if ok && (manager.pinned(arg) || isLocalPath(arg) ||
+			slices.Contains(ignored, arg) || slices.Contains(ignored, lintPackageName(arg))) {
+			continue
+		}
+		l.report(node, word.Span.Start, "unsupported-package-manager",
+			"%s package %s is not pinned to a version, anchor does not pin %s packages",
+			command, source[word.Span.Start:word.Span.End], command)
+	}
+}
+
+func literalOf(word shellWord) string {
+	value, _ := word.literal()
+	return value
+}
+
+// isLocalPath reports whether a package argument is a path in the image, e.g. pip install .
+func isLocalPath(arg string) bool {
+	return strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/")
+}
+
+// lintPackageName returns the name of a package argument without its version or version
+// range, e.g. requests for requests>=2, as it is named in anchor ignore comments.
+func lintPackageName(arg string) string {
+	if i := strings.IndexAny(arg[min(1, len(arg)):], "=<>~!@:"); i >= 0 {
+		return arg[:i+1]
+	}
+	return arg
+}
+
+func (l *linter) lintAdd(node *Node, add *AddInstruction) {
+	if !flagValue(add.Flags, "checksum").IsZero() {
+		return
+	}
+	for _, source := range add.Sources {
+		value := source.Literal()
+		if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+			l.report(node, source.Span.Start, "remote-add",
+				"%s is added without a checksum, add --checksum to pin its content", value)
+		}
+	}
+}
+
+func (l *linter) lintCopyFrom(
+	node *Node, instruction CopyInstruction, ignored []string, stages []string,
+) {
+	from := instruction.From.Literal()
+	if from == "" || slices.Contains(ignored, from) {
+		return
+	}
+	image, digest := splitImageDigest(from)
+	if digest != "" || slices.Contains(stages, strings.ToLower(image)) ||
+		strings.Trim(from, "0123456789") == "" {
+		// an earlier stage, by name or index
+		return
+	}
+	l.report(node, instruction.From.Span.Start, "unpinned-copy-from",
+		"files are copied from %s, which anchor does not pin, pin it to a digest or copy from a stage",
+		from)
+}
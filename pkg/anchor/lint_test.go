@@ -0,0 +1,103 @@
+package anchor
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLintTemplate = `ARG BASE=debian:bookworm
+FROM golang AS builder
+RUN go install golang.org/x/tools/gopls@latest github.com/x/y@v1.2.3
+RUN pip install requests==2.31 flask && python3 -m pip install -r requirements.txt .
+FROM $BASE
+COPY --from=builder /go/bin /usr/local/bin
+COPY --from=nginx:1.27 /etc/nginx /etc/nginx
+ADD https://example.com/tool.tar.gz /tmp/
+ADD --checksum=sha256:abc https://example.com/other.tar.gz /tmp/
+RUN curl -fsSL https://example.com/install.sh | sudo bash
+RUN apt-get update && apt-get install -y curl $PACKAGES $(cat /tmp/packages.txt)
+# anchor ignore=flask
+RUN npm install -g typescript@5.4.5 eslint@^8 && pip install flask && apk add --virtual .deps git curl=8.5
+FROM ubuntu:latest
+# anchor ignore
+FROM alpine
+RUN if true; then
+`
+
+func TestLint(t *testing.T) {
+	findings := Lint(Parse(strings.NewReader(testLintTemplate)), "Dockerfile.template")
+	got := []string{}
+	for _, finding := range findings {
+		got = append(got, finding.String())
+	}
+	expected := []string{
+		"Dockerfile.template:2:6: warning: golang has no tag, it is built from whatever latest points to [untagged-image]",
+		"Dockerfile.template:3:16: warning: go package golang.org/x/tools/gopls@latest is not pinned to a version, anchor does not pin go packages [unsupported-package-manager]",
+		"Dockerfile.template:4:32: warning: pip package flask is not pinned to a version, anchor does not pin pip packages [unsupported-package-manager]",
+		"Dockerfile.template:5:6: warning: image $BASE is set with a variable, anchor cannot pin it [unresolved-variable]",
+		"Dockerfile.template:7:13: warning: files are copied from nginx:1.27, which anchor does not pin, pin it to a digest or copy from a stage [unpinned-copy-from]",
+		"Dockerfile.template:8:5: warning: https://example.com/tool.tar.gz is added without a checksum, add --checksum to pin its content [remote-add]",
+		"Dockerfile.template:10:5: error: the output of curl is run by bash, download a pinned release and verify its checksum instead [remote-script]",
+		"Dockerfile.template:11:47: warning: package $PACKAGES is set with a variable, anchor cannot pin it [unresolved-variable]",
+		"Dockerfile.template:13:37: warning: npm package eslint@^8 is not pinned to a version, anchor does not pin npm packages [unsupported-package-manager]",
+		"Dockerfile.template:13:95: warning: apk package git is not pinned to a version, anchor does not pin apk packages [unsupported-package-manager]",
+		"Dockerfile.template:14:6: warning: ubuntu:latest uses the latest tag, use a versioned tag so refreshing the digest stays on it [latest-tag]",
+		`Dockerfile.template:17:1: warning: RUN command could not be parsed, so its packages are not anchored: 18:1: expected "fi" [unparsed-run]`,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestLintPinned(t *testing.T) {
+	template := `FROM golang:1.23@sha256:abc AS builder
+FROM builder
+COPY --from=0 /a /a
+COPY --from=golang:1.23@sha256:abc /b /b
+RUN pip install requests==2.31 && gem install rails -v 7.1.3 && cargo install ripgrep@14.1.0
+RUN apt-get update && apt-get install -y curl
+`
+	if findings := Lint(Parse(strings.NewReader(template)), "Dockerfile"); len(findings) != 0 {
+		t.Errorf("expected no findings, got %v", findings)
+	}
+}
+
+func TestSARIF(t *testing.T) {
+	findings := []Finding{{
+		Rule:    "latest-tag",
+		Level:   "warning",
+		Message: "ubuntu:latest uses the latest tag",
+		File:    "services/api/Dockerfile.template",
+		Line:    3,
+		Column:  6,
+	}}
+	content, err := SARIF(findings, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(content, &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("unexpected log: %s", content)
+	}
+	run := log.Runs[0]
+	if run.Tool.Driver.Version != "v1.0.0" || len(run.Tool.Driver.Rules) != len(LintRules) {
+		t.Errorf("unexpected driver: %+v", run.Tool.Driver)
+	}
+	expected := sarifResult{
+		RuleID:  "latest-tag",
+		Level:   "warning",
+		Message: sarifMessage{Text: "ubuntu:latest uses the latest tag"},
+		Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: "services/api/Dockerfile.template"},
+			Region:           sarifRegion{StartLine: 3, StartColumn: 6},
+		}}},
+	}
+	if len(run.Results) != 1 || !reflect.DeepEqual(run.Results[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, run.Results)
+	}
+}
@@ -0,0 +1,276 @@
+package anchor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/fatih/color"
+)
+
+// stageCopy is a COPY or ADD from the build context earlier in the current stage, used to
+// trace files read by RUN commands back to the build context.
+type stageCopy struct {
+	node    *Node
+	sources []Word
+	dest    Word
+	// rewritten is set once the copy has been pointed at a lock file
+	rewritten bool
+}
+
+func parseStageCopy(node *Node) *stageCopy {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return nil
+	}
+	var instructionCopy CopyInstruction
+	switch i := instruction.(type) {
+	case *CopyInstruction:
+		instructionCopy = *i
+	case *AddInstruction:
+		instructionCopy = i.CopyInstruction
+	default:
+		return nil
+	}
+	if !instructionCopy.From.IsZero() || len(instructionCopy.Sources) == 0 {
+		return nil
+	}
+	return &stageCopy{node: node, sources: instructionCopy.Sources, dest: instructionCopy.Dest}
+}
+
+// isDirectory reports whether the destination of the copy is a directory the sources are
+// copied into rather than the path of the copied file.
+func (c *stageCopy) isDirectory() bool {
+	return len(c.sources) > 1 || strings.HasSuffix(c.dest.Literal(), "/")
+}
+
+// resolve maps a path inside the image to the build context source it was copied from.
+func (c *stageCopy) resolve(target string) (Word, bool) {
+	dest := c.dest.Literal()
+	if !path.IsAbs(dest) {
+		dest = "/" + dest
+	}
+	target = path.Clean(target)
+	for _, source := range c.sources {
+		copied := path.Clean(dest)
+		if c.isDirectory() {
+			copied = path.Join(dest, path.Base(source.Literal()))
+		}
+		if copied == target {
+			return source, true
+		}
+	}
+	return Word{}, false
+}
+
+// packageList is a file of package names installed by a RUN command, one or more names per
+// line. Lines starting with # are comments, and support the same anchor ignore comments as
+// a Dockerfile.
+type packageList struct {
+	// Source is the path of the list in the build context
+	Source string
+	// Target is the path of the list inside the image
+	Target    string
+	Packages  []string
+	Ignored   []string
+	IgnoreAll bool
+	lines     []string
+	// copy is the instruction that copies the list into the image
+	copy       *stageCopy
+	sourceWord Word
+}
+
+func readPackageList(contextDir string, source string, target string) (*packageList, error) {
+	// sources are relative to the root of the build context, which docker build does not let
+	// them leave
+	if cleaned := path.Clean(source); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return nil, fmt.Errorf("package list %s is outside the build context %s", source, contextDir)
+	}
+	content, err := os.ReadFile(
+		filepath.Join(contextDir, filepath.FromSlash(source)),
+	) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package list %s: %w", source, err)
+	}
+	list := &packageList{
+		Source:   source,
+		Target:   target,
+		Packages: []string{},
+		Ignored:  []string{},
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		list.lines = append(list.lines, line)
+		if isComment([]byte(line)) {
+			ignored, all := parseComment(Entry{Type: EntryComment, Value: line})
+			list.Ignored = append(list.Ignored, ignored...)
+			list.IgnoreAll = list.IgnoreAll || all
+			continue
+		}
+		for _, field := range strings.Fields(stripListComment(line)) {
+			pkg := packageName(field)
+			if !slices.Contains(list.Packages, pkg) {
+				list.Packages = append(list.Packages, pkg)
+			}
+		}
+	}
+	return list, scanner.Err()
+}
+
+func stripListComment(line string) string {
+	before, _, _ := strings.Cut(line, "#")
+	return before
+}
+
+// versions returns the versions the packages of the list are pinned to, leaving out the
+// packages which are not.
+func (l *packageList) versions() map[string]string {
+	versions := map[string]string{}
+	for _, line := range l.lines {
+		if isComment([]byte(line)) {
+			continue
+		}
+		for _, field := range strings.Fields(stripListComment(line)) {
+			if version := packageVersion(field); version != "" {
+				versions[packageName(field)] = version
+			}
+		}
+	}
+	return versions
+}
+
+// unignored returns the packages of the list which should be anchored.
+func (l *packageList) unignored(ignored []string) []string {
+	if l.IgnoreAll {
+		return []string{}
+	}
+	packages := []string{}
+	for _, pkg := range l.Packages {
+		if !slices.Contains(ignored, pkg) && !slices.Contains(l.Ignored, pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+// pinned renders the list with each package pinned to its version, keeping the comments
+// and layout of the original. Downgrades are reported to w.
+func (l *packageList) pinned(w io.Writer, resolution *Resolution, ignored []string) []byte {
+	anchored := l.unignored(ignored)
+	var buf bytes.Buffer
+	for _, line := range l.lines {
+		if isComment([]byte(line)) {
+			buf.WriteString(line + "\n")
+			continue
+		}
+		content := stripListComment(line)
+		rewritten := rewriteFields(content, func(field string) string {
+			pkg := packageName(field)
+			name, version, ok := resolution.pin(pkg)
+			if !ok || !slices.Contains(anchored, pkg) {
+				return field
+			}
+			if previous := packageVersion(field); isDowngrade(previous, version) {
+				printColor(w, color.FgYellow, "\tDowngraded %s from %s to %s", name, previous, version)
+			}
+			return fmt.Sprintf("%s=%s", name, version)
+		})
+		buf.WriteString(rewritten + line[len(content):] + "\n")
+	}
+	return buf.Bytes()
+}
+
+// unpinned renders the list with the versions removed, keeping those of ignored packages and
+// version patterns, e.g. curl=7.88.*.
+func (l *packageList) unpinned(ignored []string) []byte {
+	var buf bytes.Buffer
+	for _, line := range l.lines {
+		if isComment([]byte(line)) || l.IgnoreAll {
+			buf.WriteString(line + "\n")
+			continue
+		}
+		content := stripListComment(line)
+		rewritten := rewriteFields(content, func(field string) string {
+			pkg := packageName(field)
+			if slices.Contains(ignored, pkg) || slices.Contains(l.Ignored, pkg) ||
+				strings.ContainsAny(packageVersion(field), "*?") {
+				return field
+			}
+			return pkg
+		})
+		buf.WriteString(rewritten + line[len(content):] + "\n")
+	}
+	return buf.Bytes()
+}
+
+// rewriteFields replaces each whitespace delimited field of a line, keeping the whitespace
+// between them.
+func rewriteFields(content string, rewrite func(field string) string) string {
+	var sb strings.Builder
+	start := -1
+	for i := 0; i <= len(content); i++ {
+		if i < len(content) && !unicode.IsSpace(rune(content[i])) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			sb.WriteString(rewrite(content[start:i]))
+			start = -1
+		}
+		if i < len(content) {
+			sb.WriteByte(content[i])
+		}
+	}
+	return sb.String()
+}
+
+// lockName returns the name of the pinned copy of a package list, e.g. packages.txt is
+// written to packages.lock.txt. Lists that are already locked keep their name.
+func lockName(source string, architecture string, appendArchitecture bool) string {
+	dir, name := path.Split(source)
+	if strings.Contains(name, ".lock") {
+		return source
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	if appendArchitecture {
+		base = fmt.Sprintf("%s.%s", base, architecture)
+	}
+	return dir + base + ".lock" + ext
+}
+
+// rewrite points the copy at the lock file of the list, keeping the path of the list inside
+// the image the same so the RUN command does not need to change.
+func (c *stageCopy) rewrite(source Word, lock string, target string) error {
+	if c.rewritten {
+		return nil
+	}
+	if len(c.sources) > 1 {
+		return fmt.Errorf(
+			"cannot anchor %s as it is copied along with other files, copy it on its own",
+			source.Literal(),
+		)
+	}
+	edits := []Edit{{Span: source.Span, Text: lock}}
+	if c.isDirectory() {
+		edits = append(edits, Edit{Span: c.dest.Span, Text: target})
+	}
+	if err := c.node.Apply(edits...); err != nil {
+		return err
+	}
+	c.rewritten = true
+	return nil
+}
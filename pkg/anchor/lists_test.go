@@ -0,0 +1,185 @@
+package anchor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListFiles(t *testing.T) {
+	cases := []struct {
+		name     string
+		script   string
+		expected []string
+	}{
+		{
+			"command substitution",
+			"apt-get install -y $(cat /tmp/packages.txt)",
+			[]string{"/tmp/packages.txt"},
+		},
+		{
+			"backquotes",
+			"apt-get install -y `cat /tmp/packages.txt` curl",
+			[]string{"/tmp/packages.txt"},
+		},
+		{
+			"xargs redirect",
+			"xargs apt-get install -y < /tmp/packages.txt",
+			[]string{"/tmp/packages.txt"},
+		},
+		{
+			"xargs pipe",
+			"cat /tmp/packages.txt | xargs apt-get install -y",
+			[]string{"/tmp/packages.txt"},
+		},
+		{
+			"xargs arg file",
+			"xargs -a /tmp/packages.txt apt-get install -y",
+			[]string{"/tmp/packages.txt"},
+		},
+		{"redirect without xargs", "apt-get install -y curl < /tmp/packages.txt", []string{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			script, err := parseShell(tc.script)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			actual := []string{}
+			for _, install := range findInstalls(script) {
+				for _, file := range install.ListFiles {
+					value, _ := file.literal()
+					actual = append(actual, value)
+				}
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPackageList(t *testing.T) {
+	dir := t.TempDir()
+	content := `# anchor ignore=wget
+curl   wget # trailing comment
+ca-certificates=20230311
+
+git
+`
+	err := os.WriteFile(filepath.Join(dir, "packages.txt"), []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := readPackageList(dir, "packages.txt", "/tmp/packages.txt")
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expectedPackages := []string{"curl", "wget", "ca-certificates", "git"}
+	if !reflect.DeepEqual(list.Packages, expectedPackages) {
+		t.Errorf("Expected %v but got %v", expectedPackages, list.Packages)
+	}
+	unignored := list.unignored([]string{"git"})
+	if !reflect.DeepEqual(unignored, []string{"curl", "ca-certificates"}) {
+		t.Errorf("Expected [curl ca-certificates] but got %v", unignored)
+	}
+
+	packageMap := map[string]string{
+		"curl":            "7.88.1",
+		"wget":            "1.21.3",
+		"ca-certificates": "20240203",
+		"git":             "2.39.2",
+	}
+	expected := `# anchor ignore=wget
+curl=7.88.1   wget # trailing comment
+ca-certificates=20240203
+
+git
+`
+	actual := string(list.pinned(io.Discard, &Resolution{Versions: packageMap}, []string{"git"}))
+	if actual != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, actual)
+	}
+}
+
+func TestLockName(t *testing.T) {
+	cases := []struct {
+		source     string
+		appendArch bool
+		expected   string
+	}{
+		{"packages.txt", false, "packages.lock.txt"},
+		{"deps/packages", false, "deps/packages.lock"},
+		{"packages.txt", true, "packages.arm64.lock.txt"},
+		{"packages.lock.txt", false, "packages.lock.txt"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.source, func(t *testing.T) {
+			actual := lockName(tc.source, "arm64", tc.appendArch)
+			if actual != tc.expected {
+				t.Errorf("Expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestReadPackageListsFromCopy(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "packages.txt"), []byte("curl\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := `FROM debian:bookworm
+COPY packages.txt /tmp/
+RUN apt-get install -y $(cat /tmp/packages.txt)
+`
+	nodes := Parse(strings.NewReader(file))
+	copies := []*stageCopy{parseStageCopy(&nodes[1])}
+	installs, err := runInstalls(&nodes[2])
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	lists, err := readPackageLists(io.Discard, installs, dir, copies)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(lists) != 1 || lists[0].Source != "packages.txt" ||
+		!reflect.DeepEqual(lists[0].Packages, []string{"curl"}) {
+		t.Fatalf("Unexpected lists %+v", lists)
+	}
+
+	err = lists[0].copy.rewrite(lists[0].sourceWord, "packages.lock.txt", lists[0].Target)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := "COPY packages.lock.txt /tmp/packages.txt\n"
+	if nodes[1].Source() != expected {
+		t.Errorf("Expected %q but got %q", expected, nodes[1].Source())
+	}
+}
+
+func TestReadPackageListOutsideContext(t *testing.T) {
+	root := t.TempDir()
+	contextDir := filepath.Join(root, "service")
+	if err := os.Mkdir(contextDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(root, "packages.txt"), []byte("curl\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"../packages.txt", "lists/../../packages.txt"} {
+		_, err := readPackageList(contextDir, source, "/tmp/packages.txt")
+		expected := "package list " + source + " is outside the build context " + contextDir
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected %q but got %v", expected, err)
+		}
+	}
+	// absolute sources are relative to the root of the context, as in docker build
+	if _, err := readPackageList(root, "/packages.txt", "/tmp/packages.txt"); err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+}
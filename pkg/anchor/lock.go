@@ -0,0 +1,211 @@
+package anchor
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LockFileName is the conventional name of the lockfile, which anchor reads with --locked
+// when no other lockfile is given.
+const LockFileName = "anchor.lock"
+
+// lockFileVersion is the version of the format of the lockfile.
+const lockFileVersion = 1
+
+// LockFile records what every anchored Dockerfile of a project is pinned to, so that the
+// pins can be reviewed and read by other tools, and the Dockerfiles rendered again from their
+// templates without resolving anything.
+type LockFile struct {
+	Version int          `json:"version"`
+	Files   []LockedFile `json:"files"`
+}
+
+// LockedFile is what an anchored Dockerfile is pinned to for a platform.
+type LockedFile struct {
+	// Template is the template the Dockerfile is anchored from, and Output the Dockerfile
+	Template string `json:"template"`
+	Output   string `json:"output"`
+	Platform string `json:"platform"`
+	// Architecture is the dpkg architecture of the platform
+	Architecture string `json:"architecture"`
+	// ResolvedAt is when the images and packages were resolved
+	ResolvedAt time.Time `json:"resolvedAt"`
+	// Source is the resolver the packages were resolved with, container or registry. Image
+	// digests are always read from the registry of the image
+	Source string        `json:"source"`
+	Stages []LockedStage `json:"stages"`
+}
+
+// LockedStage is what a stage of an anchored Dockerfile is pinned to.
+type LockedStage struct {
+	// Name is the name of the stage, or its index when it is not named
+	Name string `json:"name"`
+	// Image is the base image of the stage without its digest, which is the base image of
+	// the earlier stage it is built on, if any
+	Image string `json:"image"`
+	// Digest is the digest the image is anchored to, empty when it is not
+	Digest string `json:"digest,omitempty"`
+	// Packages are the versions the packages of the stage are anchored to, by package
+	Packages map[string]string `json:"packages,omitempty"`
+	// Providers are the packages virtual packages of the stage are anchored to, by virtual
+	// package, which are locked in Packages
+	Providers map[string]string `json:"providers,omitempty"`
+}
+
+// NewLockedFile returns the entry of the lockfile of an anchored Dockerfile, from its pins.
+func NewLockedFile(
+	template string,
+	output string,
+	platform v1.Platform,
+	pins *Pins,
+	source string,
+	resolvedAt time.Time,
+) (LockedFile, error) {
+	architecture, err := DpkgArchitecture(platform)
+	if err != nil {
+		return LockedFile{}, err
+	}
+	file := LockedFile{
+		Template:     lockPath(template),
+		Output:       lockPath(output),
+		Platform:     platform.String(),
+		Architecture: architecture,
+		ResolvedAt:   resolvedAt.UTC(),
+		Source:       source,
+		Stages:       []LockedStage{},
+	}
+	for _, name := range pins.Stages {
+		stage := LockedStage{
+			Name:   name,
+			Image:  pins.Bases[name],
+			Digest: pins.Images[pins.Bases[name]],
+		}
+		if len(pins.Packages[name]) > 0 {
+			stage.Packages = pins.Packages[name]
+		}
+		if len(pins.Providers[name]) > 0 {
+			stage.Providers = pins.Providers[name]
+		}
+		file.Stages = append(file.Stages, stage)
+	}
+	return file, nil
+}
+
+// lockPath returns a path as it is written to the lockfile, with forward slashes.
+func lockPath(path string) string {
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// ReadLockFile reads a lockfile.
+func ReadLockFile(r io.Reader) (*LockFile, error) {
+	lock := &LockFile{}
+	if err := json.NewDecoder(r).Decode(lock); err != nil {
+		return nil, fmt.Errorf("failed to read the lockfile: %w", err)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, fmt.Errorf(
+			"unsupported lockfile version %d, expected %d", lock.Version, lockFileVersion,
+		)
+	}
+	return lock, nil
+}
+
+// Write writes the lockfile as indented JSON.
+func (l *LockFile) Write(w io.Writer) error {
+	l.Version = lockFileVersion
+	if l.Files == nil {
+		l.Files = []LockedFile{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(l)
+}
+
+// Template returns the locked files of a template, one per platform it is anchored to.
+func (l *LockFile) Template(template string) []LockedFile {
+	files := []LockedFile{}
+	for _, file := range l.Files {
+		if file.Template == lockPath(template) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Lock replaces the locked files of a template, keeping the files sorted by template and
+// output.
+func (l *LockFile) Lock(template string, files []LockedFile) {
+	l.Files = slices.DeleteFunc(l.Files, func(file LockedFile) bool {
+		return file.Template == lockPath(template)
+	})
+	l.Files = append(l.Files, files...)
+	slices.SortFunc(l.Files, func(a LockedFile, b LockedFile) int {
+		return cmp.Or(cmp.Compare(a.Template, b.Template), cmp.Compare(a.Output, b.Output))
+	})
+}
+
+// stage returns the locked stage with the name.
+func (f *LockedFile) stage(name string) (LockedStage, bool) {
+	i := slices.IndexFunc(f.Stages, func(stage LockedStage) bool {
+		return stage.Name == name
+	})
+	if i < 0 {
+		return LockedStage{}, false
+	}
+	return f.Stages[i], true
+}
+
+// ResolveImage returns the digest the image is locked to. An image that is not locked fails,
+// as the template changed since the lockfile was written.
+func (f *LockedFile) ResolveImage(_ context.Context, image string) (string, error) {
+	for _, stage := range f.Stages {
+		if stage.Image == image && stage.Digest != "" {
+			return stage.Digest, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"%s is not locked for %s in the lockfile, run anchor to update it", image, f.Output,
+	)
+}
+
+// ResolvePackages returns the versions the packages are locked to in the stage of the
+// request. Packages that are not locked are reported as failures.
+func (f *LockedFile) ResolvePackages(
+	_ context.Context, request PackageRequest,
+) (*Resolution, error) {
+	resolution := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Reasons:   map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	stage, _ := f.stage(request.Stage)
+	for _, pkg := range request.Packages {
+		name := pkg
+		if provider, ok := stage.Providers[pkg]; ok {
+			name = provider
+			resolution.Providers[pkg] = provider
+		}
+		version, ok := stage.Packages[name]
+		if !ok {
+			resolution.Failures = append(resolution.Failures, PackageFailure{
+				Package:      pkg,
+				Architecture: request.Architecture,
+				Reason:       fmt.Sprintf("package is not locked for %s", f.Output),
+				Suggestion:   "Run anchor to update the lockfile.",
+			})
+			continue
+		}
+		resolution.Versions[name] = version
+		resolution.Reasons[name] = "locked in the lockfile"
+	}
+	return resolution, nil
+}
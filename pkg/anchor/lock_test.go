@@ -0,0 +1,154 @@
+package anchor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// testLockedFile locks testCheckOutput, with its package list in dir.
+func testLockedFile(t *testing.T, dir string) LockedFile {
+	t.Helper()
+	for name, content := range map[string]string{
+		"packages.txt":      "git\n",
+		"packages.lock.txt": "git=1:2.39.5\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pins, err := ReadPins(Parse(strings.NewReader(testCheckOutput)), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewLockedFile(
+		"./Dockerfile.template",
+		"Dockerfile",
+		v1.Platform{OS: "linux", Architecture: "arm64"},
+		pins,
+		"registry",
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestNewLockedFile(t *testing.T) {
+	file := testLockedFile(t, t.TempDir())
+	expected := LockedFile{
+		Template:     "Dockerfile.template",
+		Output:       "Dockerfile",
+		Platform:     "linux/arm64",
+		Architecture: "arm64",
+		ResolvedAt:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Source:       "registry",
+		Stages: []LockedStage{
+			{
+				Name:     "builder",
+				Image:    "debian:bookworm",
+				Digest:   "sha256:abc",
+				Packages: map[string]string{"curl": "7.88.1", "git": "1:2.39.5"},
+			},
+			{
+				Name:     "1",
+				Image:    "debian:bookworm",
+				Digest:   "sha256:abc",
+				Packages: map[string]string{"ca-certificates": "20230311"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(file, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, file)
+	}
+
+	lock := &LockFile{}
+	lock.Lock(file.Template, []LockedFile{file})
+	var buffer bytes.Buffer
+	if err := lock.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLockFile(&buffer)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if !reflect.DeepEqual(read, lock) {
+		t.Errorf("Expected %+v but got %+v", lock, read)
+	}
+}
+
+func TestReadLockFileVersion(t *testing.T) {
+	_, err := ReadLockFile(strings.NewReader(`{"version": 2, "files": []}`))
+	if err == nil || !strings.Contains(err.Error(), "unsupported lockfile version 2") {
+		t.Errorf("Expected an unsupported version error but got %v", err)
+	}
+}
+
+func TestLockFileLock(t *testing.T) {
+	lock := &LockFile{Files: []LockedFile{
+		{Template: "web/Dockerfile.template", Output: "web/Dockerfile.amd64"},
+		{Template: "web/Dockerfile.template", Output: "web/Dockerfile.arm64"},
+		{Template: "worker/Dockerfile.template", Output: "worker/Dockerfile"},
+	}}
+	lock.Lock("./web/Dockerfile.template", []LockedFile{
+		{Template: "web/Dockerfile.template", Output: "web/Dockerfile"},
+	})
+	lock.Lock("api/Dockerfile.template", []LockedFile{
+		{Template: "api/Dockerfile.template", Output: "api/Dockerfile"},
+	})
+	outputs := []string{}
+	for _, file := range lock.Files {
+		outputs = append(outputs, file.Output)
+	}
+	expected := []string{"api/Dockerfile", "web/Dockerfile", "worker/Dockerfile"}
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Errorf("Expected %v but got %v", expected, outputs)
+	}
+	if files := lock.Template("web/Dockerfile.template"); len(files) != 1 {
+		t.Errorf("Expected a single locked file but got %v", files)
+	}
+}
+
+func TestLockedFileRender(t *testing.T) {
+	dir := t.TempDir()
+	file := testLockedFile(t, dir)
+	render := func(template string) ([]Node, error) {
+		nodes := Parse(strings.NewReader(template))
+		_, err := ProcessWithConfig(context.Background(), nodes, Config{
+			Platform:   v1.Platform{OS: "linux", Architecture: "arm64"},
+			ContextDir: dir,
+			Resolver:   &file,
+			Images:     &file,
+		})
+		return nodes, err
+	}
+
+	nodes, err := render(testCheckTemplate)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	output := Parse(strings.NewReader(testCheckOutput))
+	if mismatches := CompareNodes(nodes, output, "Dockerfile"); len(mismatches) > 0 {
+		t.Errorf("Expected the locked output but got %v", mismatches)
+	}
+
+	_, err = render(strings.Replace(testCheckTemplate, "curl", "curl wget", 1))
+	var resolutionError *ResolutionError
+	if !errors.As(err, &resolutionError) || len(resolutionError.Failures) != 1 ||
+		resolutionError.Failures[0].Package != "wget" {
+		t.Errorf("Expected wget to fail but got %v", err)
+	}
+	_, err = render(strings.Replace(testCheckTemplate, "debian:bookworm", "debian:trixie", 1))
+	if err == nil || !strings.Contains(err.Error(), "debian:trixie is not locked") {
+		t.Errorf("Expected debian:trixie to fail but got %v", err)
+	}
+}
@@ -0,0 +1,494 @@
+package anchor
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// AnchoredPlatform is a Dockerfile anchored to a platform, with the files generated with it.
+type AnchoredPlatform struct {
+	Platform v1.Platform
+	Nodes    []Node
+	Files    []File
+}
+
+// MergePlatforms merges Dockerfiles anchored to several platforms from the same template,
+// with the architecture appended to their package lists, into a single Dockerfile that
+// docker buildx builds for every platform at once. What differs between the platforms is
+// selected with the TARGETARCH build arg: a RUN instruction installing different versions
+// becomes a case statement on it, and a package list pinned differently for each platform
+// is copied by name, e.g. packages.${TARGETARCH}.lock.txt. Base images must be anchored to
+// the same digest, which is the digest of their manifest index.
+//
+// The merged Dockerfile starts with a comment listing the platforms it is merged from, which
+// MergedPlatforms reads. The copies of package lists in the nodes of each platform are
+// renamed to the merged files, so that the pins of each platform can still be read from them.
+func MergePlatforms(platforms []AnchoredPlatform) (Nodes, []File, error) {
+	if len(platforms) == 0 {
+		return nil, nil, fmt.Errorf("no platforms to merge")
+	}
+	for _, platform := range platforms[1:] {
+		if len(platform.Nodes) != len(platforms[0].Nodes) {
+			return nil, nil, fmt.Errorf(
+				"%s and %s were not anchored from the same template",
+				platforms[0].Platform.String(),
+				platform.Platform.String(),
+			)
+		}
+	}
+	selector := newArchSelector(platforms)
+	files, renames, err := selector.mergeFiles(platforms)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sb strings.Builder
+	declared := []string{}
+	for i := range platforms[0].Nodes {
+		node := &platforms[0].Nodes[i]
+		if node.CommandType == CommandFrom {
+			declared = []string{}
+		}
+		if arg, ok := nodeInstruction(node).(*ArgInstruction); ok {
+			for _, kv := range arg.Args {
+				declared = append(declared, kv.Key.Value)
+			}
+		}
+		text, selected, err := selector.mergeNode(platforms, renames, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			// after the comments leading the first instruction, as parser directives such as
+			// # syntax must come first
+			offset := len(text) - len(commandSource(*node))
+			text = text[:offset] + mergedComment(platforms) + text[offset:]
+		}
+		if selected {
+			// the build args are only set in a stage that declares them
+			for _, arg := range selector.args() {
+				if !slices.Contains(declared, arg) {
+					fmt.Fprintf(&sb, "ARG %s\n", arg)
+					declared = append(declared, arg)
+				}
+			}
+		}
+		sb.WriteString(text)
+	}
+
+	for i, platform := range platforms {
+		for j := range platform.Nodes {
+			edits := renames[i].edits(&platform.Nodes[j], func(rename listRename) string {
+				return rename.platform
+			})
+			if err := platform.Nodes[j].Apply(edits...); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return Parse(strings.NewReader(sb.String())), files, nil
+}
+
+// mergedPrefix starts the comment that lists the platforms of a merged Dockerfile.
+const mergedPrefix = "# anchor platforms="
+
+// mergedComment returns the comment that lists the platforms of a merged Dockerfile.
+func mergedComment(platforms []AnchoredPlatform) string {
+	names := []string{}
+	for _, platform := range platforms {
+		names = append(names, platform.Platform.String())
+	}
+	return mergedPrefix + strings.Join(names, ",") + "\n"
+}
+
+// MergedPlatforms returns the platforms a Dockerfile was merged from by MergePlatforms, or
+// nil when it is anchored to a single platform.
+func MergedPlatforms(nodes Nodes) []string {
+	for _, node := range nodes {
+		for _, entry := range node.Entries {
+			if entry.Type != EntryComment {
+				continue
+			}
+			if value, ok := strings.CutPrefix(strings.TrimSpace(entry.Value), mergedPrefix); ok {
+				return strings.Split(value, ",")
+			}
+		}
+	}
+	return nil
+}
+
+// ReadPlatformPins reads the pins an anchored Dockerfile has for a platform. The pins of a
+// platform of a Dockerfile merged by MergePlatforms are read from the branches of the case
+// statements and the package lists the platform selects, and those of any other Dockerfile
+// with ReadPins.
+func ReadPlatformPins(nodes []Node, contextDir string, platform v1.Platform) (*Pins, error) {
+	if MergedPlatforms(nodes) == nil {
+		return ReadPins(nodes, contextDir)
+	}
+	selected, err := selectPlatform(nodes, platform)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := ReadPins(selected, contextDir)
+	if err != nil {
+		return nil, err
+	}
+	// the architecture prefix is removed when merging, as each platform is built natively
+	for _, versions := range pins.Packages {
+		if len(versions) > 0 {
+			pins.Architecture, err = DpkgArchitecture(platform)
+			break
+		}
+	}
+	return pins, err
+}
+
+// selectPlatform returns the Dockerfile a platform builds from a Dockerfile merged by
+// MergePlatforms, with the branch of each case statement on the build args the platform
+// selects, and the package lists of the platform copied by their name for it, e.g.
+// packages.amd64.lock.txt for packages.${TARGETARCH}.lock.txt.
+func selectPlatform(nodes []Node, platform v1.Platform) (Nodes, error) {
+	merged := []AnchoredPlatform{}
+	for _, value := range MergedPlatforms(nodes) {
+		mergedPlatform, err := ParsePlatform(value)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, AnchoredPlatform{Platform: mergedPlatform})
+	}
+	if !slices.ContainsFunc(merged, func(merged AnchoredPlatform) bool {
+		return merged.Platform.Equals(platform)
+	}) {
+		return nil, fmt.Errorf("the Dockerfile is not merged from %s", platform.String())
+	}
+	selector := newArchSelector(merged)
+	var sb strings.Builder
+	for i := range nodes {
+		node := &nodes[i]
+		source := node.Source()
+		if node.CommandType == CommandRun {
+			var err error
+			source, err = selector.selectBranch(node, platform)
+			if err != nil {
+				return nil, err
+			}
+		} else if _, copies := nodeInstruction(node).(*CopyInstruction); copies {
+			source = strings.ReplaceAll(source, selector.expression(), selector.key(platform))
+		}
+		sb.WriteString(source)
+	}
+	return Parse(strings.NewReader(sb.String())), nil
+}
+
+// selectBranch returns the source of a RUN instruction with the case statement mergeRun
+// generated replaced by the script of the branch the platform selects, or the source as it
+// is when the instruction is the same for every platform.
+func (s archSelector) selectBranch(node *Node, platform v1.Platform) (string, error) {
+	source := node.Source()
+	header := fmt.Sprintf("case \"%s\" in \\\n", s.expression())
+	footer := fmt.Sprintf(
+		"      *) echo \"%s is not anchored\" >&2 && exit 1 ;; \\\n    esac", s.expression(),
+	)
+	start, end := strings.Index(source, header), strings.Index(source, footer)
+	if start < 0 || end < start {
+		return source, nil
+	}
+	for _, branch := range strings.Split(source[start+len(header):end], " ;; \\\n") {
+		keys, script, ok := strings.Cut(strings.TrimLeft(branch, " "), ") ")
+		if ok && slices.Contains(strings.Split(keys, "|"), s.key(platform)) {
+			return source[:start] + script + source[end+len(footer):], nil
+		}
+	}
+	return "", fmt.Errorf(
+		"the RUN instruction on line %d has no branch for %s",
+		instructionLine(*node),
+		platform.String(),
+	)
+}
+
+// commandSource returns the source of a node from its instruction, without the comments and
+// empty lines leading it.
+func commandSource(node Node) string {
+	source := node.Source()
+	for _, entry := range node.Entries {
+		if entry.Type == EntryCommand {
+			break
+		}
+		source = source[len(entry.Value):]
+	}
+	return source
+}
+
+// listRename is the name a package list of a platform is copied from once merged, in the
+// merged Dockerfile and in the Dockerfile of the platform.
+type listRename struct {
+	merged   string
+	platform string
+}
+
+// listRenames are the renames of the package lists of a platform, by name.
+type listRenames map[string]listRename
+
+// edits returns the edits renaming the package lists a node copies. Only a source naming a
+// list is renamed, keeping its directory, so a list whose name ends with the name of another
+// is not renamed as that list.
+func (r listRenames) edits(node *Node, name func(listRename) string) []Edit {
+	copied := parseStageCopy(node)
+	if copied == nil {
+		return nil
+	}
+	edits := []Edit{}
+	for _, source := range copied.sources {
+		literal := source.Literal()
+		base := path.Base(literal)
+		rename, ok := r[base]
+		if !ok {
+			continue
+		}
+		edits = append(edits, Edit{
+			Span: source.Span,
+			Text: strings.TrimSuffix(literal, base) + name(rename),
+		})
+	}
+	return edits
+}
+
+// apply returns the source of a node with the package lists it copies renamed, leaving the
+// node as it is.
+func (r listRenames) apply(node *Node, name func(listRename) string) string {
+	source := node.Source()
+	edits := r.edits(node, name)
+	// the sources are in order and do not overlap, so they are replaced from the last
+	for i := len(edits) - 1; i >= 0; i-- {
+		span := edits[i].Span
+		source = source[:span.Start] + edits[i].Text + source[span.End:]
+	}
+	return source
+}
+
+// archSelector selects what is anchored for a platform with the TARGETARCH build arg, and
+// with TARGETVARIANT as well when platforms only differ by variant, e.g. arm/v6 and arm/v7.
+type archSelector struct {
+	variants bool
+}
+
+func newArchSelector(platforms []AnchoredPlatform) archSelector {
+	architectures := []string{}
+	for _, platform := range platforms {
+		if slices.Contains(architectures, platform.Platform.Architecture) {
+			return archSelector{variants: true}
+		}
+		architectures = append(architectures, platform.Platform.Architecture)
+	}
+	return archSelector{}
+}
+
+// args returns the build args the selector reads.
+func (s archSelector) args() []string {
+	if s.variants {
+		return []string{"TARGETARCH", "TARGETVARIANT"}
+	}
+	return []string{"TARGETARCH"}
+}
+
+// expression returns the shell expression of the value the selector selects on.
+func (s archSelector) expression() string {
+	if s.variants {
+		return "${TARGETARCH}${TARGETVARIANT}"
+	}
+	return "${TARGETARCH}"
+}
+
+// key returns the value of the expression when building a platform, e.g. arm64, or armv7
+// with variants.
+func (s archSelector) key(platform v1.Platform) string {
+	if s.variants && platform.Architecture == "arm" {
+		return platform.Architecture + platform.Variant
+	}
+	return platform.Architecture
+}
+
+// mergedFile is a file generated for every platform, by platform.
+type mergedFile struct {
+	// dir and name are the directory and name of the file without an architecture, e.g.
+	// packages.lock.txt
+	dir  string
+	name string
+	// names are the names of the file of each platform, e.g. packages.amd64.lock.txt
+	names    []string
+	contents [][]byte
+}
+
+// mergeFiles returns the package lists of the merged Dockerfile, and how the lists of each
+// platform are renamed to them. A list pinned the same way for every platform is written
+// once, without an architecture, and one pinned differently is written for each platform
+// with the key of the platform instead of its architecture.
+func (s archSelector) mergeFiles(
+	platforms []AnchoredPlatform,
+) ([]File, []listRenames, error) {
+	merged := []*mergedFile{}
+	for i, platform := range platforms {
+		architecture, err := DpkgArchitecture(platform.Platform)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range platform.Files {
+			dir, name := filepath.Split(file.Path)
+			plain := strings.Replace(name, "."+architecture+".lock", ".lock", 1)
+			index := slices.IndexFunc(merged, func(m *mergedFile) bool {
+				return m.dir == dir && m.name == plain
+			})
+			if index < 0 {
+				merged = append(merged, &mergedFile{
+					dir:      dir,
+					name:     plain,
+					names:    make([]string, len(platforms)),
+					contents: make([][]byte, len(platforms)),
+				})
+				index = len(merged) - 1
+			}
+			merged[index].names[i] = name
+			merged[index].contents[i] = file.Content
+		}
+	}
+
+	files := []File{}
+	renames := make([]listRenames, len(platforms))
+	for i := range renames {
+		renames[i] = listRenames{}
+	}
+	for _, file := range merged {
+		if slices.Contains(file.names, "") {
+			return nil, nil, fmt.Errorf("%s is not generated for every platform", file.name)
+		}
+		same := !slices.ContainsFunc(file.contents, func(content []byte) bool {
+			return !bytes.Equal(content, file.contents[0])
+		})
+		if same {
+			files = append(files, File{Path: file.dir + file.name, Content: file.contents[0]})
+			for i, name := range file.names {
+				renames[i][name] = listRename{merged: file.name, platform: file.name}
+			}
+			continue
+		}
+		if file.names[0] == file.name {
+			return nil, nil, fmt.Errorf(
+				"%s is pinned differently for each platform, name the list without .lock so "+
+					"that a list is written for each platform",
+				file.name,
+			)
+		}
+		for i, platform := range platforms {
+			architecture, _ := DpkgArchitecture(platform.Platform)
+			name := file.names[i]
+			rename := listRename{
+				merged:   s.rename(name, architecture, s.expression()),
+				platform: s.rename(name, architecture, s.key(platform.Platform)),
+			}
+			files = append(files, File{Path: file.dir + rename.platform, Content: file.contents[i]})
+			renames[i][name] = rename
+		}
+	}
+	return files, renames, nil
+}
+
+// rename replaces the architecture of the name of a package list, e.g. packages.armhf.lock.txt
+// is packages.armv7.lock.txt.
+func (s archSelector) rename(name string, architecture string, key string) string {
+	return strings.Replace(name, "."+architecture+".lock", "."+key+".lock", 1)
+}
+
+// mergeNode returns the merged source of the node at an index, and whether it selects on the
+// build args.
+func (s archSelector) mergeNode(
+	platforms []AnchoredPlatform, renames []listRenames, index int,
+) (string, bool, error) {
+	sources := []string{}
+	for i, platform := range platforms {
+		sources = append(sources, renames[i].apply(
+			&platform.Nodes[index], func(rename listRename) string { return rename.merged },
+		))
+	}
+	node := &platforms[0].Nodes[index]
+	if !slices.ContainsFunc(sources, func(source string) bool { return source != sources[0] }) {
+		_, copies := nodeInstruction(node).(*CopyInstruction)
+		return sources[0], copies && strings.Contains(sources[0], s.expression()), nil
+	}
+
+	line := instructionLine(*node)
+	switch node.CommandType {
+	case CommandFrom:
+		return "", false, fmt.Errorf(
+			"the FROM instruction on line %d is anchored to different images for each "+
+				"platform, it must be anchored to the digest of a multi-platform image",
+			line,
+		)
+	case CommandRun:
+		return s.mergeRun(platforms, index)
+	default:
+		return "", false, fmt.Errorf(
+			"line %d differs between platforms and cannot be merged into one Dockerfile", line,
+		)
+	}
+}
+
+// mergeRun merges a RUN instruction that installs different versions for each platform. As
+// each platform is built natively, the architecture anchor adds with dpkg is the one the
+// image already has, so it is removed. When that is the only difference, the instruction is
+// the same for every platform, and otherwise its script becomes a case statement on the build
+// args, with a branch for each platform.
+func (s archSelector) mergeRun(platforms []AnchoredPlatform, index int) (string, bool, error) {
+	var prefix, suffix string
+	scripts := []string{}
+	for i, platform := range platforms {
+		node := &platform.Nodes[index]
+		run, ok := nodeInstruction(node).(*RunInstruction)
+		if !ok || run.Exec {
+			return "", false, fmt.Errorf(
+				"the RUN instruction on line %d installs different versions for each platform, "+
+					"which can only be merged in shell form",
+				instructionLine(*node),
+			)
+		}
+		source := node.Source()
+		start := len(run.Script) - len(strings.TrimLeftFunc(run.Script, unicode.IsSpace))
+		end := len(strings.TrimRightFunc(run.Script, unicode.IsSpace))
+		if i == 0 {
+			prefix, suffix = source[:start], source[end:]
+		}
+		// the prefix is removed as MakeTemplate removes it, with the update it adds
+		scripts = append(scripts, dpkgPrefix.ReplaceAllString(source[start:end], ""))
+	}
+	if !slices.ContainsFunc(scripts, func(script string) bool { return script != scripts[0] }) {
+		return prefix + scripts[0] + suffix, false, nil
+	}
+
+	// platforms installing the same versions share a branch
+	branches := []string{}
+	keys := [][]string{}
+	for i, platform := range platforms {
+		j := slices.Index(branches, scripts[i])
+		if j < 0 {
+			branches = append(branches, scripts[i])
+			keys = append(keys, []string{})
+			j = len(branches) - 1
+		}
+		keys[j] = append(keys[j], s.key(platform.Platform))
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "case \"%s\" in \\\n", s.expression())
+	for i, branch := range branches {
+		fmt.Fprintf(&sb, "      %s) %s ;; \\\n", strings.Join(keys[i], "|"), branch)
+	}
+	fmt.Fprintf(
+		&sb, "      *) echo \"%s is not anchored\" >&2 && exit 1 ;; \\\n    esac", s.expression(),
+	)
+	return prefix + sb.String() + suffix, true, nil
+}
@@ -0,0 +1,403 @@
+package anchor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// sameVersionResolver resolves every package to the same version on every architecture.
+type sameVersionResolver struct{}
+
+func (sameVersionResolver) ResolvePackages(
+	_ context.Context, request PackageRequest,
+) (*Resolution, error) {
+	resolution := &Resolution{Versions: map[string]string{}}
+	for _, pkg := range request.Packages {
+		resolution.Versions[pkg] = "1.0"
+	}
+	return resolution, nil
+}
+
+// anchorPlatforms anchors a template to each platform, as anchor does with several
+// architectures.
+func anchorPlatforms(
+	t *testing.T, template string, dir string, resolver PackageResolver, platforms ...string,
+) []AnchoredPlatform {
+	t.Helper()
+	anchored := []AnchoredPlatform{}
+	for _, value := range platforms {
+		platform, err := ParsePlatform(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes := Parse(strings.NewReader(template))
+		result, err := ProcessWithConfig(context.Background(), nodes, Config{
+			Platform:           platform,
+			ContextDir:         dir,
+			AppendArchitecture: true,
+			Resolver:           resolver,
+			Images:             strictImageResolver{"debian:bookworm": "sha256:index"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		anchored = append(anchored, AnchoredPlatform{
+			Platform: platform,
+			Nodes:    nodes,
+			Files:    result.Files,
+		})
+	}
+	return anchored
+}
+
+func writeNodes(t *testing.T, nodes Nodes) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := nodes.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestMergePlatforms(t *testing.T) {
+	template := `FROM debian:bookworm AS builder
+# tools
+RUN apt-get update \
+    && apt-get install -y curl git
+RUN echo done
+
+FROM debian:bookworm
+RUN apt-get update && apt-get install -y ca-certificates
+`
+	cases := []struct {
+		name      string
+		resolver  PackageResolver
+		platforms []string
+		expected  string
+	}{
+		{
+			"same versions",
+			sameVersionResolver{},
+			[]string{"amd64", "arm64"},
+			`# anchor platforms=linux/amd64,linux/arm64
+FROM debian:bookworm@sha256:index AS builder
+# tools
+RUN apt-get update \
+    && apt-get install -y curl=1.0 git=1.0
+RUN echo done
+
+FROM debian:bookworm@sha256:index
+RUN apt-get update && apt-get install -y ca-certificates=1.0
+`,
+		},
+		{
+			"versions for each platform",
+			&catalogResolver{},
+			[]string{"amd64", "arm64"},
+			`# anchor platforms=linux/amd64,linux/arm64
+FROM debian:bookworm@sha256:index AS builder
+ARG TARGETARCH
+# tools
+RUN case "${TARGETARCH}" in \
+      amd64) apt-get update \
+    && apt-get install -y curl=1.0-amd64 git=1.0-amd64 ;; \
+      arm64) apt-get update \
+    && apt-get install -y curl=1.0-arm64 git=1.0-arm64 ;; \
+      *) echo "${TARGETARCH} is not anchored" >&2 && exit 1 ;; \
+    esac
+RUN echo done
+
+FROM debian:bookworm@sha256:index
+ARG TARGETARCH
+RUN case "${TARGETARCH}" in \
+      amd64) apt-get update && apt-get install -y ca-certificates=1.0-amd64 ;; \
+      arm64) apt-get update && apt-get install -y ca-certificates=1.0-arm64 ;; \
+      *) echo "${TARGETARCH} is not anchored" >&2 && exit 1 ;; \
+    esac
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			anchored := anchorPlatforms(t, template, t.TempDir(), c.resolver, c.platforms...)
+			nodes, files, err := MergePlatforms(anchored)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if actual := writeNodes(t, nodes); actual != c.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", c.expected, actual)
+			}
+			if len(files) != 0 {
+				t.Errorf("Expected no files but got %v", files)
+			}
+		})
+	}
+}
+
+func TestMergePlatformsPackageLists(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"tools.txt": "curl\n",
+		"base.txt":  "ca-certificates\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	template := `FROM debian:bookworm
+COPY tools.txt /tmp/tools.txt
+RUN apt-get update && apt-get install -y $(cat /tmp/tools.txt)
+`
+	anchored := anchorPlatforms(t, template, dir, &catalogResolver{}, "amd64", "arm/v6", "arm/v7")
+	nodes, files, err := MergePlatforms(anchored)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := `# anchor platforms=linux/amd64,linux/arm/v6,linux/arm/v7
+FROM debian:bookworm@sha256:index
+ARG TARGETARCH
+ARG TARGETVARIANT
+COPY tools.${TARGETARCH}${TARGETVARIANT}.lock.txt /tmp/tools.txt
+RUN apt-get update && apt-get install -y $(cat /tmp/tools.txt)
+`
+	if actual := writeNodes(t, nodes); actual != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	paths := []string{}
+	for _, file := range files {
+		paths = append(paths, filepath.Base(file.Path))
+	}
+	expectedPaths := []string{"tools.amd64.lock.txt", "tools.armv6.lock.txt", "tools.armv7.lock.txt"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Expected %v but got %v", expectedPaths, paths)
+	}
+	// the pins of each platform are read from the merged lists
+	if err := os.WriteFile(files[1].Path, files[1].Content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := ReadPins(anchored[1].Nodes, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := pins.Packages["0"]["curl"]; version != "1.0-armel" {
+		t.Errorf("Expected curl to be pinned to 1.0-armel but got %s", version)
+	}
+
+	// a list pinned the same way for every platform is written once
+	anchored = anchorPlatforms(t, template, dir, sameVersionResolver{}, "amd64", "arm64")
+	nodes, files, err = MergePlatforms(anchored)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if !strings.Contains(writeNodes(t, nodes), "COPY tools.lock.txt /tmp/tools.txt\n") {
+		t.Errorf("Expected a single list to be copied but got:\n%s", writeNodes(t, nodes))
+	}
+	if len(files) != 1 || filepath.Base(files[0].Path) != "tools.lock.txt" {
+		t.Errorf("Expected a single list but got %v", files)
+	}
+}
+
+func TestMergePlatformsListNames(t *testing.T) {
+	platform := func(value string, architecture string) AnchoredPlatform {
+		p, err := ParsePlatform(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := fmt.Sprintf(`FROM debian@sha256:index
+COPY a.%[1]s.lock.txt /tmp/a.txt
+COPY lists/data.%[1]s.lock.txt /tmp/data.txt
+`, architecture)
+		return AnchoredPlatform{
+			Platform: p,
+			Nodes:    Parse(strings.NewReader(file)),
+			Files: []File{
+				{Path: "a." + architecture + ".lock.txt", Content: []byte("curl=1.0\n")},
+				{
+					Path:    filepath.Join("lists", "data."+architecture+".lock.txt"),
+					Content: []byte("git=1.0-" + architecture + "\n"),
+				},
+			},
+		}
+	}
+	platforms := []AnchoredPlatform{platform("amd64", "amd64"), platform("arm64", "arm64")}
+	nodes, _, err := MergePlatforms(platforms)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	// a.lock.txt is pinned the same way for every platform, data.lock.txt is not
+	expected := `# anchor platforms=linux/amd64,linux/arm64
+FROM debian@sha256:index
+COPY a.lock.txt /tmp/a.txt
+ARG TARGETARCH
+COPY lists/data.${TARGETARCH}.lock.txt /tmp/data.txt
+`
+	if actual := writeNodes(t, nodes); actual != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	expected = `FROM debian@sha256:index
+COPY a.lock.txt /tmp/a.txt
+COPY lists/data.arm64.lock.txt /tmp/data.txt
+`
+	if actual := writeNodes(t, platforms[1].Nodes); actual != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestMergedPlatforms(t *testing.T) {
+	template := `# syntax=docker/dockerfile:1
+FROM debian:bookworm
+RUN apt-get update && apt-get install -y curl
+`
+	anchored := anchorPlatforms(t, template, t.TempDir(), sameVersionResolver{}, "amd64", "arm64")
+	nodes, _, err := MergePlatforms(anchored)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	// parser directives must stay on the first line
+	expected := `# syntax=docker/dockerfile:1
+# anchor platforms=linux/amd64,linux/arm64
+FROM debian:bookworm@sha256:index
+RUN apt-get update && apt-get install -y curl=1.0
+`
+	if actual := writeNodes(t, nodes); actual != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	platforms := MergedPlatforms(nodes)
+	if !reflect.DeepEqual(platforms, []string{"linux/amd64", "linux/arm64"}) {
+		t.Errorf("Expected the merged platforms but got %v", platforms)
+	}
+	if platforms := MergedPlatforms(anchored[0].Nodes); platforms != nil {
+		t.Errorf("Expected no merged platforms but got %v", platforms)
+	}
+}
+
+func TestMergePlatformsErrors(t *testing.T) {
+	platform := func(value string, file string) AnchoredPlatform {
+		p, err := ParsePlatform(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return AnchoredPlatform{Platform: p, Nodes: Parse(strings.NewReader(file))}
+	}
+	cases := []struct {
+		name      string
+		platforms []AnchoredPlatform
+		expected  string
+	}{
+		{
+			"images",
+			[]AnchoredPlatform{
+				platform("amd64", "FROM debian@sha256:a\n"),
+				platform("arm64", "FROM debian@sha256:b\n"),
+			},
+			"FROM instruction on line 1 is anchored to different images",
+		},
+		{
+			"exec form",
+			[]AnchoredPlatform{
+				platform("amd64", "FROM debian\nRUN [\"apt-get\", \"install\", \"curl=1\"]\n"),
+				platform("arm64", "FROM debian\nRUN [\"apt-get\", \"install\", \"curl=2\"]\n"),
+			},
+			"can only be merged in shell form",
+		},
+		{
+			"templates",
+			[]AnchoredPlatform{
+				platform("amd64", "FROM debian\n"),
+				platform("arm64", "FROM debian\nUSER nobody\n"),
+			},
+			"were not anchored from the same template",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := MergePlatforms(c.platforms)
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("Expected an error containing %q but got %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestCheckMerged(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tools.txt"), []byte("git\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	template := `FROM debian:bookworm
+COPY tools.txt /tmp/tools.txt
+RUN apt-get update && apt-get install -y curl $(cat /tmp/tools.txt)
+RUN apt-get install -y ca-certificates
+`
+	anchored := anchorPlatforms(t, template, dir, &catalogResolver{}, "amd64", "arm/v6", "arm/v7")
+	nodes, files, err := MergePlatforms(anchored)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file.Path, file.Content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := Parse(strings.NewReader(writeNodes(t, nodes)))
+
+	armel := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+	pins, err := ReadPlatformPins(output, dir, armel)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := map[string]string{
+		"curl": "1.0-armel", "git": "1.0-armel", "ca-certificates": "1.0-armel",
+	}
+	if pins.Architecture != "armel" || !reflect.DeepEqual(pins.Packages["0"], expected) {
+		t.Errorf("Expected the pins of armel but got %s %v", pins.Architecture, pins.Packages)
+	}
+	dependencies, err := Outdated(context.Background(), output, Config{
+		Platform:           armel,
+		ContextDir:         dir,
+		AppendArchitecture: true,
+		Resolver:           sameVersionResolver{},
+		Images:             strictImageResolver{"debian:bookworm": "sha256:index"},
+		Output:             io.Discard,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if i := slices.IndexFunc(dependencies, func(dependency Dependency) bool {
+		return dependency.Name == "curl"
+	}); i < 0 || dependencies[i].Pinned != "1.0-armel" || dependencies[i].Latest != "1.0" {
+		t.Errorf("Expected curl to be outdated on armel but got %+v", dependencies)
+	}
+
+	check := func(template string) []Mismatch {
+		t.Helper()
+		mismatches, err := Check(
+			context.Background(),
+			Parse(strings.NewReader(template)),
+			output,
+			"Dockerfile",
+			Config{ContextDir: dir, Output: io.Discard},
+		)
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+		return mismatches
+	}
+	if mismatches := check(template); len(mismatches) > 0 {
+		t.Errorf("Expected no mismatches but got %v", mismatches)
+	}
+	mismatches := check(strings.Replace(template, "ca-certificates", "ca-certificates wget", 1))
+	if len(mismatches) != 1 || !strings.Contains(mismatches[0].Expected, "wget") {
+		t.Errorf("Expected wget to be missing but got %v", mismatches)
+	}
+}
@@ -0,0 +1,161 @@
+package anchor
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Dependency is an image or package pinned in an anchored Dockerfile, along with what it
+// would be pinned to if the Dockerfile was anchored again now.
+type Dependency struct {
+	// Kind is image or package
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+	// Architecture is the dpkg architecture of a package, empty for images, whose digest is
+	// that of every platform
+	Architecture string `json:"architecture,omitempty"`
+	// Pinned is the digest or version in the Dockerfile, empty when it is not pinned
+	Pinned string `json:"pinned"`
+	// Latest is the digest or version it would be pinned to now, empty when it can no longer
+	// be resolved
+	Latest string `json:"latest"`
+	// Error is why the latest version could not be resolved
+	Error string `json:"error,omitempty"`
+}
+
+// IsOutdated reports whether anchoring again would change the pin.
+func (d Dependency) IsOutdated() bool {
+	return d.Pinned != d.Latest
+}
+
+// Outdated compares the images and packages pinned in an anchored Dockerfile with the
+// digests and versions they would be anchored to now. Packages are resolved against the
+// latest digest of their base image. The nodes are not changed. For a Dockerfile merged by
+// MergePlatforms, the pins of config.Platform are compared.
+func Outdated(ctx context.Context, nodes []Node, config Config) ([]Dependency, error) {
+	if MergedPlatforms(nodes) != nil {
+		selected, err := selectPlatform(nodes, config.Platform)
+		if err != nil {
+			return nil, err
+		}
+		nodes = selected
+	}
+	pins, err := ReadPins(nodes, config.ContextDir)
+	if err != nil {
+		return nil, err
+	}
+	images := &recordingImageResolver{resolver: config.imageResolver(), digests: map[string]string{}}
+	packages := &recordingPackageResolver{resolver: config.packageResolver()}
+	config.Images = images
+	config.Resolver = packages
+	_, err = ProcessWithConfig(ctx, cloneNodes(nodes), config)
+	var resolutionError *ResolutionError
+	if err != nil && !errors.As(err, &resolutionError) {
+		return nil, err
+	}
+
+	dependencies := []Dependency{}
+	stages := 0
+	for i := range nodes {
+		node := &nodes[i]
+		if node.CommandType != CommandFrom {
+			continue
+		}
+		name := stageName(node, stages)
+		stages++
+		instruction, err := node.Instruction()
+		if err != nil {
+			continue
+		}
+		from, ok := instruction.(*FromInstruction)
+		if !ok {
+			continue
+		}
+		image, pinned := splitImageDigest(from.Image.Value)
+		if latest, ok := images.digests[image]; ok {
+			dependencies = append(dependencies, Dependency{
+				Kind:   "image",
+				Name:   image,
+				Stage:  name,
+				Pinned: pinned,
+				Latest: latest,
+			})
+		}
+	}
+	for i, request := range packages.requests {
+		resolution := packages.resolutions[i]
+		for _, pkg := range request.Packages {
+			dependency := Dependency{
+				Kind:         "package",
+				Name:         pkg,
+				Stage:        request.Stage,
+				Architecture: request.Architecture,
+				Pinned:       pins.Packages[request.Stage][pkg],
+			}
+			if _, version, ok := resolution.pin(pkg); ok {
+				dependency.Latest = version
+			}
+			if i := slices.IndexFunc(resolution.Failures, func(failure PackageFailure) bool {
+				return failure.Package == pkg
+			}); i >= 0 {
+				dependency.Error = resolution.Failures[i].Reason
+			}
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	return dependencies, nil
+}
+
+// cloneNodes parses a copy of the nodes, so that they can be processed without changing
+// the original.
+func cloneNodes(nodes []Node) Nodes {
+	var sb strings.Builder
+	for _, node := range nodes {
+		sb.WriteString(node.Source())
+	}
+	return Parse(strings.NewReader(sb.String()))
+}
+
+// recordingImageResolver records the digests resolved by another resolver, by image.
+type recordingImageResolver struct {
+	resolver ImageResolver
+	mu       sync.Mutex
+	digests  map[string]string
+}
+
+func (r *recordingImageResolver) ResolveImage(ctx context.Context, image string) (string, error) {
+	digest, err := r.resolver.ResolveImage(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.digests[image] = digest
+	return digest, nil
+}
+
+// recordingPackageResolver records the requests to another resolver and their resolutions.
+type recordingPackageResolver struct {
+	resolver    PackageResolver
+	mu          sync.Mutex
+	requests    []PackageRequest
+	resolutions []*Resolution
+}
+
+func (r *recordingPackageResolver) ResolvePackages(
+	ctx context.Context, request PackageRequest,
+) (*Resolution, error) {
+	resolution, err := r.resolver.ResolvePackages(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, request)
+	r.resolutions = append(r.resolutions, resolution)
+	return resolution, nil
+}
@@ -0,0 +1,55 @@
+package anchor
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestOutdated(t *testing.T) {
+	file := `FROM debian:bookworm@sha256:old AS builder
+RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y curl=7.88.1 wget=1.21.3
+FROM debian@sha256:digest
+RUN dpkg --add-architecture amd64 && apt-get update && apt-get install -y ca-certificates=20230311
+`
+	nodes := Parse(strings.NewReader(file))
+	images := &Pins{Images: map[string]string{"debian:bookworm": "sha256:new"}}
+	resolver := &failingResolver{failures: map[string]string{"wget": "package is not available for amd64"}}
+	dependencies, err := Outdated(context.Background(), nodes, Config{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		Resolver: resolver,
+		Images:   images,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := []Dependency{
+		{Kind: "image", Name: "debian:bookworm", Stage: "builder", Pinned: "sha256:old", Latest: "sha256:new"},
+		{Kind: "package", Name: "curl", Stage: "builder", Architecture: "amd64", Pinned: "7.88.1", Latest: "1.0"},
+		{
+			Kind:         "package",
+			Name:         "wget",
+			Stage:        "builder",
+			Architecture: "amd64",
+			Pinned:       "1.21.3",
+			Error:        "package is not available for amd64",
+		},
+		{
+			Kind:         "package",
+			Name:         "ca-certificates",
+			Stage:        "1",
+			Architecture: "amd64",
+			Pinned:       "20230311",
+			Latest:       "1.0",
+		},
+	}
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, dependencies)
+	}
+	if nodes[0].Source() != "FROM debian:bookworm@sha256:old AS builder\n" {
+		t.Errorf("Expected the nodes to be unchanged but got %v", nodes[0].Source())
+	}
+}
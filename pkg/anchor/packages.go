@@ -1,113 +1,418 @@
 package anchor
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"maps"
+	"path"
 	"slices"
 	"strings"
-
-	"github.com/fatih/color"
 )
 
+// aptRoot is the directory the apt files of the platform being resolved are placed under in
+// the resolution container.
+const aptRoot = "/anchor"
+
+// fetchPackageVersions runs apt as root in a native container of the image, configured with
+// the architecture and the apt files of the platform being resolved, so that its own
+// sources, such as ports.ubuntu.com, preferences and dpkg state are used without emulation.
+// The entrypoint of the image is replaced by the shell of the stage, and the environment of
+// the stage is set before apt runs.
 func fetchPackageVersions(
-	ctx context.Context, packages []string, architecture string, image string,
-) (map[string]string, error) {
-	var stdoutBuf, stderrBuf bytes.Buffer
-	command := "dpkg --add-architecture " + architecture + " && apt-get update && apt-cache show --"
-	for _, pkg := range packages {
-		command += " " + pkg + ":" + architecture
-	}
-	c := exec.CommandContext(
-		ctx, "docker", "run", "--rm", image, "bash", "-c", command,
-	) // #nosec G204
-	c.Stdout = &stdoutBuf
-	c.Stderr = &stderrBuf // Use a buffer to capture stderr output
-
-	if err := c.Run(); err != nil {
-		// Log stderr or handle it as needed
-		fmt.Fprintf(os.Stderr, "error running command: %s\n", stderrBuf.String())
-		return nil, fmt.Errorf("failed to run command: %w", err)
-	}
-
-	versions, err := parsePackageVersions(stdoutBuf.String())
+	ctx context.Context, runtime Runtime, request PackageRequest, files map[string][]byte,
+) (*Resolution, error) {
+	sourceParts := aptRoot + "/etc/apt/sources.list.d"
+	preferencesParts := aptRoot + "/etc/apt/preferences.d"
+	if len(request.Setup) > 0 {
+		sourceParts = setupSourceParts
+		preferencesParts = setupPreferencesParts
+	}
+	options := []string{
+		"-o APT::Architecture=" + request.Architecture,
+		"-o APT::Architectures=" + request.Architecture,
+		"-o Dir::Etc::SourceList=" + aptRoot + "/etc/apt/sources.list",
+		"-o Dir::Etc::SourceParts=" + sourceParts,
+		"-o Dir::Etc::Preferences=" + aptRoot + "/etc/apt/preferences",
+		"-o Dir::Etc::PreferencesParts=" + preferencesParts,
+		"-o Dir::State::Lists=/tmp/anchor-lists",
+	}
+	if _, ok := files["var/lib/dpkg/status"]; ok {
+		options = append(options, "-o Dir::State::status="+aptRoot+"/var/lib/dpkg/status")
+	}
+	aptOptions := strings.Join(options, " ")
+	script := ""
+	for _, assignment := range request.Environment {
+		script += "export " + assignment + "\n"
+	}
+	script += replaySetup(request.Setup)
+	script += "mkdir -p " + aptRoot + "/etc/apt/sources.list.d " + aptRoot + "/etc/apt/preferences.d" +
+		" /tmp/anchor-lists/partial" +
+		" && apt-get " + aptOptions + " update >&2" +
+		" && apt-cache " + aptOptions + " policy"
+	// packages installed with -t are resolved with it as the default release, so that apt
+	// gives the versions of the target release their priority
+	targets := map[string][]string{}
+	for _, pkg := range request.Packages {
+		target := request.TargetReleases[pkg]
+		// names can come from package lists, so they are quoted like the target release
+		targets[target] = append(targets[target], shellQuote(pkg))
+	}
+	missing := ""
+	for _, target := range slices.Sorted(maps.Keys(targets)) {
+		cacheOptions := aptOptions
+		if target != "" {
+			cacheOptions += " -o APT::Default-Release=" + shellQuote(target)
+		}
+		pkgs := strings.Join(targets[target], " ")
+		script += " && apt-cache " + cacheOptions + " policy -- " + pkgs
+		// a package apt has no version of is looked up separately, so that it does not fail
+		// the others, and its providers are listed in case it is a virtual package
+		missing += "for p in " + pkgs + "; do" +
+			" apt-cache " + aptOptions + " show -- \"$p\" >/dev/null 2>&1 && continue;" +
+			" providers=$(apt-cache " + aptOptions + " showpkg -- \"$p\" 2>/dev/null" +
+			" | sed '1,/^Reverse Provides:/d' | cut -d' ' -f1 | sort -u);" +
+			" echo \"Missing: $p:\" $providers;" +
+			" if [ -z \"$providers\" ]; then names=1;" +
+			" else apt-cache " + cacheOptions + " policy -- $providers; fi;" +
+			" done\n"
+	}
+	script += " || exit 1\n" + missing +
+		"[ -z \"$names\" ] || { echo 'Package names:'; apt-cache " + aptOptions + " pkgnames" +
+		" | sed 's/^/ /'; }\n"
+	containerFiles := map[string][]byte{}
+	for name, content := range files {
+		containerFiles[path.Join(aptRoot, name)] = content
+	}
+	shell := request.Shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+	output, err := runtime.Run(ctx, ContainerRun{
+		Image:      request.Image,
+		Entrypoint: shell,
+		User:       "0",
+		Command:    []string{script},
+		Files:      containerFiles,
+	})
 	if err != nil {
-		fmt.Printf("error parsing versions: %s\n", stderrBuf.String())
 		return nil, err
 	}
-	return versions, nil
+	return parsePackageVersions(string(output), request), nil
 }
 
-func parsePackageVersions(s string) (map[string]string, error) {
-	versions := make(map[string]string)
-	currentPackage := ""
-	color.Blue("\tParsing package versions...")
+// setupSourceParts and setupPreferencesParts are the directories the sources and
+// preferences of the platform being resolved are copied to in the resolution container,
+// together with those added by the repository setup.
+const (
+	setupSourceParts      = "/tmp/anchor-sources.list.d"
+	setupPreferencesParts = "/tmp/anchor-preferences.d"
+)
 
-	for _, line := range strings.Split(s, "\n") {
-		if strings.HasPrefix(line, "Package:") {
-			currentPackage = strings.Split(line, ": ")[1]
-			continue
+// replaySetup returns the script that runs the repository setup of a request in the
+// resolution container, and adds the sources and preferences it writes to those of the
+// platform being resolved. The setup runs for the architecture of the container, so
+// architecture restrictions are removed from the sources it adds. It is empty without setup.
+func replaySetup(setup []string) string {
+	if len(setup) == 0 {
+		return ""
+	}
+	script := "mkdir -p /tmp/anchor-before " + setupSourceParts + " " + setupPreferencesParts +
+		"; cp -a " + aptRoot + "/etc/apt/sources.list.d/. " + setupSourceParts + "/ 2>/dev/null" +
+		"; cp -a " + aptRoot + "/etc/apt/preferences.d/. " + setupPreferencesParts + "/ 2>/dev/null" +
+		"; cp -a /etc/apt/sources.list.d /etc/apt/preferences.d /tmp/anchor-before/ 2>/dev/null" +
+		"; cp /etc/apt/sources.list /tmp/anchor-before.list 2>/dev/null" +
+		"; touch /tmp/anchor-before.list\n"
+	for _, step := range setup {
+		script += "{\n" + step + "\n} >&2 || exit 1\n"
+	}
+	changed := func(dir string) string {
+		return "for f in /etc/apt/" + dir + "/*; do" +
+			" [ -f \"$f\" ] || continue;" +
+			" cmp -s \"$f\" \"/tmp/anchor-before/" + dir + "/${f##*/}\" ||"
+	}
+	script += changed("sources.list.d") +
+		" sed -e 's/arch=[^] ]*//' -e '/^Architectures:/d' \"$f\"" +
+		" > \"" + setupSourceParts + "/anchor-setup-${f##*/}\";" +
+		" done\n" +
+		changed("preferences.d") + " cp \"$f\" " + setupPreferencesParts + "/; done\n" +
+		"grep -vxF -f /tmp/anchor-before.list /etc/apt/sources.list 2>/dev/null" +
+		" | sed -e 's/arch=[^] ]*//' > " + setupSourceParts + "/anchor-setup.list\n"
+	return script
+}
+
+// parsePackageVersions resolves the requested packages from the output of the resolution
+// container.
+func parsePackageVersions(output string, request PackageRequest) *Resolution {
+	policy := parsePolicy(output)
+	return resolvePackages(request, aptCatalog{
+		versions:  func(pkg string) []aptVersion { return policy.Versions[pkg] },
+		providers: func(pkg string) []string { return policy.Providers[pkg] },
+		names:     func() []string { return policy.Names },
+	})
+}
+
+// packageInstall is a single package manager install invocation within a RUN command.
+type packageInstall struct {
+	Manager string
+	// Start is the offset of the install command in the script
+	Start int
+	// TargetRelease is the release set with -t, if any
+	TargetRelease string
+	// Packages are the package arguments of the install
+	Packages []shellWord
+	// ListFiles are the paths of files in the image the install reads package names from,
+	// e.g. apt-get install $(cat /tmp/packages.txt) or xargs apt-get install < packages.txt
+	ListFiles []shellWord
+}
+
+// commandWrappers are commands that run their arguments as another command, mapped to
+// their options which take a separate value.
+var commandWrappers = map[string][]string{
+	"sudo":    {"-u", "-g", "-h", "-p", "-C", "-D", "-U", "--user", "--group"},
+	"env":     {"-u", "-C", "--unset", "--chdir"},
+	"xargs":   {"-a", "-d", "-E", "-I", "-L", "-n", "-P", "-s", "--arg-file", "--delimiter"},
+	"nice":    {"-n", "--adjustment"},
+	"nohup":   {},
+	"time":    {},
+	"command": {},
+	"exec":    {},
+}
+
+// aptValueOptions are the apt-get options which take a separate value.
+var aptValueOptions = []string{
+	"-o", "-c", "-t", "--option", "--config-file", "--target-release", "--default-release",
+}
+
+// targetRelease returns the release an apt option selects as the target release, as with
+// -t bookworm-backports or -o APT::Default-Release=bookworm-backports.
+func targetRelease(option string, value string) (string, bool) {
+	switch option {
+	case "-t", "--target-release", "--default-release":
+		return value, true
+	case "-o", "--option":
+		key, release, _ := strings.Cut(value, "=")
+		if strings.EqualFold(key, "APT::Default-Release") {
+			return release, true
 		}
-		if strings.HasPrefix(line, "Version:") {
-			if currentPackage == "" {
-				return nil, fmt.Errorf("version found before package, offending line: %s", line)
-			}
+	}
+	return "", false
+}
 
-			if _, ok := versions[currentPackage]; ok {
-				// We have already seen this package, so we can skip it
-				currentPackage = ""
+// unwrapCommand strips wrapper commands such as sudo, env and xargs from the arguments of
+// a simple command, returning the arguments of the command that is actually run. It also
+// reports whether the command is run by xargs, and the files xargs reads with -a.
+func unwrapCommand(args []shellWord) ([]shellWord, bool, []shellWord) {
+	xargs := false
+	argFiles := []shellWord{}
+	for len(args) > 0 {
+		name, ok := args[0].literal()
+		if !ok {
+			break
+		}
+		name = path.Base(name)
+		valueOptions, isWrapper := commandWrappers[name]
+		if !isWrapper {
+			break
+		}
+		xargs = xargs || name == "xargs"
+		args = args[1:]
+		for len(args) > 0 {
+			arg, ok := args[0].literal()
+			if !ok {
+				break
+			}
+			if name == "env" && isAssignment(args[0]) {
+				args = args[1:]
 				continue
 			}
-			versions[currentPackage] = strings.Split(line, ": ")[1]
-			currentPackage = ""
+			if !strings.HasPrefix(arg, "-") {
+				break
+			}
+			args = args[1:]
+			if slices.Contains(valueOptions, arg) && len(args) > 0 {
+				if name == "xargs" && (arg == "-a" || arg == "--arg-file") {
+					argFiles = append(argFiles, args[0])
+				}
+				args = args[1:]
+			}
 		}
 	}
-	return versions, nil
+	return args, xargs, argFiles
 }
 
-func parseCommand(command string) []string {
-	commands := strings.Split(command, "&&")
-	packages := []string{}
-	for _, c := range commands {
-		components := strings.Split(c, " ")
-		var stripped []string
-		for _, part := range components {
-			part = strings.TrimSpace(part)
-			if part == "" {
-				continue
+// catFiles returns the files read by a cat command, e.g. cat /tmp/packages.txt.
+func catFiles(command *shellSimpleCommand) []shellWord {
+	if command == nil || len(command.Args) < 2 {
+		return nil
+	}
+	if name, ok := command.Args[0].literal(); !ok || path.Base(name) != "cat" {
+		return nil
+	}
+	files := []shellWord{}
+	for _, arg := range command.Args[1:] {
+		if value, ok := arg.literal(); ok && !strings.HasPrefix(value, "-") {
+			files = append(files, arg)
+		}
+	}
+	return files
+}
+
+// findInstalls walks the script and returns every apt install invocation, wherever it
+// occurs: in lists, pipelines, conditionals, loops, functions and command substitutions.
+func findInstalls(script *shellList) []packageInstall {
+	installs := []packageInstall{}
+	script.walk(func(command *shellSimpleCommand, input *shellSimpleCommand) {
+		if install, ok := parseInstall(command, input); ok {
+			installs = append(installs, install)
+		}
+	})
+	return installs
+}
+
+func parseInstall(command *shellSimpleCommand, input *shellSimpleCommand) (packageInstall, bool) {
+	args, xargs, argFiles := unwrapCommand(command.Args)
+	if len(args) == 0 {
+		return packageInstall{}, false
+	}
+	name, ok := args[0].literal()
+	manager := path.Base(name)
+	if !ok || (manager != "apt-get" && manager != "apt") {
+		return packageInstall{}, false
+	}
+	install := packageInstall{
+		Manager:   manager,
+		Start:     command.Args[0].Span.Start,
+		ListFiles: []shellWord{},
+	}
+	subcommand := ""
+	for i := 1; i < len(args); i++ {
+		arg, ok := args[i].literal()
+		if ok && strings.HasPrefix(arg, "-") {
+			value, hasValue := "", false
+			if slices.Contains(aptValueOptions, arg) && i+1 < len(args) {
+				i++
+				value, hasValue = args[i].literal()
+			} else if option, optionValue, found := strings.Cut(arg, "="); found {
+				arg, value, hasValue = option, optionValue, true
 			}
-			if part == "\\" {
-				continue
+			if hasValue {
+				if release, ok := targetRelease(arg, value); ok {
+					install.TargetRelease = release
+				}
 			}
-			if !strings.HasPrefix(part, "-") {
-				stripped = append(stripped, part)
+			continue
+		}
+		if subcommand == "" {
+			if !ok {
+				return packageInstall{}, false
 			}
+			subcommand = arg
+			continue
 		}
-		if len(stripped) < 3 {
+		if ok && isPackageFile(arg) {
+			// a local .deb is installed as it is, there is no version to anchor it to
 			continue
 		}
-		for i, part := range stripped {
-			if i == 0 {
-				if part != "apt-get" {
-					break
-				} else {
-					continue
-				}
+		install.Packages = append(install.Packages, args[i])
+		for _, part := range args[i].Parts {
+			if part.Kind == partCommandSubstitution {
+				install.ListFiles = append(install.ListFiles, catFiles(part.Script.single())...)
 			}
-			if i == 1 {
-				if part != "install" {
-					break
-				} else {
-					continue
-				}
-			}
-			if !slices.Contains(packages, part) {
-				packages = append(packages, part)
+		}
+	}
+	if xargs {
+		install.ListFiles = append(install.ListFiles, argFiles...)
+		install.ListFiles = append(install.ListFiles, catFiles(input)...)
+		for _, redirect := range command.Redirects {
+			if redirect.Op == "<" {
+				install.ListFiles = append(install.ListFiles, redirect.Target)
 			}
 		}
 	}
+	return install, subcommand == "install"
+}
 
+// installPackageNames returns the unique names of the packages installed, skipping any
+// which are ignored or not known until the command runs, e.g. $PACKAGES.
+func installPackageNames(installs []packageInstall, ignored []string) []string {
+	packages := []string{}
+	for _, install := range installs {
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if !ok {
+				continue
+			}
+			pkg := packageName(value)
+			if pkg == "" || slices.Contains(ignored, pkg) || slices.Contains(packages, pkg) {
+				continue
+			}
+			packages = append(packages, pkg)
+		}
+	}
 	return packages
 }
+
+// isPackageFile reports whether an install argument is the path of a package file rather than
+// the name of a package, e.g. ./local.deb, which apt installs when it starts with . or /.
+func isPackageFile(arg string) bool {
+	return strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/") ||
+		strings.HasSuffix(arg, ".deb")
+}
+
+// execWords converts the arguments of an exec form instruction into shell words so they
+// can be inspected like a shell form command.
+func execWords(args []Word) []shellWord {
+	words := make([]shellWord, 0, len(args))
+	for _, arg := range args {
+		inner := Span{Start: arg.Span.Start + 1, End: arg.Span.End - 1}
+		words = append(words, shellWord{
+			Span: arg.Span,
+			Parts: []shellPart{{
+				Kind:  partDoubleQuoted,
+				Span:  arg.Span,
+				Value: arg.Literal(),
+				Parts: []shellPart{{Kind: partLiteral, Span: inner, Value: arg.Literal()}},
+			}},
+		})
+	}
+	return words
+}
+
+// runInstalls returns the package installs of a RUN node in either shell or exec form.
+func runInstalls(node *Node) ([]packageInstall, error) {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return nil, err
+	}
+	run, ok := instruction.(*RunInstruction)
+	if !ok {
+		return nil, fmt.Errorf("node is not a RUN command")
+	}
+	if run.Exec {
+		install, ok := parseInstall(&shellSimpleCommand{Args: execWords(run.Args)}, nil)
+		if !ok {
+			return []packageInstall{}, nil
+		}
+		return []packageInstall{install}, nil
+	}
+	script, err := parseShell(run.Script)
+	if err != nil {
+		var syntaxError *shellSyntaxError
+		if errors.As(err, &syntaxError) {
+			line, column := node.Position(syntaxError.Offset)
+			return nil, fmt.Errorf("%d:%d: %w", line, column, err)
+		}
+		return nil, err
+	}
+	return findInstalls(script), nil
+}
+
+// parseCommand returns the packages installed by a shell script.
+func parseCommand(command string) []string {
+	script, err := parseShell(command)
+	if err != nil {
+		return []string{}
+	}
+	return installPackageNames(findInstalls(script), nil)
+}
@@ -37,6 +37,8 @@ type Node struct {
 	Entries     []Entry
 	CommandType commandType
 	Command     string
+	// Line is the 1-based line in the file the node starts on
+	Line int
 }
 
 func (n Nodes) Print() {
@@ -83,10 +85,12 @@ func (n *Node) appendLine(line []byte, entryType EntryType, beginning bool, stri
 
 func Parse(r io.Reader) Nodes {
 	scanner := bufio.NewScanner(r)
-	node := Node{}
+	lineNumber := 0
+	node := Node{Line: 1}
 	nodes := make([]Node, 0)
 	for scanner.Scan() {
 		line := scanner.Bytes()
+		lineNumber++
 
 		if isComment(line) {
 			node.appendLine(line, EntryComment, false)
@@ -111,6 +115,7 @@ func Parse(r io.Reader) Nodes {
 		isEndOfLine := isEndOfSection(line)
 		for !isEndOfLine && scanner.Scan() {
 			nextLine := scanner.Bytes()
+			lineNumber++
 			if isWhitespace(nextLine) {
 				node.appendLine(nextLine, EntryEmpty, false)
 				continue
@@ -125,7 +130,7 @@ func Parse(r io.Reader) Nodes {
 		}
 
 		nodes = append(nodes, node)
-		node = Node{}
+		node = Node{Line: lineNumber + 1}
 	}
 	return nodes
 }
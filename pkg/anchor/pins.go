@@ -0,0 +1,157 @@
+package anchor
+
+import (
+	"context"
+	"io"
+	"maps"
+	"strings"
+)
+
+// Pins are the image digests and package versions an anchored Dockerfile is pinned to. They
+// resolve images and packages to what the Dockerfile already uses, so its template can be
+// rendered again without a registry, a container runtime or the network.
+type Pins struct {
+	// Architecture is the dpkg architecture the packages were anchored for, empty when no
+	// packages were anchored
+	Architecture string
+	// Images are the digests images are anchored to, by reference without the digest
+	Images map[string]string
+	// Packages are the versions packages are anchored to, by stage name, or index for an
+	// unnamed stage, then package
+	Packages map[string]map[string]string
+	// Providers are the packages virtual packages are anchored to, by stage name, or index for
+	// an unnamed stage, then virtual package
+	Providers map[string]map[string]string
+	// Bases are the base images of the stages without their digests, by stage name, or index
+	// for an unnamed stage. A stage built on an earlier stage has the base image of that stage
+	Bases map[string]string
+	// Stages are the names of the stages, or indexes for unnamed stages, in order
+	Stages []string
+}
+
+// ReadPins reads the pins of an anchored Dockerfile, including the package lists it copies
+// from the build context.
+func ReadPins(nodes []Node, contextDir string) (*Pins, error) {
+	pins := &Pins{
+		Images:    map[string]string{},
+		Packages:  map[string]map[string]string{},
+		Providers: map[string]map[string]string{},
+		Bases:     map[string]string{},
+		Stages:    []string{},
+	}
+	current := newStage("", globalArgs(nodes))
+	stages := 0
+	// the base images of the named stages, which later stages can be built from
+	stageBases := map[string]string{"scratch": "scratch"}
+	for i := range nodes {
+		node := &nodes[i]
+		switch node.CommandType {
+		case CommandFrom:
+			current = newStage("", current.args)
+			current.name = stageName(node, stages)
+			pins.Stages = append(pins.Stages, current.name)
+			stages++
+			instruction, err := node.Instruction()
+			if err != nil {
+				continue
+			}
+			if from, ok := instruction.(*FromInstruction); ok {
+				image, digest := splitImageDigest(from.Image.Value)
+				if digest != "" {
+					pins.Images[image] = digest
+				}
+				if base, ok := stageBases[strings.ToLower(image)]; ok {
+					image = base
+				}
+				pins.Bases[current.name] = image
+				stageBases[strings.ToLower(current.name)] = image
+			}
+		case CommandRun:
+			if err := pins.readRun(node, contextDir, current); err != nil {
+				return nil, err
+			}
+		default:
+			current.apply(node)
+		}
+	}
+	return pins, nil
+}
+
+// readRun reads the versions of the packages installed by a RUN instruction.
+func (p *Pins) readRun(node *Node, contextDir string, stage *stage) error {
+	installs, err := runInstalls(node)
+	if err != nil {
+		return nil
+	}
+	if run, ok := nodeInstruction(node).(*RunInstruction); ok && !run.Exec {
+		if match := findDpkgPrefix(run.Script); match != nil {
+			p.Architecture = run.Script[match[2]:match[3]]
+		}
+	}
+	versions := p.Packages[stage.name]
+	if versions == nil {
+		versions = map[string]string{}
+		p.Packages[stage.name] = versions
+	}
+	if providers := nodeProviders(node); len(providers) > 0 {
+		if p.Providers[stage.name] == nil {
+			p.Providers[stage.name] = map[string]string{}
+		}
+		maps.Copy(p.Providers[stage.name], providers)
+	}
+	for _, install := range installs {
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if version := packageVersion(value); ok && version != "" {
+				versions[packageName(value)] = version
+			}
+		}
+	}
+	lists, err := readPackageLists(io.Discard, installs, contextDir, stage.copies)
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		for pkg, version := range list.versions() {
+			versions[pkg] = version
+		}
+	}
+	return nil
+}
+
+// ResolveImage returns the digest the image is anchored to, which is empty when it is not.
+func (p *Pins) ResolveImage(_ context.Context, image string) (string, error) {
+	return p.Images[image], nil
+}
+
+// ResolvePackages returns the versions the packages are anchored to in the stage of the
+// request. Packages that are not anchored are left out, so they stay unpinned.
+func (p *Pins) ResolvePackages(_ context.Context, request PackageRequest) (*Resolution, error) {
+	resolution := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	for _, pkg := range request.Packages {
+		name, version, ok := p.pin(request.Stage, pkg)
+		if !ok {
+			continue
+		}
+		if name != pkg {
+			resolution.Providers[pkg] = name
+		}
+		resolution.Versions[name] = version
+	}
+	return resolution, nil
+}
+
+// pin returns the package and version a package of a stage is anchored to, which is its
+// provider for a virtual package.
+func (p *Pins) pin(stage string, pkg string) (string, string, bool) {
+	name := pkg
+	if provider, ok := p.Providers[stage][pkg]; ok {
+		name = provider
+	}
+	version, ok := p.Packages[stage][name]
+	return name, version, ok
+}
@@ -0,0 +1,48 @@
+package anchor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPins(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "packages.lock.txt"), []byte("git=1:2.39.5\nmake\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins, err := ReadPins(Parse(strings.NewReader(testCheckOutput)), dir)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := &Pins{
+		Architecture: "arm64",
+		Images:       map[string]string{"debian:bookworm": "sha256:abc"},
+		Packages: map[string]map[string]string{
+			"builder": {"curl": "7.88.1", "git": "1:2.39.5"},
+			"1":       {"ca-certificates": "20230311"},
+		},
+		Providers: map[string]map[string]string{},
+		Bases:     map[string]string{"builder": "debian:bookworm", "1": "debian:bookworm"},
+		Stages:    []string{"builder", "1"},
+	}
+	if !reflect.DeepEqual(pins, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, pins)
+	}
+}
+
+func TestReadPinsUserArchitecture(t *testing.T) {
+	file := `FROM debian:bookworm
+RUN dpkg --add-architecture i386 && apt-get update && apt-get install -y wine32:i386
+`
+	pins, err := ReadPins(Parse(strings.NewReader(file)), t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if pins.Architecture != "" {
+		t.Errorf("Expected the architecture of the user's setup to be ignored, got %s", pins.Architecture)
+	}
+}
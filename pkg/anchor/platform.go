@@ -0,0 +1,241 @@
+package anchor
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// dpkgArchitectures maps OCI architectures, with their variant where it matters, to the
+// architecture names used by Debian and Ubuntu.
+var dpkgArchitectures = map[string]string{
+	"amd64":    "amd64",
+	"arm64":    "arm64",
+	"arm/v5":   "armel",
+	"arm/v6":   "armel",
+	"arm/v7":   "armhf",
+	"386":      "i386",
+	"ppc64le":  "ppc64el",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+	"loong64":  "loong64",
+}
+
+// ParsePlatform parses a platform such as amd64, arm/v7 or linux/arm64/v8. The OS defaults to
+// linux, the only OS apt packages can be anchored for, and arm defaults to arm/v7 as it does
+// for docker.
+func ParsePlatform(s string) (v1.Platform, error) {
+	s = strings.TrimSpace(s)
+	osName, _, _ := strings.Cut(s, "/")
+	if !slices.Contains([]string{"linux", "windows", "darwin", "freebsd"}, osName) {
+		s = "linux/" + s
+	}
+	parsed, err := v1.ParsePlatform(s)
+	if err != nil {
+		return v1.Platform{}, err
+	}
+	platform := *parsed
+	if platform.OS != "linux" {
+		return v1.Platform{}, fmt.Errorf("unsupported platform %s: only linux is supported", s)
+	}
+	if platform.Architecture == "arm" && platform.Variant == "" {
+		platform.Variant = "v7"
+	}
+	if _, err := DpkgArchitecture(platform); err != nil {
+		return v1.Platform{}, err
+	}
+	return platform, nil
+}
+
+// DpkgArchitecture returns the Debian architecture name of a platform, e.g. armhf for
+// linux/arm/v7 and ppc64el for linux/ppc64le.
+func DpkgArchitecture(platform v1.Platform) (string, error) {
+	key := platform.Architecture
+	if key == "arm" {
+		key += "/" + platform.Variant
+	}
+	architecture, ok := dpkgArchitectures[key]
+	if !ok {
+		return "", fmt.Errorf("unsupported platform: %s", platform.String())
+	}
+	return architecture, nil
+}
+
+// DpkgPlatform returns the platform of a Debian architecture name, e.g. linux/arm/v7 for
+// armhf. armel is linux/arm/v5, as Debian publishes it.
+func DpkgPlatform(architecture string) (v1.Platform, error) {
+	for _, key := range slices.Sorted(maps.Keys(dpkgArchitectures)) {
+		if dpkgArchitectures[key] == architecture {
+			return ParsePlatform(key)
+		}
+	}
+	return v1.Platform{}, fmt.Errorf("unsupported architecture: %s", architecture)
+}
+
+// ImagePlatforms returns the linux platforms in the manifest index of an image, or the
+// platform of the image when it is not an index.
+func ImagePlatforms(ctx context.Context, image string) ([]v1.Platform, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(
+		ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image %s: %w", image, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		return []v1.Platform{*config.Platform()}, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	platforms := []v1.Platform{}
+	for _, child := range manifest.Manifests {
+		// attestation manifests are listed with an unknown platform
+		if child.Platform == nil || child.Platform.OS != "linux" {
+			continue
+		}
+		platforms = append(platforms, *child.Platform)
+	}
+	return platforms, nil
+}
+
+// BaseImages returns the images the stages of a Dockerfile are built from, leaving out
+// scratch, earlier stages, images set with build args and images ignored with an anchor
+// ignore comment.
+func BaseImages(nodes []Node) []string {
+	images := []string{}
+	stages := []string{"scratch"}
+	for i := range nodes {
+		node := &nodes[i]
+		if node.CommandType != CommandFrom {
+			continue
+		}
+		instruction, err := node.Instruction()
+		if err != nil {
+			continue
+		}
+		from, ok := instruction.(*FromInstruction)
+		if !ok {
+			continue
+		}
+		image, _ := splitImageDigest(from.Image.Value)
+		ignored, all := nodeIgnores(node)
+		external := !all && !slices.Contains(ignored, image) &&
+			!slices.Contains(ignored, from.Image.Value) &&
+			!slices.Contains(stages, strings.ToLower(image)) &&
+			!strings.Contains(image, "$")
+		if external && !slices.Contains(images, from.Image.Value) {
+			images = append(images, from.Image.Value)
+		}
+		if !from.Alias.IsZero() {
+			stages = append(stages, strings.ToLower(from.Alias.Value))
+		}
+	}
+	return images
+}
+
+// ResolvePlatforms returns the platforms to anchor the Dockerfile to. The value all selects
+// every supported platform that all base images are available for. Otherwise each requested
+// platform must be in the manifest index of every base image, so that a missing platform
+// fails before anything is resolved.
+func ResolvePlatforms(
+	ctx context.Context, nodes []Node, requested []string,
+) ([]v1.Platform, error) {
+	imagePlatforms := func(image string) ([]v1.Platform, error) {
+		return ImagePlatforms(ctx, image)
+	}
+	return resolvePlatforms(requested, BaseImages(nodes), imagePlatforms)
+}
+
+func resolvePlatforms(
+	requested []string,
+	images []string,
+	imagePlatforms func(image string) ([]v1.Platform, error),
+) ([]v1.Platform, error) {
+	available := map[string][]v1.Platform{}
+	for _, image := range images {
+		platforms, err := imagePlatforms(image)
+		if err != nil {
+			return nil, err
+		}
+		available[image] = platforms
+	}
+	supports := func(image string, platform v1.Platform) bool {
+		return slices.ContainsFunc(available[image], func(p v1.Platform) bool {
+			return p.Satisfies(platform)
+		})
+	}
+
+	if len(requested) == 1 && requested[0] == "all" {
+		if len(images) == 0 {
+			return nil, fmt.Errorf("cannot anchor all platforms without a base image")
+		}
+		platforms := []v1.Platform{}
+		architectures := []string{}
+		for _, platform := range available[images[0]] {
+			architecture, err := DpkgArchitecture(platform)
+			if err != nil || slices.Contains(architectures, architecture) {
+				continue
+			}
+			if !slices.ContainsFunc(images, func(image string) bool {
+				return !supports(image, platform)
+			}) {
+				platforms = append(platforms, platform)
+				architectures = append(architectures, architecture)
+			}
+		}
+		if len(platforms) == 0 {
+			return nil, fmt.Errorf("the base images do not have a supported platform in common")
+		}
+		return platforms, nil
+	}
+
+	platforms := []v1.Platform{}
+	for _, value := range requested {
+		platform, err := ParsePlatform(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			if supports(image, platform) {
+				continue
+			}
+			names := []string{}
+			for _, p := range available[image] {
+				names = append(names, p.String())
+			}
+			return nil, fmt.Errorf(
+				"platform %s is not in the manifest index of %s, it has %s",
+				platform.String(),
+				image,
+				strings.Join(names, ", "),
+			)
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
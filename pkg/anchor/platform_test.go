@@ -0,0 +1,125 @@
+package anchor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	cases := []struct {
+		value        string
+		platform     string
+		architecture string
+	}{
+		{"amd64", "linux/amd64", "amd64"},
+		{"arm64", "linux/arm64", "arm64"},
+		{"linux/arm64/v8", "linux/arm64/v8", "arm64"},
+		{"linux/arm/v7", "linux/arm/v7", "armhf"},
+		{"arm", "linux/arm/v7", "armhf"},
+		{"arm/v6", "linux/arm/v6", "armel"},
+		{"linux/386", "linux/386", "i386"},
+		{"ppc64le", "linux/ppc64le", "ppc64el"},
+		{"s390x", "linux/s390x", "s390x"},
+		{"riscv64", "linux/riscv64", "riscv64"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.value, func(t *testing.T) {
+			platform, err := ParsePlatform(tc.value)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if platform.String() != tc.platform {
+				t.Errorf("Expected %v but got %v", tc.platform, platform.String())
+			}
+			architecture, err := DpkgArchitecture(platform)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if architecture != tc.architecture {
+				t.Errorf("Expected %v but got %v", tc.architecture, architecture)
+			}
+		})
+	}
+
+	for _, value := range []string{"windows/amd64", "sparc", "arm/v9"} {
+		if _, err := ParsePlatform(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestBaseImages(t *testing.T) {
+	file := `FROM golang:1.23 AS builder
+FROM builder AS test
+# anchor ignore
+FROM internal/tools:latest AS tools
+FROM scratch
+FROM debian:bookworm@sha256:abc
+FROM golang:1.23
+`
+	actual := BaseImages(Parse(strings.NewReader(file)))
+	expected := []string{"golang:1.23", "debian:bookworm@sha256:abc"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestResolvePlatforms(t *testing.T) {
+	platform := func(value string) v1.Platform {
+		parsed, err := v1.ParsePlatform(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *parsed
+	}
+	available := map[string][]v1.Platform{
+		"debian:bookworm": {
+			platform("linux/amd64"),
+			platform("linux/arm/v7"),
+			platform("linux/arm64/v8"),
+			platform("linux/s390x"),
+			platform("unknown/unknown"),
+		},
+		"golang:1.23": {
+			platform("linux/amd64"),
+			platform("linux/arm64/v8"),
+			platform("linux/s390x"),
+			platform("windows/amd64"),
+		},
+	}
+	imagePlatforms := func(image string) ([]v1.Platform, error) {
+		return available[image], nil
+	}
+	images := []string{"debian:bookworm", "golang:1.23"}
+
+	platforms, err := resolvePlatforms([]string{"all"}, images, imagePlatforms)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	names := []string{}
+	for _, p := range platforms {
+		names = append(names, p.String())
+	}
+	expected := []string{"linux/amd64", "linux/arm64/v8", "linux/s390x"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v but got %v", expected, names)
+	}
+
+	platforms, err = resolvePlatforms([]string{"amd64", "arm64"}, images, imagePlatforms)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(platforms) != 2 || platforms[1].Architecture != "arm64" {
+		t.Errorf("Unexpected platforms %v", platforms)
+	}
+
+	_, err = resolvePlatforms([]string{"amd64", "arm/v7"}, images, imagePlatforms)
+	if err == nil || !strings.HasPrefix(
+		err.Error(), "platform linux/arm/v7 is not in the manifest index of golang:1.23",
+	) {
+		t.Errorf("Expected a missing platform error but got %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package anchor
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// aptRelease describes the release a package file belongs to, as read from the Release file
+// of its suite. Target releases, package/release suffixes and preferences match against it.
+type aptRelease struct {
+	// Archive is the suite of the release, e.g. stable or bookworm-backports
+	Archive  string
+	Codename string
+	Version  string
+	Origin   string
+	Label    string
+	// Component is the component of the package file, e.g. main
+	Component string
+	// Site is the host the package file is downloaded from, empty for installed packages
+	Site string
+	// NotAutomatic releases, such as experimental, are not installed from unless asked for,
+	// and ButAutomaticUpgrades releases, such as backports, only upgrade what they installed
+	NotAutomatic         bool
+	ButAutomaticUpgrades bool
+}
+
+// installedRelease is the release of the dpkg status file.
+var installedRelease = aptRelease{Archive: "now"}
+
+// matches reports whether the release is the one named by -t or a package/release suffix,
+// which may be its archive, codename or version.
+func (r aptRelease) matches(release string) bool {
+	return release != "" &&
+		(release == r.Archive || release == r.Codename || release == r.Version)
+}
+
+// parseRelease parses a Release file, falling back to the suite for fields it lacks.
+func parseRelease(content []byte, suite string) aptRelease {
+	release := aptRelease{Archive: strings.TrimSuffix(suite, "/")}
+	stanzas := parseStanzas(content)
+	if len(stanzas) == 0 {
+		return release
+	}
+	stanza := stanzas[0]
+	if stanza["Suite"] != "" {
+		release.Archive = stanza["Suite"]
+	}
+	release.Codename = stanza["Codename"]
+	release.Version = stanza["Version"]
+	release.Origin = stanza["Origin"]
+	release.Label = stanza["Label"]
+	release.NotAutomatic = stanza["NotAutomatic"] == "yes"
+	release.ButAutomaticUpgrades = stanza["ButAutomaticUpgrades"] == "yes"
+	return release
+}
+
+// parseReleaseAttributes parses the release attributes apt-cache policy prints for a
+// package file, e.g. o=Debian,a=stable,n=bookworm,l=Debian,c=main,b=amd64.
+func parseReleaseAttributes(value string) aptRelease {
+	release := aptRelease{}
+	for _, attribute := range strings.Split(value, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch key {
+		case "a":
+			release.Archive = value
+		case "n":
+			release.Codename = value
+		case "v":
+			release.Version = value
+		case "o":
+			release.Origin = value
+		case "l":
+			release.Label = value
+		case "c":
+			release.Component = value
+		}
+	}
+	return release
+}
+
+// aptPreference is a pin from /etc/apt/preferences or /etc/apt/preferences.d.
+type aptPreference struct {
+	// Packages are the names, globs or /regular expressions/ the pin applies to
+	Packages []string
+	// Pin is the release, version or origin the pin matches, e.g. release n=bookworm
+	Pin      string
+	Priority int
+}
+
+// parsePreferences returns the pins of the preferences files of an image, in the order apt
+// reads them. Files are keyed by their path without the leading slash.
+func parsePreferences(files map[string][]byte) []aptPreference {
+	contents := [][]byte{files["etc/apt/preferences"]}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		ext := path.Ext(name)
+		if path.Dir(name) == "etc/apt/preferences.d" && (ext == "" || ext == ".pref") {
+			contents = append(contents, files[name])
+		}
+	}
+	preferences := []aptPreference{}
+	for _, content := range contents {
+		for _, stanza := range parseStanzas(content) {
+			priority, err := strconv.Atoi(stanza["Pin-Priority"])
+			if err != nil || stanza["Package"] == "" || stanza["Pin"] == "" {
+				continue
+			}
+			preferences = append(preferences, aptPreference{
+				Packages: strings.Fields(stanza["Package"]),
+				Pin:      stanza["Pin"],
+				Priority: priority,
+			})
+		}
+	}
+	return preferences
+}
+
+// general reports whether the pin applies to every package.
+func (p aptPreference) general() bool {
+	return len(p.Packages) == 1 && p.Packages[0] == "*"
+}
+
+func (p aptPreference) matchesPackage(name string) bool {
+	return slices.ContainsFunc(p.Packages, func(pattern string) bool {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			return err == nil && re.MatchString(name)
+		}
+		return globMatch(pattern, name)
+	})
+}
+
+// matchesRelease reports whether a release or origin pin matches a package file.
+func (p aptPreference) matchesRelease(release aptRelease) bool {
+	kind, value, _ := strings.Cut(p.Pin, " ")
+	value = strings.TrimSpace(value)
+	switch kind {
+	case "origin":
+		return release != installedRelease && globMatch(strings.Trim(value, `"`), release.Site)
+	case "release":
+		if value == "*" {
+			return true
+		}
+		if !strings.Contains(value, "=") {
+			// a bare value is the archive or codename, or the version when it is numeric
+			if value != "" && value[0] >= '0' && value[0] <= '9' {
+				return globMatch(value, release.Version)
+			}
+			return globMatch(value, release.Archive) || globMatch(value, release.Codename)
+		}
+		for _, attribute := range strings.Split(value, ",") {
+			key, expected, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+			actual := map[string]string{
+				"a": release.Archive,
+				"n": release.Codename,
+				"v": release.Version,
+				"o": release.Origin,
+				"l": release.Label,
+				"c": release.Component,
+			}[key]
+			if key != "b" && !globMatch(expected, actual) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchesVersion reports whether the pin matches a version of a package, which is in the
+// package files of the releases.
+func (p aptPreference) matchesVersion(version string, releases []aptRelease) bool {
+	kind, value, _ := strings.Cut(p.Pin, " ")
+	if kind == "version" {
+		return globMatch(strings.TrimSpace(value), version)
+	}
+	return slices.ContainsFunc(releases, p.matchesRelease)
+}
+
+func globMatch(pattern string, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// aptVersion is a version of a package with its pin priority, and the releases of the
+// package files it is available from.
+type aptVersion struct {
+	Version   string
+	Priority  int
+	Installed bool
+	Releases  []aptRelease
+}
+
+// versionPriority returns the pin priority apt gives a version of a package. The first pin
+// for the package that matches the version wins. Otherwise the version has the highest
+// priority of its package files, which is that of the first general pin matching the file,
+// 990 for the target release, 100 for installed packages, 100 or 1 for releases that are
+// not automatic and 500 for the rest.
+func versionPriority(
+	pkg string, version aptVersion, target string, preferences []aptPreference,
+) int {
+	for _, preference := range preferences {
+		if !preference.general() && preference.matchesPackage(pkg) &&
+			preference.matchesVersion(version.Version, version.Releases) {
+			return preference.Priority
+		}
+	}
+	priority := 0
+	for i, release := range version.Releases {
+		filePriority := 500
+		switch {
+		case release == installedRelease:
+			filePriority = 100
+		case release.matches(target):
+			filePriority = 990
+		case release.NotAutomatic && release.ButAutomaticUpgrades:
+			filePriority = 100
+		case release.NotAutomatic:
+			filePriority = 1
+		}
+		for _, preference := range preferences {
+			if preference.general() && preference.matchesVersion(version.Version, []aptRelease{release}) {
+				filePriority = preference.Priority
+				break
+			}
+		}
+		if i == 0 || filePriority > priority {
+			priority = filePriority
+		}
+	}
+	return priority
+}
+
+// candidateVersion returns the version apt would install. A package/release suffix selects
+// the highest version of that release. Otherwise the version with the highest priority is
+// chosen, the highest version among equals, and a version older than the installed one
+// needs a priority of at least 1000 to be chosen. Versions with a negative priority are
+// never chosen.
+func candidateVersion(versions []aptVersion, release string) (string, bool) {
+	sorted := slices.Clone(versions)
+	slices.SortStableFunc(sorted, func(a aptVersion, b aptVersion) int {
+		return CompareDebianVersions(b.Version, a.Version)
+	})
+	if release != "" {
+		for _, version := range sorted {
+			if slices.ContainsFunc(version.Releases, func(r aptRelease) bool {
+				return r.matches(release)
+			}) {
+				return version.Version, true
+			}
+		}
+		return "", false
+	}
+
+	installed := ""
+	for _, version := range sorted {
+		if version.Installed {
+			installed = version.Version
+		}
+	}
+	var candidate *aptVersion
+	for i, version := range sorted {
+		if version.Priority < 0 {
+			continue
+		}
+		if installed != "" && version.Priority < 1000 &&
+			CompareDebianVersions(version.Version, installed) < 0 {
+			continue
+		}
+		if candidate == nil || version.Priority > candidate.Priority {
+			candidate = &sorted[i]
+		}
+	}
+	if candidate == nil {
+		return "", false
+	}
+	return candidate.Version, true
+}
+
+// candidateReason explains why apt chooses the candidate version of a package, as returned
+// by candidateVersion for the same versions and release.
+func candidateReason(versions []aptVersion, release string, candidate string) string {
+	if release != "" {
+		return fmt.Sprintf("the newest version in the release %s", release)
+	}
+	i := slices.IndexFunc(versions, func(version aptVersion) bool {
+		return version.Version == candidate
+	})
+	if i < 0 {
+		return ""
+	}
+	chosen := versions[i]
+	reason := fmt.Sprintf("priority %d from %s", chosen.Priority, releaseNames(chosen.Releases))
+	newest := chosen
+	for _, version := range versions {
+		if CompareDebianVersions(version.Version, newest.Version) > 0 {
+			newest = version
+		}
+	}
+	switch {
+	case len(versions) == 1:
+		reason = "the only version, " + reason
+	case newest.Version != chosen.Version && newest.Priority < 0:
+		reason += fmt.Sprintf(", %s is never installed as its priority is negative", newest.Version)
+	case newest.Version != chosen.Version:
+		reason += fmt.Sprintf(", higher than the %d of the newer %s", newest.Priority, newest.Version)
+	default:
+		reason = "the newest version, " + reason
+	}
+	if chosen.Installed {
+		reason += ", installed in the base image"
+	}
+	return reason
+}
+
+// releaseNames returns the names of the releases a version is available from, e.g.
+// bookworm-updates, for explaining candidates.
+func releaseNames(releases []aptRelease) string {
+	names := []string{}
+	for _, release := range releases {
+		name := release.Codename
+		switch {
+		case release == installedRelease:
+			name = "the dpkg status"
+		case name == "":
+			name = release.Archive
+		}
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "an unknown release"
+	}
+	return strings.Join(names, ", ")
+}
+
+// aptPolicy is what the resolution container reports about the requested packages.
+type aptPolicy struct {
+	// Versions are the versions of each package
+	Versions map[string][]aptVersion
+	// Providers are the packages that provide each requested package apt has no version of
+	Providers map[string][]string
+	// Names are the names of every package apt knows, listed when a package has neither a
+	// version nor a provider
+	Names []string
+}
+
+// parsePolicy parses the output of apt-cache policy, with and without packages, into the
+// versions of each package. The package files listed without packages give the releases of
+// the files in the version tables. Lines such as "Missing: mail-transport-agent: exim4"
+// list the providers of packages without a version, and the names apt-cache pkgnames
+// prints follow "Package names:".
+func parsePolicy(output string) aptPolicy {
+	files := map[string]aptRelease{}
+	policy := aptPolicy{
+		Versions:  map[string][]aptVersion{},
+		Providers: map[string][]string{},
+		Names:     []string{},
+	}
+	packages := policy.Versions
+	section, file, pkg := "", "", ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if line[0] != ' ' {
+			section, pkg = "", ""
+			switch {
+			case line == "Package files:" || line == "Pinned packages:" || line == "Package names:":
+				section = line
+			case fields[0] == "Missing:" && len(fields) > 1:
+				missing := strings.TrimSuffix(fields[1], ":")
+				policy.Providers[missing] = fields[2:]
+			default:
+				if strings.HasSuffix(line, ":") && len(fields) == 1 {
+					pkg = strings.TrimSuffix(line, ":")
+					packages[pkg] = []aptVersion{}
+				}
+			}
+			continue
+		}
+		switch {
+		case section == "Package names:":
+			policy.Names = append(policy.Names, fields[0])
+		case section == "Package files:":
+			if _, err := strconv.Atoi(fields[0]); err == nil && len(fields) > 1 {
+				file = strings.Join(fields[1:], " ")
+				files[file] = policyFileRelease(fields[1:])
+				continue
+			}
+			release := files[file]
+			switch fields[0] {
+			case "release":
+				attributes := parseReleaseAttributes(strings.Join(fields[1:], " "))
+				attributes.Site = release.Site
+				release = attributes
+			case "origin":
+				if len(fields) > 1 {
+					release.Site = fields[1]
+				}
+			}
+			files[file] = release
+		case pkg != "":
+			versions := packages[pkg]
+			installed := fields[0] == "***"
+			if installed {
+				fields = fields[1:]
+			}
+			if len(fields) == 2 {
+				if priority, err := strconv.Atoi(fields[1]); err == nil {
+					packages[pkg] = append(versions, aptVersion{
+						Version:   fields[0],
+						Priority:  priority,
+						Installed: installed,
+					})
+					continue
+				}
+			}
+			if _, err := strconv.Atoi(fields[0]); err != nil || len(versions) == 0 {
+				continue
+			}
+			key := strings.Join(fields[1:], " ")
+			release, ok := files[key]
+			if !ok {
+				release = policyFileRelease(fields[1:])
+			}
+			last := &versions[len(versions)-1]
+			last.Releases = append(last.Releases, release)
+		}
+	}
+	return policy
+}
+
+// policyFileRelease returns the release of a package file listed by apt-cache policy, such
+// as http://deb.debian.org/debian bookworm/main amd64 Packages, before its release line.
+func policyFileRelease(fields []string) aptRelease {
+	if len(fields) == 1 && fields[0] == "/var/lib/dpkg/status" {
+		return installedRelease
+	}
+	release := aptRelease{}
+	if len(fields) > 1 {
+		release.Archive, release.Component, _ = strings.Cut(fields[1], "/")
+	}
+	return release
+}
@@ -0,0 +1,292 @@
+package anchor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+var (
+	testBookworm  = aptRelease{Archive: "stable", Codename: "bookworm", Component: "main"}
+	testBackports = aptRelease{
+		Archive:              "stable-backports",
+		Codename:             "bookworm-backports",
+		Component:            "main",
+		NotAutomatic:         true,
+		ButAutomaticUpgrades: true,
+	}
+	testExperimental = aptRelease{Archive: "experimental", Codename: "rc-buggy", NotAutomatic: true}
+)
+
+func TestVersionPriority(t *testing.T) {
+	preferences := parsePreferences(map[string][]byte{
+		"etc/apt/preferences": []byte(`Package: *
+Pin: release a=experimental
+Pin-Priority: 50
+`),
+		"etc/apt/preferences.d/curl": []byte(`Explanation: curl from backports
+Package: curl libcurl*
+Pin: release n=bookworm-backports
+Pin-Priority: 600
+`),
+		"etc/apt/preferences.d/ignored.txt": []byte(`Package: *
+Pin: release *
+Pin-Priority: -1
+`),
+	})
+	cases := []struct {
+		name     string
+		pkg      string
+		releases []aptRelease
+		target   string
+		expected int
+	}{
+		{"default", "wget", []aptRelease{testBookworm}, "", 500},
+		{"installed", "wget", []aptRelease{installedRelease}, "", 100},
+		{"backports", "wget", []aptRelease{testBackports}, "", 100},
+		{"target release", "wget", []aptRelease{testBackports}, "bookworm-backports", 990},
+		{"general pin", "wget", []aptRelease{testExperimental}, "", 50},
+		{"specific pin", "libcurl4", []aptRelease{testBackports}, "", 600},
+		{"highest file", "wget", []aptRelease{installedRelease, testBookworm}, "", 500},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			version := aptVersion{Version: "1.0", Releases: tc.releases}
+			actual := versionPriority(tc.pkg, version, tc.target, preferences)
+			if actual != tc.expected {
+				t.Errorf("Expected %d but got %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCandidateVersion(t *testing.T) {
+	versions := []aptVersion{
+		{Version: "7.88.1-10+deb12u5", Priority: 500, Releases: []aptRelease{testBookworm}},
+		{Version: "8.11.1-1~bpo12+1", Priority: 100, Releases: []aptRelease{testBackports}},
+		{Version: "7.88.1-10", Priority: 100, Installed: true},
+	}
+	cases := []struct {
+		name     string
+		versions []aptVersion
+		release  string
+		expected string
+	}{
+		{"highest priority", versions, "", "7.88.1-10+deb12u5"},
+		{"release suffix", versions, "bookworm-backports", "8.11.1-1~bpo12+1"},
+		{"archive suffix", versions, "stable-backports", "8.11.1-1~bpo12+1"},
+		{
+			"no downgrade",
+			[]aptVersion{
+				{Version: "7.88.1-10+deb12u5", Priority: 500},
+				{Version: "8.11.1-1~bpo12+1", Priority: 100, Installed: true},
+			},
+			"",
+			"8.11.1-1~bpo12+1",
+		},
+		{
+			"forced downgrade",
+			[]aptVersion{
+				{Version: "7.88.1-10+deb12u5", Priority: 1001},
+				{Version: "8.11.1-1~bpo12+1", Priority: 100, Installed: true},
+			},
+			"",
+			"7.88.1-10+deb12u5",
+		},
+		{
+			"highest version among equals",
+			[]aptVersion{
+				{Version: "1:1.0", Priority: 500},
+				{Version: "2.0", Priority: 500},
+				{Version: "3.0", Priority: -1},
+			},
+			"",
+			"1:1.0",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, ok := candidateVersion(tc.versions, tc.release)
+			if !ok || actual != tc.expected {
+				t.Errorf("Expected %s but got %s", tc.expected, actual)
+			}
+		})
+	}
+	if _, ok := candidateVersion(versions, "trixie"); ok {
+		t.Errorf("Expected no candidate for a release the package is not in")
+	}
+}
+
+func TestCandidateReason(t *testing.T) {
+	versions := []aptVersion{
+		{Version: "7.88.1-10+deb12u5", Priority: 500, Releases: []aptRelease{testBookworm}},
+		{Version: "8.11.1-1~bpo12+1", Priority: 100, Releases: []aptRelease{testBackports}},
+		{Version: "7.88.1-10", Priority: 100, Installed: true, Releases: []aptRelease{installedRelease}},
+	}
+	cases := []struct {
+		name     string
+		versions []aptVersion
+		release  string
+		expected string
+	}{
+		{
+			"higher priority than a newer version",
+			versions,
+			"",
+			"priority 500 from bookworm, higher than the 100 of the newer 8.11.1-1~bpo12+1",
+		},
+		{
+			"release suffix",
+			versions,
+			"bookworm-backports",
+			"the newest version in the release bookworm-backports",
+		},
+		{
+			"only version",
+			versions[1:2],
+			"",
+			"the only version, priority 100 from bookworm-backports",
+		},
+		{
+			"installed",
+			[]aptVersion{
+				{Version: "1.0", Priority: 500, Releases: []aptRelease{testBookworm}},
+				{Version: "2.0", Priority: 100, Installed: true, Releases: []aptRelease{installedRelease}},
+			},
+			"",
+			"the newest version, priority 100 from the dpkg status, installed in the base image",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			candidate, ok := candidateVersion(tc.versions, tc.release)
+			if !ok {
+				t.Fatal("Expected a candidate")
+			}
+			if actual := candidateReason(tc.versions, tc.release, candidate); actual != tc.expected {
+				t.Errorf("Expected %q but got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+const testPolicy = `Package files:
+ 100 /var/lib/dpkg/status
+     release a=now
+ 100 http://deb.debian.org/debian bookworm-backports/main amd64 Packages
+     release o=Debian Backports,a=stable-backports,n=bookworm-backports,l=Debian Backports,c=main,b=amd64
+     origin deb.debian.org
+ 500 http://deb.debian.org/debian bookworm/main amd64 Packages
+     release v=12.8,o=Debian,a=stable,n=bookworm,l=Debian,c=main,b=amd64
+     origin deb.debian.org
+Pinned packages:
+curl:
+  Installed: (none)
+  Candidate: 7.88.1-10+deb12u8
+  Version table:
+     8.11.1-1~bpo12+1 100
+        100 http://deb.debian.org/debian bookworm-backports/main amd64 Packages
+     7.88.1-10+deb12u8 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+tzdata:
+  Installed: 2024b-0+deb12u1
+  Candidate: 2024b-0+deb12u1
+  Version table:
+ *** 2024b-0+deb12u1 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+        100 /var/lib/dpkg/status
+`
+
+func TestParsePolicy(t *testing.T) {
+	policies := parsePolicy(testPolicy)
+	backports := testBackports
+	backports.Origin, backports.Label, backports.Site = "Debian Backports", "Debian Backports", "deb.debian.org"
+	// apt-cache policy does not print whether a release is automatic
+	backports.NotAutomatic, backports.ButAutomaticUpgrades = false, false
+	bookworm := testBookworm
+	bookworm.Version, bookworm.Origin, bookworm.Label, bookworm.Site = "12.8", "Debian", "Debian", "deb.debian.org"
+	expected := map[string][]aptVersion{
+		"curl": {
+			{Version: "8.11.1-1~bpo12+1", Priority: 100, Releases: []aptRelease{backports}},
+			{Version: "7.88.1-10+deb12u8", Priority: 500, Releases: []aptRelease{bookworm}},
+		},
+		"tzdata": {
+			{
+				Version:   "2024b-0+deb12u1",
+				Priority:  500,
+				Installed: true,
+				Releases:  []aptRelease{bookworm, installedRelease},
+			},
+		},
+	}
+	if !reflect.DeepEqual(policies.Versions, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, policies.Versions)
+	}
+
+	resolution := parsePackageVersions(testPolicy, PackageRequest{
+		Packages: []string{"curl", "tzdata"},
+		Releases: map[string]string{"curl": "bookworm-backports"},
+	})
+	expectedVersions := map[string]string{"curl": "8.11.1-1~bpo12+1", "tzdata": "2024b-0+deb12u1"}
+	if !reflect.DeepEqual(resolution.Versions, expectedVersions) {
+		t.Errorf("Expected %v but got %v", expectedVersions, resolution.Versions)
+	}
+}
+
+func TestRegistryResolverPriorities(t *testing.T) {
+	server := testAptServer(t, map[string]string{
+		"/debian/dists/bookworm/Release": "Suite: stable\nCodename: bookworm\n",
+		"/debian/dists/bookworm/main/binary-amd64/Packages.gz": `Package: curl
+Version: 7.88.1-10+deb12u8
+Architecture: amd64
+`,
+		"/debian/dists/bookworm-backports/Release": `Suite: stable-backports
+Codename: bookworm-backports
+NotAutomatic: yes
+ButAutomaticUpgrades: yes
+`,
+		"/debian/dists/bookworm-backports/main/binary-amd64/Packages.gz": `Package: curl
+Version: 8.11.1-1~bpo12+1
+Architecture: amd64
+`,
+	})
+	files := map[string][]byte{
+		"etc/apt/sources.list": []byte(
+			"deb http://deb.debian.org/debian bookworm main\n" +
+				"deb http://deb.debian.org/debian bookworm-backports main\n",
+		),
+	}
+	resolver := &RegistryResolver{Mirror: server.URL}
+	cases := []struct {
+		name     string
+		request  PackageRequest
+		expected string
+	}{
+		{"default", PackageRequest{}, "7.88.1-10+deb12u8"},
+		{
+			"target release",
+			PackageRequest{TargetReleases: map[string]string{"curl": "bookworm-backports"}},
+			"8.11.1-1~bpo12+1",
+		},
+		{
+			"release suffix",
+			PackageRequest{Releases: map[string]string{"curl": "stable-backports"}},
+			"8.11.1-1~bpo12+1",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := tc.request
+			request.Image = "debian:bookworm"
+			request.Architecture = "amd64"
+			request.Packages = []string{"curl"}
+			resolution, err := resolver.resolve(context.Background(), files, request)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if resolution.Versions["curl"] != tc.expected {
+				t.Errorf("Expected %s but got %s", tc.expected, resolution.Versions["curl"])
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package anchor
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Resolution is the outcome of resolving the packages of a request. Packages that cannot be
+// resolved are reported as failures rather than failing the whole request.
+type Resolution struct {
+	// Versions are the versions apt would install, by package
+	Versions map[string]string
+	// Providers are the packages apt installs in place of virtual packages, by virtual
+	// package, e.g. mail-transport-agent is provided by exim4-daemon-light
+	Providers map[string]string
+	// Reasons are why apt chooses the version of each package, by package, e.g. "the newest
+	// version, priority 500 from bookworm"
+	Reasons map[string]string
+	// Failures are the packages that could not be resolved
+	Failures []PackageFailure
+}
+
+// pin returns the package and version a requested package is anchored to, which is its
+// provider for a virtual package.
+func (r *Resolution) pin(pkg string) (string, string, bool) {
+	name := pkg
+	if provider, ok := r.Providers[pkg]; ok {
+		name = provider
+	}
+	version, ok := r.Versions[name]
+	return name, version, ok
+}
+
+// PackageFailure is a package that could not be resolved.
+type PackageFailure struct {
+	Package string
+	// Stage is the name of the stage installing the package, or its index when unnamed
+	Stage string
+	// Architecture is the dpkg architecture the package was resolved for
+	Architecture string
+	Reason       string
+	// Suggestion is how the failure may be fixed
+	Suggestion string
+}
+
+func (f PackageFailure) String() string {
+	return fmt.Sprintf(
+		"%s (stage %s, %s): %s. %s", f.Package, f.Stage, f.Architecture, f.Reason, f.Suggestion,
+	)
+}
+
+// ResolutionError lists every package of a Dockerfile that could not be resolved.
+type ResolutionError struct {
+	Failures []PackageFailure
+}
+
+func (e *ResolutionError) Error() string {
+	lines := []string{fmt.Sprintf("failed to resolve %d package(s):", len(e.Failures))}
+	for _, failure := range e.Failures {
+		lines = append(lines, "  "+failure.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// aptCatalog is what a resolver knows about the packages of a platform.
+type aptCatalog struct {
+	// versions returns the versions of a package with their priorities
+	versions func(pkg string) []aptVersion
+	// providers returns the packages providing a package
+	providers func(pkg string) []string
+	// names returns the names of every package, for suggestions
+	names func() []string
+}
+
+// resolvePackages resolves the candidate of each requested package. A virtual package with a
+// single provider is resolved to the provider, as apt-get install does.
+func resolvePackages(request PackageRequest, catalog aptCatalog) *Resolution {
+	resolution := &Resolution{
+		Versions:  map[string]string{},
+		Providers: map[string]string{},
+		Reasons:   map[string]string{},
+		Failures:  []PackageFailure{},
+	}
+	fail := func(pkg string, reason string, suggestion string) {
+		resolution.Failures = append(resolution.Failures, PackageFailure{
+			Package:      pkg,
+			Architecture: request.Architecture,
+			Reason:       reason,
+			Suggestion:   suggestion,
+		})
+	}
+	for _, pkg := range request.Packages {
+		release := request.Releases[pkg]
+		versions := catalog.versions(pkg)
+		if len(versions) > 0 {
+			version, ok := candidateVersion(versions, release)
+			switch {
+			case ok:
+				resolution.Versions[pkg] = version
+				resolution.Reasons[pkg] = candidateReason(versions, release, version)
+			case release != "":
+				fail(
+					pkg,
+					fmt.Sprintf("no version is available from the release %s", release),
+					"Check the release name and that its source is configured in the image.",
+				)
+			default:
+				fail(
+					pkg,
+					"every version is pinned with a negative priority",
+					"Check the apt preferences of the image.",
+				)
+			}
+			continue
+		}
+
+		providers := catalog.providers(pkg)
+		switch len(providers) {
+		case 0:
+			fail(
+				pkg,
+				fmt.Sprintf("package is not available for %s", request.Architecture),
+				packageSuggestion(pkg, catalog.names()),
+			)
+		case 1:
+			provider := providers[0]
+			providerVersions := catalog.versions(provider)
+			version, ok := candidateVersion(providerVersions, release)
+			if !ok {
+				fail(
+					pkg,
+					fmt.Sprintf("virtual package is provided by %s, which has no candidate", provider),
+					fmt.Sprintf("Install %s explicitly.", provider),
+				)
+				continue
+			}
+			resolution.Providers[pkg] = provider
+			resolution.Versions[provider] = version
+			resolution.Reasons[provider] = fmt.Sprintf(
+				"the only provider of %s, %s",
+				pkg,
+				candidateReason(providerVersions, release, version),
+			)
+		default:
+			fail(
+				pkg,
+				"virtual package is provided by "+strings.Join(providers, ", "),
+				fmt.Sprintf("Install one of the providers explicitly, e.g. %s.", providers[0]),
+			)
+		}
+	}
+	return resolution
+}
+
+// packageSuggestion suggests the packages whose names are closest to a misspelled one.
+func packageSuggestion(pkg string, names []string) string {
+	maxDistance := max(2, len(pkg)/4)
+	type match struct {
+		name     string
+		distance int
+	}
+	matches := []match{}
+	for _, name := range names {
+		if distance := editDistance(pkg, name); distance <= maxDistance && name != pkg {
+			matches = append(matches, match{name, distance})
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Sprintf(
+			"Check the package name and the apt sources of the image, "+
+				"or skip it with # anchor ignore=%s.",
+			pkg,
+		)
+	}
+	slices.SortFunc(matches, func(a match, b match) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	suggestions := []string{}
+	for _, m := range matches[:min(3, len(matches))] {
+		suggestions = append(suggestions, m.name)
+	}
+	return fmt.Sprintf("Did you mean %s?", strings.Join(suggestions, ", "))
+}
+
+// editDistance returns the Levenshtein distance between two names.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,169 @@
+package anchor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const testMissingPolicy = `curl:
+  Installed: (none)
+  Candidate: 7.88.1-10+deb12u8
+  Version table:
+     7.88.1-10+deb12u8 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+mail-transport-agent:
+  Installed: (none)
+  Candidate: (none)
+  Version table:
+Missing: mail-transport-agent: exim4-daemon-light
+exim4-daemon-light:
+  Installed: (none)
+  Candidate: 4.96-15+deb12u6
+  Version table:
+     4.96-15+deb12u6 500
+        500 http://deb.debian.org/debian bookworm/main amd64 Packages
+Missing: awk: gawk mawk
+Missing: culr:
+Missing: python3-definitely-not:
+Package names:
+ curl
+ gawk
+ mawk
+ python3
+`
+
+func TestResolvePackages(t *testing.T) {
+	resolution := parsePackageVersions(testMissingPolicy, PackageRequest{
+		Architecture: "amd64",
+		Packages: []string{
+			"curl", "mail-transport-agent", "awk", "culr", "python3-definitely-not",
+		},
+	})
+	expectedVersions := map[string]string{
+		"curl":               "7.88.1-10+deb12u8",
+		"exim4-daemon-light": "4.96-15+deb12u6",
+	}
+	if !reflect.DeepEqual(resolution.Versions, expectedVersions) {
+		t.Errorf("Expected %v but got %v", expectedVersions, resolution.Versions)
+	}
+	expectedProviders := map[string]string{"mail-transport-agent": "exim4-daemon-light"}
+	if !reflect.DeepEqual(resolution.Providers, expectedProviders) {
+		t.Errorf("Expected %v but got %v", expectedProviders, resolution.Providers)
+	}
+
+	expectedFailures := []PackageFailure{
+		{
+			Package:      "awk",
+			Architecture: "amd64",
+			Reason:       "virtual package is provided by gawk, mawk",
+			Suggestion:   "Install one of the providers explicitly, e.g. gawk.",
+		},
+		{
+			Package:      "culr",
+			Architecture: "amd64",
+			Reason:       "package is not available for amd64",
+			Suggestion:   "Did you mean curl?",
+		},
+		{
+			Package:      "python3-definitely-not",
+			Architecture: "amd64",
+			Reason:       "package is not available for amd64",
+			Suggestion: "Check the package name and the apt sources of the image, " +
+				"or skip it with # anchor ignore=python3-definitely-not.",
+		},
+	}
+	if !reflect.DeepEqual(resolution.Failures, expectedFailures) {
+		t.Errorf("Expected %+v but got %+v", expectedFailures, resolution.Failures)
+	}
+}
+
+func TestAppendProviderVersions(t *testing.T) {
+	nodes := Parse(strings.NewReader("RUN apt-get install -y mail-transport-agent curl\n"))
+	resolution := &Resolution{
+		Versions:  map[string]string{"exim4-daemon-light": "4.96-15+deb12u6", "curl": "7.88.1"},
+		Providers: map[string]string{"mail-transport-agent": "exim4-daemon-light"},
+	}
+	if err := appendPackageVersions(io.Discard, &nodes[0], resolution, "amd64"); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := "RUN dpkg --add-architecture amd64 && apt-get update && " +
+		"apt-get install -y exim4-daemon-light=4.96-15+deb12u6 curl=7.88.1\n"
+	if nodes[0].Source() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, nodes[0].Source())
+	}
+}
+
+// failingResolver fails to resolve the packages it is given.
+type failingResolver struct {
+	failures map[string]string
+}
+
+func (r *failingResolver) ResolvePackages(
+	_ context.Context, request PackageRequest,
+) (*Resolution, error) {
+	resolution := &Resolution{Versions: map[string]string{}}
+	for _, pkg := range request.Packages {
+		if reason, ok := r.failures[pkg]; ok {
+			resolution.Failures = append(resolution.Failures, PackageFailure{
+				Package:      pkg,
+				Architecture: request.Architecture,
+				Reason:       reason,
+				Suggestion:   "Check the package name.",
+			})
+			continue
+		}
+		resolution.Versions[pkg] = "1.0"
+	}
+	return resolution, nil
+}
+
+func TestProcessReportsEachFailure(t *testing.T) {
+	file := `FROM debian@sha256:abc AS builder
+RUN apt-get update && apt-get install -y curl culr
+FROM debian@sha256:abc
+RUN apt-get update && apt-get install -y wgte
+`
+	resolver := &failingResolver{failures: map[string]string{
+		"culr": "package is not available for arm64",
+		"wgte": "package is not available for arm64",
+	}}
+	_, err := ProcessWithConfig(context.Background(), Parse(strings.NewReader(file)), Config{
+		Platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+		Resolver: resolver,
+	})
+	var resolutionError *ResolutionError
+	if !errors.As(err, &resolutionError) {
+		t.Fatalf("Expected a resolution error but got %v", err)
+	}
+	expected := `failed to resolve 2 package(s):
+  culr (stage builder, arm64): package is not available for arm64. Check the package name.
+  wgte (stage 1, arm64): package is not available for arm64. Check the package name.`
+	if err.Error() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, err.Error())
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"curl", "curl", 0},
+		{"culr", "curl", 2},
+		{"pyhton3", "python3", 2},
+		{"git", "gitk", 1},
+		{"", "wget", 4},
+	}
+	for _, tc := range cases {
+		if actual := editDistance(tc.a, tc.b); actual != tc.expected {
+			t.Errorf("Expected %d for %s and %s but got %d", tc.expected, tc.a, tc.b, actual)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package anchor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// PackageRequest is a request to resolve the versions of packages installed in a stage.
+type PackageRequest struct {
+	// Image is the anchored base image of the stage
+	Image string
+	// Platform selects the image of the stage from the manifest index of the base image
+	Platform v1.Platform
+	// Stage is the name of the stage installing the packages, or its index when unnamed
+	Stage string
+	// Architecture is the dpkg architecture of the platform
+	Architecture string
+	Packages     []string
+	// TargetReleases are the releases packages are installed with -t from, by package
+	TargetReleases map[string]string
+	// Releases are the releases packages are installed from with a package/release suffix,
+	// e.g. curl/bookworm-backports, by package
+	Releases map[string]string
+	// Environment are the variables set in the stage before the install, as KEY=VALUE shell
+	// assignments in order, e.g. PATH="/opt/bin:$PATH"
+	Environment []string
+	// Shell is the shell of the stage, the default shell when empty
+	Shell []string
+	// Setup are the scripts that add the apt repositories of the stage, replayed in order
+	// before the packages are resolved
+	Setup []string
+}
+
+// PackageResolver resolves the version apt would install for each requested package.
+type PackageResolver interface {
+	ResolvePackages(ctx context.Context, request PackageRequest) (*Resolution, error)
+}
+
+// ImageResolver resolves the digest an image reference, such as golang:1.23, points to. An
+// empty digest leaves the image as it is.
+type ImageResolver interface {
+	ResolveImage(ctx context.Context, image string) (string, error)
+}
+
+// RegistryImageResolver resolves the current digest of images from their registry, which is
+// the digest of the manifest index for multi-platform images.
+type RegistryImageResolver struct{}
+
+func (r *RegistryImageResolver) ResolveImage(ctx context.Context, image string) (string, error) {
+	return crane.Digest(
+		image, crane.WithContext(ctx), crane.WithAuthFromKeychain(authn.DefaultKeychain),
+	)
+}
+
+// ContainerResolver resolves packages by running apt inside a container of the image. Each
+// architecture is resolved against the sources and dpkg state of its own platform image,
+// with apt configured for that architecture, so no emulation is needed.
+type ContainerResolver struct {
+	// Runtime runs the container, the Docker Engine when nil
+	Runtime Runtime
+
+	images imageFileCache
+}
+
+func (r *ContainerResolver) ResolvePackages(
+	ctx context.Context, request PackageRequest,
+) (*Resolution, error) {
+	runtime := r.Runtime
+	if runtime == nil {
+		runtime = &DockerEngine{}
+	}
+	files, err := r.images.get(ctx, request.Image, request.Platform)
+	if err != nil {
+		return nil, err
+	}
+	return fetchPackageVersions(ctx, runtime, request, files)
+}
+
+// RegistryResolver resolves packages without a container runtime. It reads the apt sources
+// and dpkg state straight from the image layers in the registry, downloads the Packages
+// indices itself and computes the candidate versions in Go.
+type RegistryResolver struct {
+	// Mirror replaces the scheme and host of every apt source when set, e.g. a local mirror
+	// such as http://localhost:8080
+	Mirror string
+	// Client is the HTTP client used to download indices, http.DefaultClient when nil
+	Client *http.Client
+
+	mu       sync.Mutex
+	indices  map[string][]aptPackage
+	releases map[string]aptRelease
+	images   imageFileCache
+}
+
+// isAptImageFile reports whether a file of an image determines what apt would install.
+func isAptImageFile(name string) bool {
+	return name == "etc/apt/sources.list" ||
+		path.Dir(name) == "etc/apt/sources.list.d" ||
+		name == "etc/apt/preferences" ||
+		path.Dir(name) == "etc/apt/preferences.d" ||
+		name == "var/lib/dpkg/status"
+}
+
+func (r *RegistryResolver) ResolvePackages(
+	ctx context.Context, request PackageRequest,
+) (*Resolution, error) {
+	if len(request.Setup) > 0 {
+		// the repositories added by the setup are not in the image, so the versions read from
+		// it would not be the ones apt installs
+		return nil, fmt.Errorf(
+			"stage %s adds apt repositories before installing packages, which the registry "+
+				"resolver cannot replay, use --resolver container",
+			request.Stage,
+		)
+	}
+	files, err := r.images.get(ctx, request.Image, request.Platform)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolve(ctx, files, request)
+}
+
+// imageFileCache reads the apt files of the platform images of base images from the
+// registry, once per image and architecture.
+type imageFileCache struct {
+	// image returns the image of the platform, from the registry when nil
+	image func(ctx context.Context, image string, platform v1.Platform) (v1.Image, error)
+
+	mu    sync.Mutex
+	files map[string]map[string][]byte
+}
+
+func (c *imageFileCache) get(
+	ctx context.Context, image string, platform v1.Platform,
+) (map[string][]byte, error) {
+	key := image + "|" + platform.String()
+	c.mu.Lock()
+	files, ok := c.files[key]
+	c.mu.Unlock()
+	if ok {
+		return files, nil
+	}
+
+	fetch := c.image
+	if fetch == nil {
+		fetch = platformImage
+	}
+	img, err := fetch(ctx, image, platform)
+	if err != nil {
+		return nil, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config of image %s: %w", image, err)
+	}
+	// a single platform image is returned whatever platform was asked for
+	if config.Architecture != "" && config.Architecture != platform.Architecture {
+		return nil, fmt.Errorf(
+			"image %s is built for %s and has no %s variant",
+			image,
+			config.Architecture,
+			platform.String(),
+		)
+	}
+	files, err = readImageFiles(img, isAptImageFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s: %w", image, err)
+	}
+
+	c.mu.Lock()
+	if c.files == nil {
+		c.files = map[string]map[string][]byte{}
+	}
+	c.files[key] = files
+	c.mu.Unlock()
+	return files, nil
+}
+
+// platformImage returns the child manifest of the image's index for the platform.
+func platformImage(ctx context.Context, image string, platform v1.Platform) (v1.Image, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(
+		ref,
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(platform),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image %s for %s: %w", image, platform.String(), err)
+	}
+	return img, nil
+}
+
+// readImageFiles returns the content of the files in the flattened filesystem of the image
+// that match, keyed by their path without a leading slash.
+func readImageFiles(img v1.Image, match func(name string) bool) (map[string][]byte, error) {
+	reader := mutate.Extract(img)
+	defer reader.Close()
+	files := map[string][]byte{}
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if header.Typeflag != tar.TypeReg || !match(name) {
+			continue
+		}
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = content
+	}
+}
+
+func (r *RegistryResolver) resolve(
+	ctx context.Context, files map[string][]byte, request PackageRequest,
+) (*Resolution, error) {
+	sources := parseImageSources(files)
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("image %s does not have any apt sources", request.Image)
+	}
+	available := []aptPackage{}
+	for _, source := range sources {
+		if !source.supports(request.Architecture) {
+			continue
+		}
+		packages, err := r.index(ctx, source, request.Architecture)
+		if err != nil {
+			return nil, err
+		}
+		available = append(available, packages...)
+	}
+	installed := parseDpkgStatus(files["var/lib/dpkg/status"])
+	preferences := parsePreferences(files)
+
+	return resolvePackages(request, aptCatalog{
+		versions: func(pkg string) []aptVersion {
+			return packageVersions(
+				pkg,
+				request.Architecture,
+				available,
+				installed,
+				request.TargetReleases[pkg],
+				preferences,
+			)
+		},
+		providers: func(pkg string) []string {
+			providers := []string{}
+			for _, p := range available {
+				if slices.Contains(p.Provides, pkg) && !slices.Contains(providers, p.Name) &&
+					(p.Architecture == request.Architecture || p.Architecture == "all") {
+					providers = append(providers, p.Name)
+				}
+			}
+			slices.Sort(providers)
+			return providers
+		},
+		names: func() []string {
+			names := []string{}
+			for _, p := range available {
+				names = append(names, p.Name)
+			}
+			slices.Sort(names)
+			return slices.Compact(names)
+		},
+	}), nil
+}
+
+// packageVersions returns the versions of a package that are available or installed, with
+// the priorities apt gives them.
+func packageVersions(
+	pkg string,
+	architecture string,
+	available []aptPackage,
+	installed []aptPackage,
+	target string,
+	preferences []aptPreference,
+) []aptVersion {
+	versions := []aptVersion{}
+	add := func(p aptPackage, isInstalled bool) {
+		i := slices.IndexFunc(versions, func(v aptVersion) bool {
+			return CompareDebianVersions(v.Version, p.Version) == 0
+		})
+		if i < 0 {
+			versions = append(versions, aptVersion{Version: p.Version})
+			i = len(versions) - 1
+		}
+		versions[i].Installed = versions[i].Installed || isInstalled
+		versions[i].Releases = append(versions[i].Releases, p.Release)
+	}
+	for _, p := range available {
+		if p.Name == pkg && (p.Architecture == architecture || p.Architecture == "all") {
+			add(p, false)
+		}
+	}
+	for _, p := range installed {
+		if p.Name == pkg {
+			add(p, true)
+		}
+	}
+	for i := range versions {
+		versions[i].Priority = versionPriority(pkg, versions[i], target, preferences)
+	}
+	return versions
+}
+
+// index returns the packages of a source's Packages index, downloading it once per run.
+func (r *RegistryResolver) index(
+	ctx context.Context, source aptSource, architecture string,
+) ([]aptPackage, error) {
+	urls := source.indexURLs(architecture)
+	if len(urls) == 0 {
+		return []aptPackage{}, nil
+	}
+	key := strings.Join(urls, "|")
+	r.mu.Lock()
+	packages, ok := r.indices[key]
+	r.mu.Unlock()
+	if ok {
+		return packages, nil
+	}
+
+	release := r.release(ctx, source)
+	packages = []aptPackage{}
+	// each component has a compressed and an uncompressed URL, use the first that exists
+	for i := 0; i < len(urls); i += 2 {
+		var content []byte
+		var err error
+		for _, u := range urls[i:min(i+2, len(urls))] {
+			content, err = r.download(ctx, u)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		componentRelease := release
+		if i/2 < len(source.Components) && !strings.HasSuffix(source.Suite, "/") {
+			componentRelease.Component = source.Components[i/2]
+		}
+		for _, pkg := range parsePackages(content, source) {
+			pkg.Release = componentRelease
+			packages = append(packages, pkg)
+		}
+	}
+
+	r.mu.Lock()
+	if r.indices == nil {
+		r.indices = map[string][]aptPackage{}
+	}
+	r.indices[key] = packages
+	r.mu.Unlock()
+	return packages, nil
+}
+
+// release returns the release of a source from its Release file, downloading it once per
+// run. Sources without a Release file are known by their suite alone.
+func (r *RegistryResolver) release(ctx context.Context, source aptSource) aptRelease {
+	u := source.releaseURL()
+	r.mu.Lock()
+	release, ok := r.releases[u]
+	r.mu.Unlock()
+	if ok {
+		return release
+	}
+
+	content, err := r.download(ctx, u)
+	if err != nil {
+		// without a Release file the release is only known by its suite
+		content = nil
+	}
+	release = parseRelease(content, source.Suite)
+	if parsed, err := url.Parse(source.URI); err == nil {
+		release.Site = parsed.Hostname()
+	}
+
+	r.mu.Lock()
+	if r.releases == nil {
+		r.releases = map[string]aptRelease{}
+	}
+	r.releases[u] = release
+	r.mu.Unlock()
+	return release
+}
+
+func (r *RegistryResolver) download(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := r.mirrored(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", u, resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(u, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", u, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return io.ReadAll(body)
+}
+
+// mirrored rewrites the scheme and host of a URL to the mirror, if one is set.
+func (r *RegistryResolver) mirrored(rawURL string) (string, error) {
+	if r.Mirror == "" {
+		return rawURL, nil
+	}
+	mirror, err := url.Parse(r.Mirror)
+	if err != nil {
+		return "", fmt.Errorf("invalid mirror %s: %w", r.Mirror, err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = mirror.Scheme
+	u.Host = mirror.Host
+	u.Path = strings.TrimSuffix(mirror.Path, "/") + u.Path
+	return u.String(), nil
+}
@@ -0,0 +1,183 @@
+package anchor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testImage builds an image with a single layer containing the files.
+func testImage(t *testing.T, files map[string]string) v1.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	for name, content := range files {
+		err := archive.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// testAptServer serves Packages indices and Release files keyed by their path, gzipped when
+// the path ends with .gz.
+func testAptServer(t *testing.T, indices map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index, ok := indices[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, ".gz") {
+			_, _ = w.Write([]byte(index))
+			return
+		}
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		_, _ = gz.Write([]byte(index))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+const testDebianSources = `Types: deb
+URIs: http://deb.debian.org/debian
+Suites: bookworm bookworm-updates
+Components: main
+`
+
+const testDebianPackages = `Package: curl
+Version: 7.88.1-10+deb12u4
+Architecture: amd64
+
+Package: curl
+Version: 7.88.1-10+deb12u5
+Architecture: amd64
+
+Package: ca-certificates
+Version: 20230311
+Architecture: all
+
+Package: wget
+Version: 1.21.3-1+b1
+Architecture: arm64
+`
+
+func TestReadImageFiles(t *testing.T) {
+	img := testImage(t, map[string]string{
+		"etc/apt/sources.list.d/debian.sources": testDebianSources,
+		"etc/hostname":                          "anchor",
+	})
+	files, err := readImageFiles(img, isAptImageFile)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := map[string][]byte{
+		"etc/apt/sources.list.d/debian.sources": []byte(testDebianSources),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v but got %v", expected, files)
+	}
+}
+
+func TestRegistryResolver(t *testing.T) {
+	server := testAptServer(t, map[string]string{
+		"/debian/dists/bookworm/main/binary-amd64/Packages.gz":         testDebianPackages,
+		"/debian/dists/bookworm-updates/main/binary-amd64/Packages.gz": "",
+	})
+	img := testImage(t, map[string]string{
+		"etc/apt/sources.list.d/debian.sources": testDebianSources,
+		"var/lib/dpkg/status": `Package: base-files
+Status: install ok installed
+Version: 12.4+deb12u5
+Architecture: amd64
+`,
+	})
+	files, err := readImageFiles(img, isAptImageFile)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	resolver := &RegistryResolver{Mirror: server.URL}
+	resolution, err := resolver.resolve(context.Background(), files, PackageRequest{
+		Image:        "debian:bookworm",
+		Architecture: "amd64",
+		Packages:     []string{"curl", "ca-certificates", "base-files"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := map[string]string{
+		"curl":            "7.88.1-10+deb12u5",
+		"ca-certificates": "20230311",
+		"base-files":      "12.4+deb12u5",
+	}
+	if !reflect.DeepEqual(resolution.Versions, expected) {
+		t.Errorf("Expected %v but got %v", expected, resolution.Versions)
+	}
+
+	resolution, err = resolver.resolve(context.Background(), files, PackageRequest{
+		Image:        "debian:bookworm",
+		Architecture: "amd64",
+		Packages:     []string{"wget"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	if len(resolution.Failures) != 1 || resolution.Failures[0].Package != "wget" {
+		t.Errorf("Expected a failure for a package not available for the architecture")
+	}
+}
+
+func TestRegistryResolverSetup(t *testing.T) {
+	resolver := &RegistryResolver{}
+	_, err := resolver.ResolvePackages(context.Background(), PackageRequest{
+		Image:        "debian:bookworm",
+		Stage:        "builder",
+		Architecture: "amd64",
+		Packages:     []string{"docker-ce"},
+		Setup: []string{
+			"curl -fsSL https://download.docker.com/linux/debian/gpg -o /etc/apt/keyrings/docker.asc",
+		},
+	})
+	expected := "stage builder adds apt repositories before installing packages, which the " +
+		"registry resolver cannot replay, use --resolver container"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q but got %v", expected, err)
+	}
+}
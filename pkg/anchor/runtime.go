@@ -0,0 +1,184 @@
+package anchor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContainerRun describes a short lived container that is removed once its command exits.
+type ContainerRun struct {
+	Image string
+	// Entrypoint replaces the entrypoint of the image when set
+	Entrypoint []string
+	// User replaces the user of the image when set
+	User    string
+	Command []string
+	// Files are placed in the container before the command runs, keyed by absolute path
+	Files map[string][]byte
+}
+
+// Runtime is a container runtime that package versions are resolved with.
+type Runtime interface {
+	Name() string
+	// Check returns an error when the runtime is not installed or not running
+	Check(ctx context.Context) error
+	// Run runs the container and returns its stdout
+	Run(ctx context.Context, run ContainerRun) ([]byte, error)
+}
+
+// CLIRuntime is a runtime driven through a docker compatible command line, such as the
+// podman and nerdctl CLIs.
+type CLIRuntime struct {
+	Binary string
+}
+
+var (
+	// Podman runs containers with the podman CLI, including rootless podman
+	Podman = CLIRuntime{Binary: "podman"}
+	// Nerdctl runs containers on containerd with the nerdctl CLI
+	Nerdctl = CLIRuntime{Binary: "nerdctl"}
+)
+
+// runtimes returns the supported runtimes in the order they are detected. Docker is reached
+// through the Engine API rather than its CLI.
+func runtimes() []Runtime {
+	return []Runtime{&DockerEngine{}, Podman, Nerdctl}
+}
+
+func (r CLIRuntime) Name() string {
+	return r.Binary
+}
+
+func (r CLIRuntime) Check(ctx context.Context) error {
+	if err := exec.CommandContext(ctx, r.Binary, "--version").Run(); err != nil {
+		return fmt.Errorf("%s is not installed", r.Binary)
+	}
+	if err := exec.CommandContext(ctx, r.Binary, "info").Run(); err != nil { // #nosec G204
+		return fmt.Errorf("%s is not running", r.Binary)
+	}
+	return nil
+}
+
+func (r CLIRuntime) Run(ctx context.Context, run ContainerRun) ([]byte, error) {
+	args := []string{"run", "--rm"}
+	if len(run.Files) > 0 {
+		dir, err := os.MkdirTemp("", "anchor-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		for i, name := range slices.Sorted(maps.Keys(run.Files)) {
+			source := filepath.Join(dir, strconv.Itoa(i))
+			if err := os.WriteFile(source, run.Files[name], 0o600); err != nil {
+				return nil, err
+			}
+			args = append(args, "-v", source+":"+name+":ro")
+		}
+	}
+	command := run.Command
+	if len(run.Entrypoint) > 0 {
+		// the CLIs only accept the executable of the entrypoint, the rest goes in the command
+		args = append(args, "--entrypoint", run.Entrypoint[0])
+		command = append(slices.Clone(run.Entrypoint[1:]), command...)
+	}
+	if run.User != "" {
+		args = append(args, "--user", run.User)
+	}
+	args = append(args, run.Image)
+	args = append(args, command...)
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	c := exec.CommandContext(ctx, r.Binary, args...) // #nosec G204
+	c.Stdout = &stdoutBuf
+	c.Stderr = &stderrBuf
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf(
+			"failed to run %s container: %w\n%s",
+			r.Binary,
+			err,
+			strings.TrimSpace(stderrBuf.String()),
+		)
+	}
+	return stdoutBuf.Bytes(), nil
+}
+
+// GetRuntime returns the runtime with the name, or the first installed and running runtime
+// when the name is auto.
+func GetRuntime(ctx context.Context, name string) (Runtime, error) {
+	if name != "auto" {
+		for _, runtime := range runtimes() {
+			if runtime.Name() == name {
+				return runtime, runtime.Check(ctx)
+			}
+		}
+		return nil, fmt.Errorf("unsupported runtime: %s", name)
+	}
+	errs := []string{}
+	for _, runtime := range runtimes() {
+		err := runtime.Check(ctx)
+		if err == nil {
+			return runtime, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("no container runtime is available: %s", strings.Join(errs, ", "))
+}
+
+// IsDockerInstalled returns whether the docker CLI is installed.
+//
+// Deprecated: use GetRuntime, whose Check reports whether a runtime is installed and running.
+func IsDockerInstalled() bool {
+	return exec.Command("docker", "--version").Run() == nil
+}
+
+// IsDockerRunning returns whether the Docker daemon is reachable.
+//
+// Deprecated: use GetRuntime, whose Check reports whether a runtime is installed and running.
+func IsDockerRunning() bool {
+	_, err := GetRuntime(context.Background(), "docker")
+	return err == nil
+}
+
+// FakeRuntime is a runtime that does not run containers, it returns canned output so the
+// resolution path can be tested without a daemon.
+type FakeRuntime struct {
+	// Output returns the stdout of a run
+	Output func(run ContainerRun) ([]byte, error)
+
+	mu   sync.Mutex
+	runs []ContainerRun
+}
+
+func (*FakeRuntime) Name() string {
+	return "fake"
+}
+
+func (*FakeRuntime) Check(context.Context) error {
+	return nil
+}
+
+func (f *FakeRuntime) Run(_ context.Context, run ContainerRun) ([]byte, error) {
+	f.mu.Lock()
+	f.runs = append(f.runs, run)
+	f.mu.Unlock()
+	if f.Output == nil {
+		return []byte{}, nil
+	}
+	return f.Output(run)
+}
+
+// Runs returns every container run so far.
+func (f *FakeRuntime) Runs() []ContainerRun {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ContainerRun{}, f.runs...)
+}
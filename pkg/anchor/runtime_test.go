@@ -0,0 +1,153 @@
+package anchor
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+const testPortsSources = `Types: deb
+URIs: http://ports.ubuntu.com/ubuntu-ports/
+Suites: noble
+Components: main
+`
+
+// testPlatformImages returns images of the architecture containing the files, as if they
+// were the child manifests of an index.
+func testPlatformImages(
+	t *testing.T, files map[string]string,
+) func(context.Context, string, v1.Platform) (v1.Image, error) {
+	t.Helper()
+	img := testImage(t, files)
+	return func(_ context.Context, _ string, platform v1.Platform) (v1.Image, error) {
+		config, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		config = config.DeepCopy()
+		config.Architecture = platform.Architecture
+		return mutate.ConfigFile(img, config)
+	}
+}
+
+func TestContainerResolver(t *testing.T) {
+	runtime := &FakeRuntime{
+		Output: func(run ContainerRun) ([]byte, error) {
+			return []byte(`curl:
+  Installed: (none)
+  Candidate: 8.5.0-2ubuntu10.6
+  Version table:
+     8.5.0-2ubuntu10.6 500
+        500 http://ports.ubuntu.com/ubuntu-ports noble-updates/main arm64 Packages
+     8.5.0-2ubuntu10 500
+        500 http://ports.ubuntu.com/ubuntu-ports noble/main arm64 Packages
+git:
+  Installed: (none)
+  Candidate: 1:2.43.0-1ubuntu7.2
+  Version table:
+     1:2.43.0-1ubuntu7.2 500
+        500 http://ports.ubuntu.com/ubuntu-ports noble-updates/main arm64 Packages
+`), nil
+		},
+	}
+	resolver := &ContainerResolver{Runtime: runtime}
+	resolver.images.image = testPlatformImages(t, map[string]string{
+		"etc/apt/sources.list.d/ubuntu.sources": testPortsSources,
+	})
+	resolution, err := resolver.ResolvePackages(context.Background(), PackageRequest{
+		Image:        "ubuntu@sha256:abc",
+		Platform:     v1.Platform{OS: "linux", Architecture: "arm64"},
+		Architecture: "arm64",
+		Packages:     []string{"curl", "git"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := map[string]string{"curl": "8.5.0-2ubuntu10.6", "git": "1:2.43.0-1ubuntu7.2"}
+	if !reflect.DeepEqual(resolution.Versions, expected) {
+		t.Errorf("Expected %v but got %v", expected, resolution.Versions)
+	}
+
+	runs := runtime.Runs()
+	if len(runs) != 1 || runs[0].Image != "ubuntu@sha256:abc" {
+		t.Fatalf("Unexpected runs %+v", runs)
+	}
+	command := strings.Join(runs[0].Command, " ")
+	if !strings.Contains(command, "-o APT::Architecture=arm64") ||
+		!strings.Contains(command, "policy -- 'curl' 'git' || exit 1\n") {
+		t.Errorf("Unexpected command %q", command)
+	}
+	// the sources of the arm64 image are used, not those of the container
+	expectedFiles := map[string][]byte{
+		"/anchor/etc/apt/sources.list.d/ubuntu.sources": []byte(testPortsSources),
+	}
+	if !reflect.DeepEqual(runs[0].Files, expectedFiles) {
+		t.Errorf("Expected files %v but got %v", expectedFiles, runs[0].Files)
+	}
+}
+
+func TestContainerResolverError(t *testing.T) {
+	runtime := &FakeRuntime{
+		Output: func(run ContainerRun) ([]byte, error) {
+			return nil, errors.New("E: No packages found")
+		},
+	}
+	resolver := &ContainerResolver{Runtime: runtime}
+	resolver.images.image = testPlatformImages(t, map[string]string{})
+	_, err := resolver.ResolvePackages(
+		context.Background(),
+		PackageRequest{
+			Image:        "debian",
+			Platform:     v1.Platform{OS: "linux", Architecture: "amd64"},
+			Architecture: "amd64",
+			Packages:     []string{"curl"},
+		},
+	)
+	if err == nil || err.Error() != "E: No packages found" {
+		t.Errorf("Expected the runtime error but got %v", err)
+	}
+}
+
+func TestSinglePlatformImage(t *testing.T) {
+	img := testImage(t, map[string]string{})
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = config.DeepCopy()
+	config.Architecture = "amd64"
+	img, err = mutate.ConfigFile(img, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := imageFileCache{
+		image: func(context.Context, string, v1.Platform) (v1.Image, error) { return img, nil },
+	}
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	_, err = cache.get(context.Background(), "example.com/app:1.0", platform)
+	expected := "image example.com/app:1.0 is built for amd64 and has no linux/arm64 variant"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q but got %v", expected, err)
+	}
+}
+
+func TestGetRuntimeUnsupported(t *testing.T) {
+	_, err := GetRuntime(context.Background(), "lxc")
+	if err == nil || err.Error() != "unsupported runtime: lxc" {
+		t.Errorf("Expected unsupported runtime error but got %v", err)
+	}
+}
+
+func TestIsDockerRunning(t *testing.T) {
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv("DOCKER_HOST", "unix://"+filepath.Join(t.TempDir(), "missing.sock"))
+	if IsDockerRunning() {
+		t.Error("Expected docker not to be running without a daemon")
+	}
+}
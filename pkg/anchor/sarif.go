@@ -0,0 +1,112 @@
+package anchor
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"slices"
+)
+
+// The SARIF 2.1.0 log written for code scanning, with only the properties anchor sets.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+// SARIF returns the findings as a SARIF 2.1.0 log, which code scanning tools such as GitHub
+// code scanning read. The version is that of anchor, it is left out when empty.
+func SARIF(findings []Finding, version string) ([]byte, error) {
+	rules := make([]sarifRule, 0, len(LintRules))
+	for _, rule := range LintRules {
+		rules = append(rules, sarifRule{
+			ID:                   rule.ID,
+			ShortDescription:     sarifMessage{Text: rule.Description},
+			DefaultConfiguration: sarifConfiguration{Level: rule.Level},
+		})
+	}
+	results := make([]sarifResult, 0, len(findings))
+	for _, finding := range findings {
+		results = append(results, sarifResult{
+			RuleID: finding.Rule,
+			RuleIndex: slices.IndexFunc(LintRules, func(rule LintRule) bool {
+				return rule.ID == finding.Rule
+			}),
+			Level:   finding.Level,
+			Message: sarifMessage{Text: finding.Message},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(finding.File)},
+				Region:           sarifRegion{StartLine: finding.Line, StartColumn: finding.Column},
+			}}},
+		})
+	}
+	return json.MarshalIndent(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "anchor",
+				Version:        version,
+				InformationURI: "https://github.com/SongStitch/anchor",
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	}, "", "  ")
+}
@@ -0,0 +1,54 @@
+package anchor
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Selection selects the images and packages that are refreshed when a Dockerfile is anchored
+// again, the rest keep the pins of the previous output. The zero value selects everything.
+type Selection struct {
+	// Images and Packages limit the refresh to images or to packages, both are refreshed when
+	// neither is set
+	Images   bool
+	Packages bool
+	// Names limit the refresh to the images and packages with these names, e.g. golang,
+	// golang:1.23 or curl
+	Names []string
+	// Stages limit the refresh to these stages, by name or index
+	Stages []string
+}
+
+// selectsImage reports whether the image of a stage is refreshed.
+func (s Selection) selectsImage(image string, stage string) bool {
+	if s.Packages && !s.Images {
+		return false
+	}
+	return s.selectsStage(stage) && (len(s.Names) == 0 ||
+		slices.ContainsFunc(s.Names, func(name string) bool { return imageMatches(image, name) }))
+}
+
+// selectsPackage reports whether a package installed in a stage is refreshed.
+func (s Selection) selectsPackage(pkg string, stage string) bool {
+	if s.Images && !s.Packages {
+		return false
+	}
+	return s.selectsStage(stage) && (len(s.Names) == 0 || slices.Contains(s.Names, pkg))
+}
+
+func (s Selection) selectsStage(stage string) bool {
+	return len(s.Stages) == 0 || slices.Contains(s.Stages, stage)
+}
+
+// imageMatches reports whether a name refers to an image reference, by the reference itself,
+// its repository, e.g. ghcr.io/songstitch/anchor, or the last part of the repository, e.g.
+// golang for golang:1.23.
+func imageMatches(image string, name string) bool {
+	image, _ = splitImageDigest(image)
+	repository := image
+	if hasTag(image) {
+		repository = image[:strings.LastIndex(image, ":")]
+	}
+	return name == image || name == repository || name == path.Base(repository)
+}
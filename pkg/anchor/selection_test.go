@@ -0,0 +1,81 @@
+package anchor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestSelection(t *testing.T) {
+	cases := []struct {
+		name      string
+		selection Selection
+		image     bool
+		pkg       bool
+	}{
+		{"everything", Selection{}, true, true},
+		{"images", Selection{Images: true}, true, false},
+		{"packages", Selection{Packages: true}, false, true},
+		{"images and packages", Selection{Images: true, Packages: true}, true, true},
+		{"image name", Selection{Names: []string{"golang"}}, true, false},
+		{"image reference", Selection{Names: []string{"golang:1.23-bookworm"}}, true, false},
+		{"package name", Selection{Names: []string{"curl"}}, false, true},
+		{"stage", Selection{Stages: []string{"builder"}}, true, true},
+		{"other stage", Selection{Stages: []string{"1"}}, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			image := tc.selection.selectsImage("golang:1.23-bookworm", "builder")
+			pkg := tc.selection.selectsPackage("curl", "builder")
+			if image != tc.image || pkg != tc.pkg {
+				t.Errorf("Expected image %v and package %v but got %v and %v", tc.image, tc.pkg, image, pkg)
+			}
+		})
+	}
+}
+
+func TestImageMatches(t *testing.T) {
+	for _, name := range []string{
+		"ghcr.io/songstitch/anchor:v1", "ghcr.io/songstitch/anchor", "anchor",
+	} {
+		if !imageMatches("ghcr.io/songstitch/anchor:v1", name) {
+			t.Errorf("Expected %s to match", name)
+		}
+	}
+	if imageMatches("localhost:5000/anchor", "localhost") {
+		t.Errorf("Expected the registry port not to be taken for a tag")
+	}
+}
+
+func TestProcessKeepsUnselectedPins(t *testing.T) {
+	file := `FROM golang:1.23-bookworm AS builder
+RUN apt-get update && apt-get install -y curl wget jq
+`
+	pins := &Pins{
+		Images:   map[string]string{"golang:1.23-bookworm": "sha256:old"},
+		Packages: map[string]map[string]string{"builder": {"curl": "7.88.1", "wget": "1.21.3"}},
+	}
+	resolver := &failingResolver{}
+	nodes := Parse(strings.NewReader(file))
+	_, err := ProcessWithConfig(context.Background(), nodes, Config{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		Resolver: resolver,
+		Images:   &Pins{Images: map[string]string{"golang:1.23-bookworm": "sha256:new"}},
+		Pins:     pins,
+		Refresh:  Selection{Names: []string{"curl"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	// curl is refreshed, wget keeps its pin and jq was not pinned before
+	expected := `FROM golang:1.23-bookworm@sha256:old AS builder
+RUN dpkg --add-architecture amd64 && apt-get update && apt-get update && apt-get install -y curl=1.0 wget=1.21.3 jq=1.0
+`
+	var sb strings.Builder
+	_ = nodes.Write(&sb)
+	if sb.String() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, sb.String())
+	}
+}
@@ -0,0 +1,103 @@
+package anchor
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// setupCommands are the commands that add apt repositories or their keys.
+var setupCommands = []string{"add-apt-repository", "apt-add-repository", "apt-key"}
+
+// setupPaths are the directories apt reads its sources and repository keys from.
+var setupPaths = []string{"/etc/apt/", "/usr/share/keyrings/"}
+
+// isRepositorySetup reports whether a command sets up an apt repository, by adding it with
+// add-apt-repository or by writing a source or key below /etc/apt or /usr/share/keyrings,
+// e.g. curl -o /etc/apt/keyrings/docker.asc or echo "deb ..." > /etc/apt/sources.list.d/x.list.
+func isRepositorySetup(command *shellSimpleCommand) bool {
+	args, _, _ := unwrapCommand(command.Args)
+	if len(args) == 0 {
+		return false
+	}
+	name, ok := args[0].literal()
+	name = path.Base(name)
+	if ok && slices.Contains(setupCommands, name) {
+		return true
+	}
+	// apt and dpkg read these paths rather than write them
+	if ok && slices.Contains([]string{"apt-get", "apt", "apt-cache", "dpkg"}, name) {
+		return false
+	}
+	for _, redirect := range command.Redirects {
+		if redirect.Op != ">" && redirect.Op != ">>" && redirect.Op != ">|" {
+			continue
+		}
+		if target, ok := redirect.Target.literal(); ok && isSetupPath(target) {
+			return true
+		}
+	}
+	for _, arg := range args[1:] {
+		value, ok := arg.literal()
+		if !ok {
+			continue
+		}
+		// options such as --output=/etc/apt/keyrings/key.gpg
+		_, option, hasOption := strings.Cut(value, "=")
+		if isSetupPath(value) || (hasOption && isSetupPath(option)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSetupPath(value string) bool {
+	return slices.ContainsFunc(setupPaths, func(prefix string) bool {
+		return strings.HasPrefix(value, prefix)
+	})
+}
+
+// repositorySetup returns the part of a shell form RUN script that sets up apt repositories,
+// from the start of the script to the last command which does, so that the tools it needs,
+// such as curl and gnupg, are installed the same way. Only commands that end before the
+// offset before are considered, or every command when it is negative. It is empty when the
+// script does not set up a repository.
+func repositorySetup(node *Node, before int) string {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return ""
+	}
+	run, ok := instruction.(*RunInstruction)
+	if !ok || run.Exec {
+		return ""
+	}
+	script, err := parseShell(run.Script)
+	if err != nil {
+		return ""
+	}
+	pipelines := []*shellPipeline{}
+	for _, item := range script.Items {
+		for _, pipeline := range item.Pipelines {
+			if before >= 0 && pipeline.Span.End > before {
+				break
+			}
+			pipelines = append(pipelines, pipeline)
+		}
+	}
+	last := -1
+	for i, pipeline := range pipelines {
+		setup := false
+		for _, command := range pipeline.Commands {
+			command.walk(func(command *shellSimpleCommand, _ *shellSimpleCommand) {
+				setup = setup || isRepositorySetup(command)
+			}, nil)
+		}
+		if setup {
+			last = i
+		}
+	}
+	if last < 0 {
+		return ""
+	}
+	return strings.TrimSpace(run.Script[pipelines[0].Span.Start:pipelines[last].Span.End])
+}
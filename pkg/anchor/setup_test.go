@@ -0,0 +1,141 @@
+package anchor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// recordingResolver records the requests it resolves, without resolving any package.
+type recordingResolver struct {
+	requests []PackageRequest
+}
+
+func (r *recordingResolver) ResolvePackages(
+	_ context.Context, request PackageRequest,
+) (*Resolution, error) {
+	r.requests = append(r.requests, request)
+	return &Resolution{}, nil
+}
+
+func TestRepositorySetup(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{
+			name: "keyring and source",
+			file: `RUN apt-get update && apt-get install -y curl gnupg \
+    && curl -fsSL https://download.docker.com/linux/debian/gpg | gpg --dearmor -o /etc/apt/keyrings/docker.gpg \
+    && echo "deb [signed-by=/etc/apt/keyrings/docker.gpg] https://download.docker.com/linux/debian bookworm stable" > /etc/apt/sources.list.d/docker.list
+`,
+			expected: `apt-get update && apt-get install -y curl gnupg \
+    && curl -fsSL https://download.docker.com/linux/debian/gpg | gpg --dearmor -o /etc/apt/keyrings/docker.gpg \
+    && echo "deb [signed-by=/etc/apt/keyrings/docker.gpg] https://download.docker.com/linux/debian bookworm stable" > /etc/apt/sources.list.d/docker.list`,
+		},
+		{
+			name:     "tee",
+			file:     "RUN echo 'deb http://example.com/debian stable main' | sudo tee -a /etc/apt/sources.list.d/example.list\n",
+			expected: "echo 'deb http://example.com/debian stable main' | sudo tee -a /etc/apt/sources.list.d/example.list",
+		},
+		{
+			name:     "ppa",
+			file:     "RUN add-apt-repository -y ppa:deadsnakes/ppa; apt-get update\n",
+			expected: "add-apt-repository -y ppa:deadsnakes/ppa",
+		},
+		{
+			name:     "curl output option",
+			file:     "RUN curl -fsSL --output=/usr/share/keyrings/example.gpg https://example.com/key.gpg\n",
+			expected: "curl -fsSL --output=/usr/share/keyrings/example.gpg https://example.com/key.gpg",
+		},
+		{
+			name:     "install only",
+			file:     "RUN apt-get update && apt-get install -y -o Dir::Etc::SourceList=/etc/apt/sources.list curl\n",
+			expected: "",
+		},
+		{
+			name:     "exec form",
+			file:     `RUN ["add-apt-repository", "ppa:deadsnakes/ppa"]` + "\n",
+			expected: "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := Parse(strings.NewReader(tc.file))
+			if actual := repositorySetup(&nodes[0], -1); actual != tc.expected {
+				t.Errorf("Expected %q but got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRepositorySetupBeforeInstall(t *testing.T) {
+	file := `RUN add-apt-repository ppa:deadsnakes/ppa \
+    && apt-get update \
+    && apt-get install -y python3.12 \
+    && echo 'deb http://example.com/debian stable main' > /etc/apt/sources.list.d/late.list
+`
+	nodes := Parse(strings.NewReader(file))
+	installs, err := runInstalls(&nodes[0])
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	expected := "add-apt-repository ppa:deadsnakes/ppa"
+	if actual := repositorySetup(&nodes[0], installs[0].Start); actual != expected {
+		t.Errorf("Expected %q but got %q", expected, actual)
+	}
+}
+
+func TestProcessReplaysSetup(t *testing.T) {
+	file := `FROM ubuntu@sha256:abc
+RUN apt-get update && apt-get install -y software-properties-common && add-apt-repository ppa:deadsnakes/ppa
+RUN apt-get update && apt-get install -y python3.12
+FROM ubuntu@sha256:abc
+RUN apt-get update && apt-get install -y curl
+`
+	resolver := &recordingResolver{}
+	_, err := ProcessWithConfig(context.Background(), Parse(strings.NewReader(file)), Config{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		Resolver: resolver,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	setup := "apt-get update && apt-get install -y software-properties-common" +
+		" && add-apt-repository ppa:deadsnakes/ppa"
+	expected := [][]string{{}, {setup}, {}}
+	if len(resolver.requests) != len(expected) {
+		t.Fatalf("Expected %d requests but got %d", len(expected), len(resolver.requests))
+	}
+	for i, request := range resolver.requests {
+		if strings.Join(request.Setup, "\n") != strings.Join(expected[i], "\n") {
+			t.Errorf("Expected setup %q for request %d but got %q", expected[i], i, request.Setup)
+		}
+	}
+}
+
+func TestReplaySetupScript(t *testing.T) {
+	runtime := &FakeRuntime{}
+	request := PackageRequest{
+		Image:        "ubuntu@sha256:abc",
+		Architecture: "arm64",
+		Packages:     []string{"python3.12"},
+		Setup:        []string{"add-apt-repository -y ppa:deadsnakes/ppa"},
+	}
+	_, err := fetchPackageVersions(context.Background(), runtime, request, map[string][]byte{})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	script := runtime.Runs()[0].Command[0]
+	for _, expected := range []string{
+		"{\nadd-apt-repository -y ppa:deadsnakes/ppa\n} >&2 || exit 1\n",
+		"-o Dir::Etc::SourceParts=" + setupSourceParts,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected %q in the script %q", expected, script)
+		}
+	}
+}
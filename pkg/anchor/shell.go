@@ -0,0 +1,839 @@
+package anchor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The shell parser builds a small POSIX shell AST for RUN instructions. Every word keeps
+// the span it was parsed from, so package arguments can be rewritten in place without
+// touching the rest of the script.
+
+type shellPartKind int
+
+const (
+	partLiteral shellPartKind = iota
+	partSingleQuoted
+	partDoubleQuoted
+	partParameter
+	partCommandSubstitution
+	partArithmetic
+)
+
+type shellPart struct {
+	Kind shellPartKind
+	Span Span
+	// Value is the unquoted text of literal and quoted parts
+	Value string
+	// Parts are the parts within a double quoted part
+	Parts []shellPart
+	// Script is the parsed body of a command substitution
+	Script *shellList
+}
+
+type shellWord struct {
+	Span  Span
+	Parts []shellPart
+}
+
+// literal returns the value of the word after quote removal, it is false when the word
+// contains an expansion and so cannot be known statically.
+func (w shellWord) literal() (string, bool) {
+	return partsLiteral(w.Parts)
+}
+
+func partsLiteral(parts []shellPart) (string, bool) {
+	var sb strings.Builder
+	for _, part := range parts {
+		switch part.Kind {
+		case partLiteral, partSingleQuoted:
+			sb.WriteString(part.Value)
+		case partDoubleQuoted:
+			value, ok := partsLiteral(part.Parts)
+			if !ok {
+				return "", false
+			}
+			sb.WriteString(value)
+		default:
+			return "", false
+		}
+	}
+	return sb.String(), true
+}
+
+type shellRedirect struct {
+	Op     string
+	Target shellWord
+	// Heredoc is the body of a << redirect
+	Heredoc string
+	strip   bool
+}
+
+type shellSimpleCommand struct {
+	Assigns   []shellWord
+	Args      []shellWord
+	Redirects []*shellRedirect
+}
+
+type shellCommand struct {
+	// Kind is one of simple, subshell, group, if, for, while, until, case or function
+	Kind   string
+	Simple *shellSimpleCommand
+	// Words are the words of a compound command, e.g. the items of a for loop
+	Words     []shellWord
+	Bodies    []*shellList
+	Redirects []*shellRedirect
+}
+
+type shellPipeline struct {
+	Span     Span
+	Negated  bool
+	Commands []*shellCommand
+}
+
+type shellAndOr struct {
+	Pipelines []*shellPipeline
+	// Ops are the && and || operators between the pipelines
+	Ops []string
+}
+
+type shellList struct {
+	Items []*shellAndOr
+}
+
+// walk calls visit for every simple command in the list, including those nested in
+// compound commands and command substitutions. The input is the simple command piped into
+// the visited command, it is nil when the command is not the target of a pipe.
+func (l *shellList) walk(visit func(command *shellSimpleCommand, input *shellSimpleCommand)) {
+	if l == nil {
+		return
+	}
+	for _, item := range l.Items {
+		for _, pipeline := range item.Pipelines {
+			var input *shellSimpleCommand
+			for _, command := range pipeline.Commands {
+				command.walk(visit, input)
+				input = command.Simple
+			}
+		}
+	}
+}
+
+func (c *shellCommand) walk(
+	visit func(command *shellSimpleCommand, input *shellSimpleCommand),
+	input *shellSimpleCommand,
+) {
+	redirects := c.Redirects
+	if c.Simple != nil {
+		visit(c.Simple, input)
+		walkWords(c.Simple.Assigns, visit)
+		walkWords(c.Simple.Args, visit)
+		redirects = append(redirects, c.Simple.Redirects...)
+	}
+	for _, redirect := range redirects {
+		walkWords([]shellWord{redirect.Target}, visit)
+	}
+	walkWords(c.Words, visit)
+	for _, body := range c.Bodies {
+		body.walk(visit)
+	}
+}
+
+func walkWords(words []shellWord, visit func(*shellSimpleCommand, *shellSimpleCommand)) {
+	for _, word := range words {
+		walkParts(word.Parts, visit)
+	}
+}
+
+func walkParts(parts []shellPart, visit func(*shellSimpleCommand, *shellSimpleCommand)) {
+	for _, part := range parts {
+		part.Script.walk(visit)
+		walkParts(part.Parts, visit)
+	}
+}
+
+// single returns the simple command when the list consists of only that command, as in
+// the command substitution $(cat packages.txt).
+func (l *shellList) single() *shellSimpleCommand {
+	if l == nil || len(l.Items) != 1 || len(l.Items[0].Pipelines) != 1 {
+		return nil
+	}
+	commands := l.Items[0].Pipelines[0].Commands
+	if len(commands) != 1 {
+		return nil
+	}
+	return commands[0].Simple
+}
+
+type shellSyntaxError struct {
+	Offset  int
+	Message string
+}
+
+func (e *shellSyntaxError) Error() string {
+	return e.Message
+}
+
+type shellParser struct {
+	src      string
+	pos      int
+	heredocs []*shellRedirect
+}
+
+// parseShell parses a shell script. Offsets in the returned AST are offsets into src.
+func parseShell(src string) (list *shellList, err error) {
+	p := &shellParser{src: src}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxError, ok := r.(*shellSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			list, err = nil, syntaxError
+		}
+	}()
+	list = p.parseList()
+	p.skipSpace()
+	if !p.eof() {
+		p.fail("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return list, nil
+}
+
+func (p *shellParser) fail(format string, args ...any) {
+	panic(&shellSyntaxError{Offset: p.pos, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *shellParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *shellParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+func isMeta(c byte) bool {
+	return isBlank(c) || strings.IndexByte("\n;&|<>()", c) >= 0
+}
+
+// skipBlanks skips blanks, line continuations and comments, but not newlines.
+func (p *shellParser) skipBlanks() {
+	for !p.eof() {
+		switch c := p.src[p.pos]; {
+		case isBlank(c):
+			p.pos++
+		case c == '\\' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '\n':
+			p.pos += 2
+		case c == '#':
+			for !p.eof() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// skipSpace skips blanks, comments and newlines, reading any pending heredoc bodies.
+func (p *shellParser) skipSpace() {
+	for {
+		p.skipBlanks()
+		if p.peek() != '\n' {
+			return
+		}
+		p.newline()
+	}
+}
+
+func (p *shellParser) newline() {
+	p.pos++
+	for _, heredoc := range p.heredocs {
+		delimiter, _ := heredoc.Target.literal()
+		var body strings.Builder
+		for !p.eof() {
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.src) - p.pos
+			}
+			line := p.src[p.pos : p.pos+end]
+			p.pos = min(p.pos+end+1, len(p.src))
+			if heredoc.strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == delimiter {
+				break
+			}
+			body.WriteString(line + "\n")
+		}
+		heredoc.Heredoc = body.String()
+	}
+	p.heredocs = nil
+}
+
+var shellOperators = []string{
+	"&&", "||", ";;", "<<-", "<<", ">>", "<&", ">&", "<>", ">|", "|", "&", ";", "<", ">", "(", ")",
+}
+
+func (p *shellParser) peekOperator() string {
+	for _, op := range shellOperators {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// reserved reports whether the reserved word is next, e.g. then or done.
+func (p *shellParser) reserved(word string) bool {
+	if !strings.HasPrefix(p.src[p.pos:], word) {
+		return false
+	}
+	end := p.pos + len(word)
+	return end >= len(p.src) || isMeta(p.src[end])
+}
+
+func (p *shellParser) expectReserved(word string) {
+	p.skipSpace()
+	if !p.reserved(word) {
+		p.fail("expected %q", word)
+	}
+	p.pos += len(word)
+}
+
+func (p *shellParser) expectOperator(op string) {
+	p.skipSpace()
+	if p.peekOperator() != op {
+		p.fail("expected %q", op)
+	}
+	p.pos += len(op)
+}
+
+func (p *shellParser) atTerminator(terminators []string) bool {
+	for _, terminator := range terminators {
+		if terminator == ")" || terminator == ";;" {
+			if p.peekOperator() == terminator {
+				return true
+			}
+		} else if p.reserved(terminator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *shellParser) parseList(terminators ...string) *shellList {
+	list := &shellList{}
+	for {
+		p.skipSpace()
+		if p.eof() || p.atTerminator(terminators) {
+			return list
+		}
+		list.Items = append(list.Items, p.parseAndOr())
+		p.skipBlanks()
+		switch op := p.peekOperator(); {
+		case op == ";" || op == "&":
+			p.pos++
+		case p.peek() == '\n':
+			p.newline()
+		case p.eof() || p.atTerminator(terminators):
+			return list
+		default:
+			p.fail("unexpected %q", p.src[p.pos:p.pos+1])
+		}
+	}
+}
+
+func (p *shellParser) parseAndOr() *shellAndOr {
+	andOr := &shellAndOr{Pipelines: []*shellPipeline{p.parsePipeline()}}
+	for {
+		p.skipBlanks()
+		op := p.peekOperator()
+		if op != "&&" && op != "||" {
+			return andOr
+		}
+		p.pos += len(op)
+		p.skipSpace()
+		andOr.Ops = append(andOr.Ops, op)
+		andOr.Pipelines = append(andOr.Pipelines, p.parsePipeline())
+	}
+}
+
+func (p *shellParser) parsePipeline() *shellPipeline {
+	pipeline := &shellPipeline{}
+	p.skipBlanks()
+	pipeline.Span.Start = p.pos
+	if p.reserved("!") {
+		pipeline.Negated = true
+		p.pos++
+	}
+	pipeline.Commands = append(pipeline.Commands, p.parseCommand())
+	for {
+		pipeline.Span.End = p.pos
+		// the blanks and line continuations after the last command are not part of it
+		for pipeline.Span.End > pipeline.Span.Start {
+			if isBlank(p.src[pipeline.Span.End-1]) {
+				pipeline.Span.End--
+			} else if strings.HasSuffix(p.src[:pipeline.Span.End], "\\\n") {
+				pipeline.Span.End -= 2
+			} else {
+				break
+			}
+		}
+		p.skipBlanks()
+		if p.peekOperator() != "|" {
+			return pipeline
+		}
+		p.pos++
+		p.skipSpace()
+		pipeline.Commands = append(pipeline.Commands, p.parseCommand())
+	}
+}
+
+func (p *shellParser) parseCommand() *shellCommand {
+	p.skipBlanks()
+	var command *shellCommand
+	switch {
+	case p.reserved("if"):
+		command = p.parseIf()
+	case p.reserved("for"):
+		command = p.parseFor()
+	case p.reserved("while"), p.reserved("until"):
+		command = p.parseLoop()
+	case p.reserved("case"):
+		command = p.parseCase()
+	case p.reserved("function"):
+		p.pos += len("function")
+		p.skipBlanks()
+		name := p.parseWord()
+		p.skipBlanks()
+		if strings.HasPrefix(p.src[p.pos:], "()") {
+			p.pos += 2
+		}
+		return p.parseFunction(name)
+	case p.reserved("{"):
+		p.pos++
+		command = &shellCommand{Kind: "group", Bodies: []*shellList{p.parseList("}")}}
+		p.expectReserved("}")
+	case p.peekOperator() == "(":
+		p.pos++
+		command = &shellCommand{Kind: "subshell", Bodies: []*shellList{p.parseList(")")}}
+		p.expectOperator(")")
+	default:
+		return p.parseSimpleCommand()
+	}
+	for {
+		p.skipBlanks()
+		if !p.atRedirect() {
+			return command
+		}
+		command.Redirects = append(command.Redirects, p.parseRedirect())
+	}
+}
+
+func (p *shellParser) parseFunction(name shellWord) *shellCommand {
+	p.skipSpace()
+	body := p.parseCommand()
+	return &shellCommand{
+		Kind:  "function",
+		Words: []shellWord{name},
+		Bodies: []*shellList{{Items: []*shellAndOr{{
+			Pipelines: []*shellPipeline{{Commands: []*shellCommand{body}}},
+		}}}},
+	}
+}
+
+func (p *shellParser) parseSimpleCommand() *shellCommand {
+	simple := &shellSimpleCommand{}
+	for {
+		p.skipBlanks()
+		if p.eof() {
+			break
+		}
+		if p.atRedirect() {
+			simple.Redirects = append(simple.Redirects, p.parseRedirect())
+			continue
+		}
+		if isMeta(p.peek()) {
+			if p.peek() == '(' && len(simple.Args) == 1 && len(simple.Assigns) == 0 {
+				p.pos++
+				p.expectOperator(")")
+				return p.parseFunction(simple.Args[0])
+			}
+			break
+		}
+		word := p.parseWord()
+		if len(simple.Args) == 0 && isAssignment(word) {
+			simple.Assigns = append(simple.Assigns, word)
+		} else {
+			simple.Args = append(simple.Args, word)
+		}
+	}
+	if len(simple.Args) == 0 && len(simple.Assigns) == 0 && len(simple.Redirects) == 0 {
+		if p.eof() {
+			p.fail("unexpected end of script")
+		}
+		p.fail("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return &shellCommand{Kind: "simple", Simple: simple}
+}
+
+func isAssignment(word shellWord) bool {
+	if len(word.Parts) == 0 || word.Parts[0].Kind != partLiteral {
+		return false
+	}
+	name, _, found := strings.Cut(word.Parts[0].Value, "=")
+	if !found || name == "" {
+		return false
+	}
+	for i := range len(name) {
+		if !isNameChar(name[i]) || i == 0 && name[i] >= '0' && name[i] <= '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *shellParser) parseIf() *shellCommand {
+	p.pos += len("if")
+	command := &shellCommand{Kind: "if"}
+	command.Bodies = append(command.Bodies, p.parseList("then"))
+	p.expectReserved("then")
+	command.Bodies = append(command.Bodies, p.parseList("elif", "else", "fi"))
+	for {
+		p.skipSpace()
+		switch {
+		case p.reserved("elif"):
+			p.pos += len("elif")
+			command.Bodies = append(command.Bodies, p.parseList("then"))
+			p.expectReserved("then")
+			command.Bodies = append(command.Bodies, p.parseList("elif", "else", "fi"))
+		case p.reserved("else"):
+			p.pos += len("else")
+			command.Bodies = append(command.Bodies, p.parseList("fi"))
+		default:
+			p.expectReserved("fi")
+			return command
+		}
+	}
+}
+
+func (p *shellParser) parseFor() *shellCommand {
+	p.pos += len("for")
+	p.skipBlanks()
+	command := &shellCommand{Kind: "for", Words: []shellWord{p.parseWord()}}
+	p.skipSpace()
+	if p.reserved("in") {
+		p.pos += len("in")
+		for {
+			p.skipBlanks()
+			if p.eof() || isMeta(p.peek()) {
+				break
+			}
+			command.Words = append(command.Words, p.parseWord())
+		}
+	}
+	p.skipBlanks()
+	if p.peekOperator() == ";" {
+		p.pos++
+	}
+	p.expectReserved("do")
+	command.Bodies = append(command.Bodies, p.parseList("done"))
+	p.expectReserved("done")
+	return command
+}
+
+func (p *shellParser) parseLoop() *shellCommand {
+	kind := "while"
+	if p.reserved("until") {
+		kind = "until"
+	}
+	p.pos += len(kind)
+	command := &shellCommand{Kind: kind}
+	command.Bodies = append(command.Bodies, p.parseList("do"))
+	p.expectReserved("do")
+	command.Bodies = append(command.Bodies, p.parseList("done"))
+	p.expectReserved("done")
+	return command
+}
+
+func (p *shellParser) parseCase() *shellCommand {
+	p.pos += len("case")
+	p.skipBlanks()
+	command := &shellCommand{Kind: "case", Words: []shellWord{p.parseWord()}}
+	p.expectReserved("in")
+	for {
+		p.skipSpace()
+		if p.reserved("esac") {
+			p.pos += len("esac")
+			return command
+		}
+		if p.peekOperator() == "(" {
+			p.pos++
+		}
+		for {
+			p.skipBlanks()
+			command.Words = append(command.Words, p.parseWord())
+			p.skipBlanks()
+			if p.peekOperator() != "|" {
+				break
+			}
+			p.pos++
+		}
+		p.expectOperator(")")
+		command.Bodies = append(command.Bodies, p.parseList(";;", "esac"))
+		p.skipSpace()
+		if p.peekOperator() == ";;" {
+			p.pos += 2
+		}
+	}
+}
+
+func (p *shellParser) atRedirect() bool {
+	i := p.pos
+	for i < len(p.src) && p.src[i] >= '0' && p.src[i] <= '9' {
+		i++
+	}
+	return i < len(p.src) && (p.src[i] == '<' || p.src[i] == '>')
+}
+
+func (p *shellParser) parseRedirect() *shellRedirect {
+	for p.peek() >= '0' && p.peek() <= '9' {
+		p.pos++
+	}
+	redirect := &shellRedirect{Op: p.peekOperator()}
+	p.pos += len(redirect.Op)
+	p.skipBlanks()
+	redirect.Target = p.parseWord()
+	if redirect.Op == "<<" || redirect.Op == "<<-" {
+		redirect.strip = redirect.Op == "<<-"
+		p.heredocs = append(p.heredocs, redirect)
+	}
+	return redirect
+}
+
+func (p *shellParser) parseWord() shellWord {
+	word := shellWord{Span: Span{Start: p.pos}}
+	var literal strings.Builder
+	literalStart := -1
+	flush := func() {
+		if literalStart >= 0 {
+			word.Parts = append(word.Parts, shellPart{
+				Kind:  partLiteral,
+				Span:  Span{Start: literalStart, End: p.pos},
+				Value: literal.String(),
+			})
+			literal.Reset()
+			literalStart = -1
+		}
+	}
+	for !p.eof() && !isMeta(p.peek()) {
+		c := p.peek()
+		switch c {
+		case '\\':
+			if p.pos+1 < len(p.src) && p.src[p.pos+1] == '\n' {
+				p.pos += 2
+				continue
+			}
+			if literalStart < 0 {
+				literalStart = p.pos
+			}
+			if p.pos+1 < len(p.src) {
+				literal.WriteByte(p.src[p.pos+1])
+			}
+			p.pos = min(p.pos+2, len(p.src))
+		case '\'':
+			flush()
+			start := p.pos
+			end := strings.IndexByte(p.src[p.pos+1:], '\'')
+			if end < 0 {
+				p.fail("unterminated single quote")
+			}
+			p.pos += end + 2
+			word.Parts = append(word.Parts, shellPart{
+				Kind:  partSingleQuoted,
+				Span:  Span{Start: start, End: p.pos},
+				Value: p.src[start+1 : p.pos-1],
+			})
+		case '"':
+			flush()
+			word.Parts = append(word.Parts, p.parseDoubleQuoted())
+		case '$':
+			flush()
+			word.Parts = append(word.Parts, p.parseDollar())
+		case '`':
+			flush()
+			word.Parts = append(word.Parts, p.parseBackquote())
+		default:
+			if literalStart < 0 {
+				literalStart = p.pos
+			}
+			literal.WriteByte(c)
+			p.pos++
+		}
+	}
+	flush()
+	word.Span.End = p.pos
+	if word.Span.End == word.Span.Start {
+		if p.eof() {
+			p.fail("unexpected end of script")
+		}
+		p.fail("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return word
+}
+
+func (p *shellParser) parseDoubleQuoted() shellPart {
+	part := shellPart{Kind: partDoubleQuoted, Span: Span{Start: p.pos}}
+	p.pos++
+	var literal strings.Builder
+	literalStart := -1
+	flush := func() {
+		if literalStart >= 0 {
+			part.Parts = append(part.Parts, shellPart{
+				Kind:  partLiteral,
+				Span:  Span{Start: literalStart, End: p.pos},
+				Value: literal.String(),
+			})
+			literal.Reset()
+			literalStart = -1
+		}
+	}
+	for {
+		if p.eof() {
+			p.fail("unterminated double quote")
+		}
+		c := p.peek()
+		switch {
+		case c == '"':
+			flush()
+			p.pos++
+			part.Span.End = p.pos
+			part.Value, _ = partsLiteral(part.Parts)
+			return part
+		case c == '$':
+			flush()
+			part.Parts = append(part.Parts, p.parseDollar())
+		case c == '`':
+			flush()
+			part.Parts = append(part.Parts, p.parseBackquote())
+		case c == '\\' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '\n':
+			p.pos += 2
+		case c == '\\' && p.pos+1 < len(p.src) && strings.IndexByte("$`\"\\", p.src[p.pos+1]) >= 0:
+			if literalStart < 0 {
+				literalStart = p.pos
+			}
+			literal.WriteByte(p.src[p.pos+1])
+			p.pos += 2
+		default:
+			if literalStart < 0 {
+				literalStart = p.pos
+			}
+			literal.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+func (p *shellParser) parseDollar() shellPart {
+	start := p.pos
+	rest := p.src[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, "$(("):
+		p.pos += 3
+		depth := 2
+		for depth > 0 {
+			if p.eof() {
+				p.fail("unterminated arithmetic expansion")
+			}
+			switch p.peek() {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			p.pos++
+		}
+		return shellPart{Kind: partArithmetic, Span: Span{Start: start, End: p.pos}}
+	case strings.HasPrefix(rest, "$("):
+		p.pos += 2
+		script := p.parseList(")")
+		p.expectOperator(")")
+		return shellPart{
+			Kind:   partCommandSubstitution,
+			Span:   Span{Start: start, End: p.pos},
+			Script: script,
+		}
+	case strings.HasPrefix(rest, "${"):
+		p.pos += 2
+		depth := 1
+		for depth > 0 {
+			if p.eof() {
+				p.fail("unterminated parameter expansion")
+			}
+			switch p.peek() {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			case '\\':
+				p.pos++
+			}
+			p.pos++
+		}
+		return shellPart{
+			Kind:  partParameter,
+			Span:  Span{Start: start, End: p.pos},
+			Value: p.src[start+2 : p.pos-1],
+		}
+	}
+	p.pos++
+	switch c := p.peek(); {
+	case isNameChar(c) && !(c >= '0' && c <= '9'):
+		for !p.eof() && isNameChar(p.peek()) {
+			p.pos++
+		}
+	case c != 0 && strings.IndexByte("0123456789@*#?$!-", c) >= 0:
+		p.pos++
+	default:
+		// a lone dollar sign is a literal
+		return shellPart{Kind: partLiteral, Span: Span{Start: start, End: p.pos}, Value: "$"}
+	}
+	return shellPart{
+		Kind:  partParameter,
+		Span:  Span{Start: start, End: p.pos},
+		Value: p.src[start+1 : p.pos],
+	}
+}
+
+func (p *shellParser) parseBackquote() shellPart {
+	start := p.pos
+	end := p.pos + 1
+	for end < len(p.src) && p.src[end] != '`' {
+		if p.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.src) {
+		p.fail("unterminated backquote")
+	}
+	inner := &shellParser{src: p.src[:end], pos: start + 1}
+	script := inner.parseList()
+	p.pos = end + 1
+	return shellPart{
+		Kind:   partCommandSubstitution,
+		Span:   Span{Start: start, End: p.pos},
+		Script: script,
+	}
+}
@@ -0,0 +1,153 @@
+package anchor
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseShellInstalls(t *testing.T) {
+	cases := []struct {
+		name     string
+		script   string
+		expected []string
+	}{
+		{"simple", "apt-get install -y curl wget", []string{"curl", "wget"}},
+		{"list", "apt-get update && apt-get install -y curl; apt-get clean", []string{"curl"}},
+		{
+			"options with values",
+			"apt-get -o Dpkg::Use-Pty=0 install -t bookworm -y curl",
+			[]string{"curl"},
+		},
+		{"pinned", "apt-get install -y curl=7.88.1-10 'wget=1.21.3'", []string{"curl", "wget"}},
+		{"quoted", `apt-get install -y "curl" 'wget'`, []string{"curl", "wget"}},
+		{"apt", "apt install -y --no-install-recommends curl", []string{"curl"}},
+		{"other subcommand", "apt-get remove -y curl", []string{}},
+		{
+			"if block",
+			`if [ "$TARGETARCH" = "amd64" ]; then apt-get install -y curl; else apt-get install -y wget; fi`,
+			[]string{"curl", "wget"},
+		},
+		{"subshell", "(cd /tmp && apt-get install -y curl)", []string{"curl"}},
+		{"group", "{ apt-get install -y curl; }", []string{"curl"}},
+		{"for loop", "for i in 1 2; do apt-get install -y curl; done", []string{"curl"}},
+		{"while loop", "while false; do apt-get install -y curl; done", []string{"curl"}},
+		{
+			"case",
+			"case \"$ARCH\" in\n  amd64|x86_64) apt-get install -y curl ;;\n  *) apt-get install -y wget ;;\nesac",
+			[]string{"curl", "wget"},
+		},
+		{
+			"function",
+			"install() { apt-get install -y \"$@\" curl; }; install wget",
+			[]string{"curl"},
+		},
+		{
+			"sudo and env",
+			"sudo -E env DEBIAN_FRONTEND=noninteractive apt-get install -y curl",
+			[]string{"curl"},
+		},
+		{"assignment", "DEBIAN_FRONTEND=noninteractive apt-get install -y curl", []string{"curl"}},
+		{"xargs", "echo wget | xargs -n 1 apt-get install -y curl", []string{"curl"}},
+		{"command substitution", "echo $(apt-get install -y curl)", []string{"curl"}},
+		{"variables", "apt-get install -y $PACKAGES ${EXTRA} curl", []string{"curl"}},
+		{"comment", "apt-get install -y curl # wget", []string{"curl"}},
+		{"continuation", "apt-get install -y \\\n    curl \\\n    wget", []string{"curl", "wget"}},
+		{"redirect", "apt-get install -y curl > /dev/null 2>&1", []string{"curl"}},
+		{
+			"heredoc",
+			"cat <<EOF > /tmp/file\napt-get install -y wget\nEOF\napt-get install -y curl",
+			[]string{"curl"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := parseCommand(tc.script)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseShellErrors(t *testing.T) {
+	cases := []string{
+		"if true; then apt-get install curl",
+		"echo 'unterminated",
+		"apt-get install curl )",
+		"echo $(apt-get install curl",
+	}
+	for _, script := range cases {
+		t.Run(script, func(t *testing.T) {
+			if _, err := parseShell(script); err == nil {
+				t.Errorf("Expected an error parsing %q", script)
+			}
+		})
+	}
+}
+
+func TestShellWordSpans(t *testing.T) {
+	script := `apt-get install -y "curl" wget\ 2 $(echo x)`
+	list, err := parseShell(script)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	var args []shellWord
+	list.walk(func(command *shellSimpleCommand, _ *shellSimpleCommand) {
+		if args == nil {
+			args = command.Args
+		}
+	})
+	expected := []string{"apt-get", "install", "-y", `"curl"`, `wget\ 2`, "$(echo x)"}
+	actual := []string{}
+	for _, arg := range args {
+		actual = append(actual, script[arg.Span.Start:arg.Span.End])
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+	if value, ok := args[4].literal(); !ok || value != "wget 2" {
+		t.Errorf("Expected literal \"wget 2\" but got %q", value)
+	}
+	if _, ok := args[5].literal(); ok {
+		t.Errorf("Expected command substitution to not be literal")
+	}
+}
+
+func TestAppendPackageVersionsPreservesScript(t *testing.T) {
+	file := `RUN set -eux; \
+    if [ "$(uname -m)" = "x86_64" ]; then \
+        apt-get install -y --no-install-recommends "curl" ca-certificates; \
+    fi \
+    && echo 'apt-get install wget' \
+    && (cd /tmp && apt-get install -y wget=1.0 | tee log.txt)
+RUN ["apt-get", "install", "-y", "curl"]
+`
+	nodes := Parse(strings.NewReader(file))
+	packageMap := map[string]string{
+		"curl":            "7.88.1",
+		"ca-certificates": "20230311",
+		"wget":            "1.21.3",
+	}
+	for i := range nodes {
+		resolution := &Resolution{Versions: packageMap}
+		if err := appendPackageVersions(io.Discard, &nodes[i], resolution, "arm64"); err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+	}
+
+	expected := `RUN dpkg --add-architecture arm64 && apt-get update && set -eux; \
+    if [ "$(uname -m)" = "x86_64" ]; then \
+        apt-get install -y --no-install-recommends "curl=7.88.1" ca-certificates=20230311; \
+    fi \
+    && echo 'apt-get install wget' \
+    && (cd /tmp && apt-get install -y wget=1.21.3 | tee log.txt)
+RUN ["apt-get", "install", "-y", "curl=7.88.1"]
+`
+	w := &strings.Builder{}
+	nodes.Write(w)
+	if w.String() != expected {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, w.String())
+	}
+}
@@ -0,0 +1,151 @@
+package anchor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultShell is the shell RUN instructions use on linux until a SHELL instruction changes
+// it. Unlike bash it is available in every image apt is.
+var defaultShell = []string{"/bin/sh", "-c"}
+
+// stage is the state of the stage being processed that RUN instructions depend on.
+type stage struct {
+	// name is the name of the stage, or its index when it is not named
+	name string
+	// image is the anchored base image of the stage
+	image  string
+	copies []*stageCopy
+	// env are the variables set by ARG and ENV instructions so far, as shell assignments
+	env   []string
+	shell []string
+	// setup are the repository setup steps of the RUN instructions so far
+	setup []string
+	// args are the values of ARG instructions declared before the first FROM
+	args map[string]Word
+}
+
+func newStage(image string, args map[string]Word) *stage {
+	return &stage{
+		image:  image,
+		copies: []*stageCopy{},
+		env:    []string{},
+		shell:  defaultShell,
+		setup:  []string{},
+		args:   args,
+	}
+}
+
+// apply records the effect of an instruction that is not a FROM or RUN on the stage.
+func (s *stage) apply(node *Node) {
+	if stageCopy := parseStageCopy(node); stageCopy != nil {
+		s.copies = append(s.copies, stageCopy)
+		return
+	}
+	instruction, err := node.Instruction()
+	if err != nil {
+		return
+	}
+	switch instruction := instruction.(type) {
+	case *ArgInstruction:
+		for _, arg := range instruction.Args {
+			value, ok := arg.Value, arg.HasValue
+			if !ok {
+				// a global argument is only visible in a stage that declares it again
+				value, ok = s.args[arg.Key.Value]
+			}
+			if ok {
+				s.env = append(s.env, arg.Key.Value+"="+shellValue(value))
+			}
+		}
+	case *EnvInstruction:
+		for _, pair := range instruction.Pairs {
+			s.env = append(s.env, pair.Key.Value+"="+shellValue(pair.Value))
+		}
+	case *ShellInstruction:
+		shell := []string{}
+		for _, arg := range instruction.Args {
+			shell = append(shell, arg.Literal())
+		}
+		s.shell = shell
+	}
+}
+
+// globalArgs returns the default values of the ARG instructions before the first FROM.
+func globalArgs(nodes []Node) map[string]Word {
+	args := map[string]Word{}
+	for i := range nodes {
+		if nodes[i].CommandType == CommandFrom {
+			break
+		}
+		instruction, err := nodes[i].Instruction()
+		if err != nil {
+			continue
+		}
+		if arg, ok := instruction.(*ArgInstruction); ok {
+			for _, pair := range arg.Args {
+				if pair.HasValue {
+					args[pair.Key.Value] = pair.Value
+				}
+			}
+		}
+	}
+	return args
+}
+
+// shellValue returns an ARG or ENV value as a shell word that expands variables the way the
+// Dockerfile does, so that values such as $PATH refer to the environment of the image.
+func shellValue(value Word) string {
+	if strings.HasPrefix(value.Value, "'") {
+		return shellQuote(value.Literal())
+	}
+	return `"` + strings.NewReplacer(`"`, `\"`, "`", "\\`").Replace(value.Literal()) + `"`
+}
+
+// shellQuote quotes a value so that the shell does not expand it.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// proxyVariables are the proxy variables docker passes to builds without them being declared.
+var proxyVariables = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY", "ALL_PROXY",
+	"http_proxy", "https_proxy", "ftp_proxy", "no_proxy", "all_proxy",
+}
+
+// ProxyEnvironment returns the proxy variables of the environment as KEY=VALUE pairs, falling
+// back to the default proxies configured in the docker config file.
+func ProxyEnvironment() []string {
+	env := []string{}
+	for _, key := range proxyVariables {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	if len(env) > 0 {
+		return env
+	}
+
+	content, err := os.ReadFile(filepath.Join(dockerConfigDir(), "config.json")) // #nosec G304
+	if err != nil {
+		return env
+	}
+	config := struct {
+		Proxies map[string]map[string]string `json:"proxies"`
+	}{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return env
+	}
+	proxies := config.Proxies["default"]
+	for _, key := range []string{"httpProxy", "httpsProxy", "ftpProxy", "noProxy", "allProxy"} {
+		if value := proxies[key]; value != "" {
+			name := strings.ToUpper(strings.TrimSuffix(key, "Proxy")) + "_PROXY"
+			env = append(env, name+"="+value, strings.ToLower(name)+"="+value)
+		}
+	}
+	slices.Sort(env)
+	return env
+}
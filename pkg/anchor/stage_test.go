@@ -0,0 +1,121 @@
+package anchor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStageEnvironment(t *testing.T) {
+	file := `ARG DEBIAN_VERSION=bookworm
+ARG MIRROR=http://deb.debian.org
+FROM debian:bookworm
+ARG MIRROR
+ARG DEBIAN_VERSION
+ARG UNSET
+ENV DEBIAN_FRONTEND=noninteractive PATH="/opt/bin:$PATH"
+ENV GREETING 'hello $USER'
+SHELL ["/bin/bash", "-o", "pipefail", "-c"]
+RUN apt-get install -y curl
+`
+	nodes := Parse(strings.NewReader(file))
+	current := newStage("debian:bookworm", globalArgs(nodes))
+	for i := 3; i < len(nodes)-1; i++ {
+		current.apply(&nodes[i])
+	}
+	expected := []string{
+		`MIRROR="http://deb.debian.org"`,
+		`DEBIAN_VERSION="bookworm"`,
+		`DEBIAN_FRONTEND="noninteractive"`,
+		`PATH="/opt/bin:$PATH"`,
+		`GREETING='hello $USER'`,
+	}
+	if !reflect.DeepEqual(current.env, expected) {
+		t.Errorf("Expected %v but got %v", expected, current.env)
+	}
+	shell := []string{"/bin/bash", "-o", "pipefail", "-c"}
+	if !reflect.DeepEqual(current.shell, shell) {
+		t.Errorf("Expected %v but got %v", shell, current.shell)
+	}
+}
+
+func TestResolutionContainer(t *testing.T) {
+	runtime := &FakeRuntime{}
+	request := PackageRequest{
+		Image:        "debian@sha256:abc",
+		Architecture: "amd64",
+		Packages:     []string{"curl"},
+		Environment:  []string{`HTTP_PROXY='http://proxy:3128'`, `PATH="/opt/bin:$PATH"`},
+	}
+	_, err := fetchPackageVersions(context.Background(), runtime, request, map[string][]byte{})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	run := runtime.Runs()[0]
+	if !reflect.DeepEqual(run.Entrypoint, []string{"/bin/sh", "-c"}) {
+		t.Errorf("Expected the default shell as the entrypoint but got %v", run.Entrypoint)
+	}
+	if run.User != "0" {
+		t.Errorf("Expected the container to run as root but got %q", run.User)
+	}
+	expected := "export HTTP_PROXY='http://proxy:3128'\nexport PATH=\"/opt/bin:$PATH\"\nmkdir -p"
+	if len(run.Command) != 1 || !strings.HasPrefix(run.Command[0], expected) {
+		t.Errorf("Unexpected command %q", run.Command)
+	}
+}
+
+func TestResolutionQuotesPackages(t *testing.T) {
+	runtime := &FakeRuntime{}
+	request := PackageRequest{
+		Image:          "debian@sha256:abc",
+		Architecture:   "amd64",
+		Packages:       []string{"curl", "git;touch /tmp/x"},
+		TargetReleases: map[string]string{"curl": "bookworm-backports"},
+	}
+	_, err := fetchPackageVersions(context.Background(), runtime, request, map[string][]byte{})
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+	command := runtime.Runs()[0].Command[0]
+	for _, expected := range []string{
+		"-o APT::Default-Release='bookworm-backports' policy -- 'curl'",
+		"policy -- 'git;touch /tmp/x'",
+		"for p in 'git;touch /tmp/x'; do",
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in the command %q", expected, command)
+		}
+	}
+}
+
+func TestProxyEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	for _, key := range proxyVariables {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	config := `{"proxies":{"default":{"httpProxy":"http://proxy:3128","noProxy":"localhost"}}}`
+	err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"HTTP_PROXY=http://proxy:3128",
+		"NO_PROXY=localhost",
+		"http_proxy=http://proxy:3128",
+		"no_proxy=localhost",
+	}
+	if actual := ProxyEnvironment(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+
+	t.Setenv("HTTPS_PROXY", "http://other:8080")
+	expected = []string{"HTTPS_PROXY=http://other:8080"}
+	if actual := ProxyEnvironment(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
@@ -0,0 +1,188 @@
+package anchor
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// lockSuffix matches the suffix lockName adds to a package list, with the architecture it
+// may include, e.g. .amd64.lock in packages.amd64.lock.txt.
+var lockSuffix = regexp.MustCompile(
+	`(\.(` + strings.Join(slices.Sorted(maps.Values(dpkgArchitectures)), "|") + `))?\.lock`,
+)
+
+// MakeTemplate turns an anchored Dockerfile, whether it was anchored by anchor or pinned by
+// hand, back into a template. Digests of tagged images, versions of apt packages and the
+// architecture prefix anchor injects are removed, and package lists copied from their lock
+// file are copied from an unpinned list instead, which is returned in the result. Pins anchor
+// cannot refresh, such as images only referenced by digest and versions with wildcards, are
+// kept with an anchor ignore comment. Nodes ignored with an anchor ignore comment are kept
+// as they are. The progress is written to color.Output.
+func MakeTemplate(nodes []Node, contextDir string) (*Result, error) {
+	w := color.Output
+	result := &Result{Files: []File{}}
+	copies := []*stageCopy{}
+	for i := range nodes {
+		node := &nodes[i]
+		ignored, all := nodeIgnores(node)
+		if all {
+			continue
+		}
+		switch node.CommandType {
+		case CommandFrom:
+			copies = []*stageCopy{}
+			unpinFrom(w, node, ignored)
+		case CommandRun:
+			files, err := unpinRun(w, node, ignored, contextDir, copies)
+			if err != nil {
+				return nil, err
+			}
+			result.Files = append(result.Files, files...)
+		default:
+			if stageCopy := parseStageCopy(node); stageCopy != nil {
+				copies = append(copies, stageCopy)
+			}
+		}
+	}
+	return result, nil
+}
+
+func unpinFrom(w io.Writer, node *Node, ignored []string) {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return
+	}
+	from, ok := instruction.(*FromInstruction)
+	if !ok {
+		return
+	}
+	image, digest := splitImageDigest(from.Image.Value)
+	if digest == "" || slices.Contains(ignored, image) || slices.Contains(ignored, from.Image.Value) {
+		return
+	}
+	if !hasTag(image) {
+		// there is no tag to anchor the image from again
+		addIgnoreComment(node, "")
+		printColor(
+			w, color.FgYellow, "\tKept %s as it has no tag, it is ignored by anchor", from.Image.Value,
+		)
+		return
+	}
+	_ = node.Apply(Edit{Span: from.Image.Span, Text: image})
+	fmt.Fprintf(w, "\tRemoved the digest of %s\n", image)
+}
+
+func unpinRun(
+	w io.Writer, node *Node, ignored []string, contextDir string, copies []*stageCopy,
+) ([]File, error) {
+	instruction, err := node.Instruction()
+	if err != nil {
+		return nil, nil
+	}
+	run, ok := instruction.(*RunInstruction)
+	if !ok {
+		return nil, nil
+	}
+	installs, err := runInstalls(node)
+	if err != nil {
+		if strings.Contains(run.Script, "apt-get") && strings.Contains(run.Script, "=") {
+			addIgnoreComment(node, "")
+			printColor(
+				w, color.FgYellow, "\tKept a RUN command that could not be parsed, it is ignored by anchor",
+			)
+		}
+		return nil, nil
+	}
+
+	edits := []Edit{}
+	kept := []string{}
+	for _, install := range installs {
+		for _, word := range install.Packages {
+			value, ok := word.literal()
+			if !ok || packageVersion(value) == "" {
+				continue
+			}
+			pkg := packageName(value)
+			switch {
+			case slices.Contains(ignored, pkg):
+			case strings.ContainsAny(packageVersion(value), "*?"):
+				// a version pattern is a deliberate range rather than a pin anchor made
+				kept = append(kept, pkg)
+			default:
+				edits = append(edits, Edit{Span: word.Span, Text: pinnedWord(word, pkg)})
+			}
+		}
+	}
+	if !run.Exec {
+		if match := findDpkgPrefix(run.Script); match != nil {
+			edits = append(edits, Edit{Span: Span{Start: match[0], End: match[1]}})
+		}
+	}
+	if err := node.Apply(edits...); err != nil {
+		return nil, err
+	}
+	// the template installs the providers virtual packages were anchored to, so the comment
+	// recording them is not needed
+	setProvidersComment(node, nil)
+	if len(kept) > 0 {
+		addIgnoreComment(node, strings.Join(kept, ","))
+		printColor(
+			w,
+			color.FgYellow,
+			"\tKept the version patterns of %s, they are ignored by anchor",
+			strings.Join(kept, ", "),
+		)
+	}
+
+	files := []File{}
+	lists, err := readPackageLists(w, installs, contextDir, copies)
+	if err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		source := unlockedName(list.Source)
+		if source == list.Source {
+			continue
+		}
+		if err := list.copy.rewrite(list.sourceWord, source, list.Target); err != nil {
+			return nil, err
+		}
+		files = append(files, File{
+			Path:    filepath.Join(contextDir, filepath.FromSlash(source)),
+			Content: list.unpinned(ignored),
+		})
+		fmt.Fprintf(w, "\tCopied package list %s from %s\n", list.Target, source)
+	}
+	return files, nil
+}
+
+// unlockedName returns the name of the list a lock file was generated from, e.g.
+// packages.txt for packages.amd64.lock.txt.
+func unlockedName(source string) string {
+	dir, name := path.Split(source)
+	return dir + lockSuffix.ReplaceAllString(name, "")
+}
+
+// addIgnoreComment adds an anchor ignore comment for the packages or images to a node, or
+// for the whole node when there are none, before its instruction.
+func addIgnoreComment(node *Node, ignored string) {
+	comment := "# anchor ignore"
+	if ignored != "" {
+		comment += "=" + ignored
+	}
+	i := slices.IndexFunc(node.Entries, func(entry Entry) bool {
+		return entry.Type == EntryCommand
+	})
+	if i < 0 {
+		return
+	}
+	node.Entries = slices.Insert(node.Entries, i, Entry{Type: EntryComment, Value: comment + "\n"})
+}
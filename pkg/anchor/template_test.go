@@ -0,0 +1,121 @@
+package anchor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMakeTemplate(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"digest removed",
+			"FROM golang:1.23@sha256:abc AS builder\n",
+			"FROM golang:1.23 AS builder\n",
+		},
+		{
+			"digest only image ignored",
+			"FROM golang@sha256:abc\n",
+			"# anchor ignore\nFROM golang@sha256:abc\n",
+		},
+		{
+			"versions and prefix removed",
+			"FROM debian:bookworm\n" +
+				"RUN dpkg --add-architecture arm64 && apt-get update && apt-get update && " +
+				"apt-get install -y curl=7.88.1 \"git=1:2.39.5\" wget\n",
+			"FROM debian:bookworm\n" +
+				"RUN apt-get update && apt-get install -y curl \"git\" wget\n",
+		},
+		{
+			"providers comment removed",
+			"FROM debian:bookworm\n# anchor providers=mail-transport-agent=exim4-daemon-light\n" +
+				"RUN apt-get install -y exim4-daemon-light=4.96\n",
+			"FROM debian:bookworm\nRUN apt-get install -y exim4-daemon-light\n",
+		},
+		{
+			"version patterns ignored",
+			"FROM debian:bookworm\nRUN apt-get update && apt-get install -y curl=7.88.* git=1:2.39.5\n",
+			"FROM debian:bookworm\n# anchor ignore=curl\n" +
+				"RUN apt-get update && apt-get install -y curl=7.88.* git\n",
+		},
+		{
+			"ignored nodes kept",
+			"# anchor ignore\nFROM debian:bookworm@sha256:abc\n" +
+				"# anchor ignore=curl\nRUN apt-get update && apt-get install -y curl=7.88.1 git=1:2.39.5\n",
+			"# anchor ignore\nFROM debian:bookworm@sha256:abc\n" +
+				"# anchor ignore=curl\nRUN apt-get update && apt-get install -y curl=7.88.1 git\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := Parse(strings.NewReader(tc.input))
+			result, err := MakeTemplate(nodes, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Files) != 0 {
+				t.Errorf("expected no files, got %d", len(result.Files))
+			}
+			var sb strings.Builder
+			if err := nodes.Write(&sb); err != nil {
+				t.Fatal(err)
+			}
+			if sb.String() != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, sb.String())
+			}
+		})
+	}
+}
+
+func TestMakeTemplatePackageList(t *testing.T) {
+	dir := t.TempDir()
+	lock := "# build tools\ncurl=7.88.1 git=1:2.39.5\n# anchor ignore=wget\nwget=1.21.3\n"
+	err := os.WriteFile(filepath.Join(dir, "packages.arm64.lock.txt"), []byte(lock), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := Parse(strings.NewReader("FROM debian:bookworm\n" +
+		"COPY packages.arm64.lock.txt /tmp/packages.txt\n" +
+		"RUN apt-get update && apt-get install -y $(cat /tmp/packages.txt)\n"))
+	result, err := MakeTemplate(nodes, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := nodes.Write(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "COPY packages.txt /tmp/packages.txt\n") {
+		t.Errorf("expected the list to be copied from packages.txt, got:\n%s", sb.String())
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(result.Files))
+	}
+	if result.Files[0].Path != filepath.Join(dir, "packages.txt") {
+		t.Errorf("expected packages.txt, got %s", result.Files[0].Path)
+	}
+	expected := "# build tools\ncurl git\n# anchor ignore=wget\nwget=1.21.3\n"
+	if string(result.Files[0].Content) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result.Files[0].Content)
+	}
+}
+
+func TestUnlockedName(t *testing.T) {
+	cases := map[string]string{
+		"packages.lock.txt":         "packages.txt",
+		"lists/packages.amd64.lock": "lists/packages",
+		"packages.arm64.lock.txt":   "packages.txt",
+		"build.deps.lock.txt":       "build.deps.txt",
+		"packages.txt":              "packages.txt",
+	}
+	for source, expected := range cases {
+		if got := unlockedName(source); got != expected {
+			t.Errorf("unlockedName(%q) = %q, expected %q", source, got, expected)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package anchor
+
+import (
+	"strconv"
+	"strings"
+)
+
+// debianVersion is a parsed [epoch:]upstream_version[-debian_revision] version string.
+type debianVersion struct {
+	epoch    int
+	upstream string
+	revision string
+}
+
+func parseDebianVersion(version string) debianVersion {
+	version = strings.TrimSpace(version)
+	parsed := debianVersion{}
+	if epoch, rest, found := strings.Cut(version, ":"); found {
+		if value, err := strconv.Atoi(epoch); err == nil {
+			parsed.epoch = value
+			version = rest
+		}
+	}
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		parsed.upstream = version[:i]
+		parsed.revision = version[i+1:]
+	} else {
+		parsed.upstream = version
+	}
+	return parsed
+}
+
+// CompareDebianVersions compares two Debian package versions the way dpkg does, returning
+// -1, 0 or 1 when a is lower than, equal to or greater than b. The epoch is compared first,
+// then the upstream version and the Debian revision, in which a tilde sorts before
+// anything, even the end of the version, so 1.0~rc1 is lower than 1.0.
+func CompareDebianVersions(a string, b string) int {
+	va, vb := parseDebianVersion(a), parseDebianVersion(b)
+	if va.epoch != vb.epoch {
+		if va.epoch < vb.epoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareVersionPart(va.upstream, vb.upstream); c != 0 {
+		return c
+	}
+	return compareVersionPart(va.revision, vb.revision)
+}
+
+// versionOrder is the sort weight of a character in the non-digit parts of a version. The
+// tilde sorts before everything, even the end of the part, and letters sort before other
+// characters.
+func versionOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= '0' && c <= '9':
+		return 0
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func compareVersionPart(a string, b string) int {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	for a != "" || b != "" {
+		for a != "" && !isDigit(a[0]) || b != "" && !isDigit(b[0]) {
+			ac, bc := 0, 0
+			if a != "" {
+				ac = versionOrder(a[0])
+			}
+			if b != "" {
+				bc = versionOrder(b[0])
+			}
+			if ac != bc {
+				if ac < bc {
+					return -1
+				}
+				return 1
+			}
+			a, b = a[1:], b[1:]
+		}
+		for a != "" && a[0] == '0' {
+			a = a[1:]
+		}
+		for b != "" && b[0] == '0' {
+			b = b[1:]
+		}
+		firstDiff := 0
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			if firstDiff < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package anchor
+
+import "testing"
+
+func TestCompareDebianVersions(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0", "1.0-0", 0},
+		{"7.88.1-10+deb12u5", "7.88.1-10+deb12u4", 1},
+		{"7.88.1-10+deb12u5", "7.88.1-10", 1},
+		{"1.0a", "1.0+", -1},
+		{"1.0.1", "1.0a", 1},
+		{"2.39.2-1.1", "2.39.2-1", 1},
+		{"2:1.0", "10:0.1", -1},
+		{"1.0-1~bpo12+1", "1.0-1", -1},
+		{"8.11.1-1~bpo12+1", "7.88.1-10+deb12u8", 1},
+		{"1:2.43.0-1ubuntu7.2", "1:2.43.0-1ubuntu7.10", -1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			if actual := CompareDebianVersions(tc.a, tc.b); actual != tc.expected {
+				t.Errorf("Expected %d but got %d", tc.expected, actual)
+			}
+			if actual := CompareDebianVersions(tc.b, tc.a); actual != -tc.expected {
+				t.Errorf("Expected reversed comparison to be %d but got %d", -tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIsDowngrade(t *testing.T) {
+	cases := []struct {
+		previous string
+		version  string
+		expected bool
+	}{
+		{"", "7.88.1-10+deb12u8", false},
+		{"7.88.1-10+deb12u5", "7.88.1-10+deb12u8", false},
+		{"7.88.1-10+deb12u8", "7.88.1-10+deb12u8", false},
+		{"8.11.1-1~bpo12+1", "7.88.1-10+deb12u8", true},
+		{"1:1.0", "2.0", true},
+	}
+	for _, tc := range cases {
+		if actual := isDowngrade(tc.previous, tc.version); actual != tc.expected {
+			t.Errorf("Expected %v for %s to %s but got %v", tc.expected, tc.previous, tc.version, actual)
+		}
+	}
+}
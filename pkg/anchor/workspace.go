@@ -0,0 +1,182 @@
+package anchor
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultTemplatePatterns are the names of the templates FindTemplates looks for when no
+// patterns are given.
+var DefaultTemplatePatterns = []string{"Dockerfile.template", "Containerfile.template"}
+
+// templateSuffix is the suffix of a template, which its output is named without.
+const templateSuffix = ".template"
+
+// FindTemplates returns the templates in the paths, sorted and without duplicates. A path
+// ending in /... is searched recursively, as with ./services/..., any other directory is
+// searched without its subdirectories, and a file is returned as it is. Templates are the
+// files whose name matches one of the glob patterns, such as *.Dockerfile.template. Hidden
+// directories and node_modules are not searched.
+func FindTemplates(paths []string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultTemplatePatterns
+	}
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid template pattern %s: %w", pattern, err)
+		}
+	}
+	matches := func(name string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := filepath.Match(pattern, name)
+			return matched
+		})
+	}
+
+	templates := []string{}
+	for _, root := range paths {
+		root, recursive := strings.CutSuffix(filepath.ToSlash(root), "/...")
+		if root == "..." {
+			root, recursive = ".", true
+		}
+		root = filepath.Clean(filepath.FromSlash(root))
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			templates = append(templates, root)
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if path != root && (!recursive || strings.HasPrefix(entry.Name(), ".") ||
+					entry.Name() == "node_modules") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if matches(entry.Name()) {
+				templates = append(templates, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(templates)
+	return slices.Compact(templates), nil
+}
+
+// TemplateOutput returns the name a template is anchored to, which is its name without the
+// .template suffix, e.g. services/api/Dockerfile for services/api/Dockerfile.template.
+func TemplateOutput(template string) (string, error) {
+	output, ok := strings.CutSuffix(template, templateSuffix)
+	if !ok || filepath.Base(template) == templateSuffix {
+		return "", fmt.Errorf(
+			"cannot name the output of %s, templates must end in %s", template, templateSuffix,
+		)
+	}
+	return output, nil
+}
+
+// PinnedFile is an anchored Dockerfile of a workspace with what it is pinned to.
+type PinnedFile struct {
+	Name string
+	Pins *Pins
+}
+
+// Inconsistency is an image, or a package for an architecture and base image, that the
+// files of a workspace pin differently.
+type Inconsistency struct {
+	// Kind is image or package
+	Kind string
+	Name string
+	// Architecture and Base are the dpkg architecture and base image a package is installed
+	// for, empty for an image
+	Architecture string
+	Base         string
+	// Files are the files pinning each version, or digest for an image, by version
+	Files map[string][]string
+}
+
+func (i Inconsistency) String() string {
+	subject, pins := fmt.Sprintf("image %s", i.Name), "digests"
+	if i.Kind == "package" {
+		subject = fmt.Sprintf("package %s (%s, %s)", i.Name, i.Architecture, i.Base)
+		pins = "versions"
+	}
+	versions := slices.Sorted(maps.Keys(i.Files))
+	files := []string{}
+	for _, version := range versions {
+		files = append(files, fmt.Sprintf("%s in %s", version, strings.Join(i.Files[version], ", ")))
+	}
+	return fmt.Sprintf(
+		"%s is pinned to %d %s: %s", subject, len(versions), pins, strings.Join(files, "; "),
+	)
+}
+
+// CheckConsistency returns the images that the files pin to different digests, and the
+// packages they pin to different versions for the same architecture and base image, sorted
+// by kind and name.
+func CheckConsistency(files []PinnedFile) []Inconsistency {
+	pinned := map[string]*Inconsistency{}
+	add := func(inconsistency Inconsistency, version string, file string) {
+		key := strings.Join([]string{
+			inconsistency.Kind, inconsistency.Name, inconsistency.Architecture, inconsistency.Base,
+		}, "\x00")
+		current, ok := pinned[key]
+		if !ok {
+			inconsistency.Files = map[string][]string{}
+			current = &inconsistency
+			pinned[key] = current
+		}
+		if !slices.Contains(current.Files[version], file) {
+			current.Files[version] = append(current.Files[version], file)
+		}
+	}
+	for _, file := range files {
+		for image, digest := range file.Pins.Images {
+			add(Inconsistency{Kind: "image", Name: image}, digest, file.Name)
+		}
+		for stage, versions := range file.Pins.Packages {
+			for pkg, version := range versions {
+				add(Inconsistency{
+					Kind:         "package",
+					Name:         pkg,
+					Architecture: file.Pins.Architecture,
+					Base:         file.Pins.Bases[stage],
+				}, version, file.Name)
+			}
+		}
+	}
+
+	inconsistencies := []Inconsistency{}
+	for _, inconsistency := range pinned {
+		if len(inconsistency.Files) > 1 {
+			for _, files := range inconsistency.Files {
+				slices.Sort(files)
+			}
+			inconsistencies = append(inconsistencies, *inconsistency)
+		}
+	}
+	slices.SortFunc(inconsistencies, func(a Inconsistency, b Inconsistency) int {
+		return cmp.Or(
+			cmp.Compare(a.Kind, b.Kind),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.Architecture, b.Architecture),
+			cmp.Compare(a.Base, b.Base),
+		)
+	})
+	return inconsistencies
+}
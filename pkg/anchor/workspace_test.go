@@ -0,0 +1,148 @@
+package anchor
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"Dockerfile.template",
+		"services/api/Dockerfile.template",
+		"services/api/Dockerfile",
+		"services/web/Containerfile.template",
+		"services/web/worker.Dockerfile.template",
+		"services/web/node_modules/pkg/Dockerfile.template",
+		"services/.cache/Dockerfile.template",
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("FROM scratch\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	join := func(names ...string) []string {
+		paths := []string{}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		return paths
+	}
+
+	cases := []struct {
+		name     string
+		paths    []string
+		patterns []string
+		expected []string
+	}{
+		{
+			"recursive",
+			[]string{filepath.Join(dir, "services") + "/..."},
+			nil,
+			join("services/api/Dockerfile.template", "services/web/Containerfile.template"),
+		},
+		{
+			"directory without subdirectories",
+			[]string{dir},
+			nil,
+			join("Dockerfile.template"),
+		},
+		{
+			"custom patterns",
+			[]string{dir + "/..."},
+			[]string{"*.Dockerfile.template"},
+			join("services/web/worker.Dockerfile.template"),
+		},
+		{
+			"files and duplicates",
+			[]string{
+				filepath.Join(dir, "services/api") + "/...",
+				filepath.Join(dir, "services/api/Dockerfile.template"),
+			},
+			nil,
+			join("services/api/Dockerfile.template"),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			templates, err := FindTemplates(c.paths, c.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(templates, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, templates)
+			}
+		})
+	}
+
+	if _, err := FindTemplates([]string{dir}, []string{"["}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+	if _, err := FindTemplates([]string{filepath.Join(dir, "missing")}, nil); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+}
+
+func TestTemplateOutput(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+		err      bool
+	}{
+		{"services/api/Dockerfile.template", "services/api/Dockerfile", false},
+		{"worker.Containerfile.template", "worker.Containerfile", false},
+		{"services/api/Dockerfile", "", true},
+		{"services/.template", "", true},
+	}
+	for _, c := range cases {
+		output, err := TemplateOutput(c.template)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.template, c.err, err)
+		}
+		if output != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.template, c.expected, output)
+		}
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	pins := func(digest string, architecture string, curl string) *Pins {
+		return &Pins{
+			Architecture: architecture,
+			Images:       map[string]string{"debian:bookworm-slim": digest},
+			Packages:     map[string]map[string]string{"0": {"curl": curl}},
+			Bases:        map[string]string{"0": "debian:bookworm-slim"},
+		}
+	}
+	files := []PinnedFile{
+		{Name: "api/Dockerfile", Pins: pins("sha256:abc", "amd64", "7.88.1-10")},
+		{Name: "web/Dockerfile.amd64", Pins: pins("sha256:abc", "amd64", "7.88.1-10")},
+		// another architecture may have another version
+		{Name: "web/Dockerfile.arm64", Pins: pins("sha256:abc", "arm64", "7.88.1-11")},
+		{Name: "worker/Dockerfile", Pins: pins("sha256:def", "amd64", "7.88.1-11")},
+	}
+	inconsistencies := CheckConsistency(files)
+	actual := []string{}
+	for _, inconsistency := range inconsistencies {
+		actual = append(actual, inconsistency.String())
+	}
+	expected := []string{
+		"image debian:bookworm-slim is pinned to 2 digests: " +
+			"sha256:abc in api/Dockerfile, web/Dockerfile.amd64, web/Dockerfile.arm64; " +
+			"sha256:def in worker/Dockerfile",
+		"package curl (amd64, debian:bookworm-slim) is pinned to 2 versions: " +
+			"7.88.1-10 in api/Dockerfile, web/Dockerfile.amd64; 7.88.1-11 in worker/Dockerfile",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if inconsistencies := CheckConsistency(files[:3]); len(inconsistencies) != 0 {
+		t.Errorf("expected no inconsistencies, got %v", inconsistencies)
+	}
+}